@@ -43,6 +43,60 @@ type Config struct {
 	TLS              TLSConfig
 	DialContext      func(ctx context.Context, network, addr string) (net.Conn, error)
 	Verbose          bool
+	//ExitSource and ExitInterface optionally set the source IP and
+	//network interface of outbound connections for reverse remotes
+	ExitSource    string
+	ExitInterface string
+	//ExitProxy optionally dials outbound TCP connections for reverse
+	//remotes through an upstream HTTP CONNECT or SOCKS5 proxy
+	ExitProxy       string
+	ExitProxyBypass []string
+	//ExitDNS and ExitHostsFile optionally resolve reverse remote
+	//destinations via a specific DNS server and static hosts
+	ExitDNS       string
+	ExitHostsFile string
+	//DNSDomains optionally restricts the names which dns
+	//remotes resolve through the tunnel
+	DNSDomains []string
+	//Tun optionally creates a TUN interface (Linux only)
+	//and tunnels the traffic routed into it
+	Tun tunnel.TunConfig
+	//Resume keeps the tunnel open while reconnecting, to resume
+	//the session if the server supports it (see --resume-grace)
+	Resume bool
+	//Transport is websocket, http2, poll, tcp or quic. By default,
+	//websockets are used, falling back to the other HTTP
+	//transports when the websocket upgrade fails. The quic
+	//transport does not use DialContext.
+	Transport string
+	//Compress optionally compresses the connections of all
+	//TCP remotes, with zstd or deflate, unless set per remote
+	Compress string
+	//KeepAliveTimeout optionally limits how long to wait for the
+	//reply to a keepalive ping, or websocket ping, and more than
+	//KeepAliveMisses unanswered pings close the connection
+	KeepAliveTimeout time.Duration
+	KeepAliveMisses  int
+	//MaxLatency optionally reconnects once the keepalive
+	//round trip time stays above it, for several pings
+	MaxLatency time.Duration
+	//MinRetryInterval, RetryFactor and RetryJitter configure
+	//the exponential backoff between connection attempts, up
+	//to MaxRetryInterval (see github.com/jpillora/backoff)
+	MinRetryInterval time.Duration
+	RetryFactor      float64
+	RetryJitter      bool
+	//StableAfter is how long a connection must last for the
+	//backoff to be reset (defaults to 5 seconds)
+	StableAfter time.Duration
+	//Hooks are optional callbacks on connection state changes
+	Hooks Hooks
+	//OnEvent optionally receives the events of the client, and of
+	//its remotes and channels, synchronously, see tunnel.Event
+	OnEvent func(tunnel.Event)
+	//Health optionally serves the health of the
+	//client on this address (host:port), see Status
+	Health string
 }
 
 // TLSConfig for a Client
@@ -67,6 +121,20 @@ type Client struct {
 	stop      func()
 	eg        *errgroup.Group
 	tunnel    *tunnel.Tunnel
+	//resumable session, when enabled
+	session *cnet.ResumableConn
+	//token of the session, issued by the server, and the
+	//number of attempts to resume it, see resumeProof
+	resumeToken    cnet.ResumeToken
+	resumeAttempts uint64
+	sessionDone    chan struct{}
+	sessionErr     error
+	//transport which last connected, when automatic
+	transport string
+	//connection state, see Status
+	state clientState
+	//short-circuits the retry wait, see Reconnect
+	retry chan struct{}
 }
 
 // NewClient creates a new client instance
@@ -78,6 +146,9 @@ func NewClient(c *Config) (*Client, error) {
 	if c.MaxRetryInterval < time.Second {
 		c.MaxRetryInterval = 5 * time.Minute
 	}
+	if c.StableAfter <= 0 {
+		c.StableAfter = 5 * time.Second
+	}
 	u, err := url.Parse(c.Server)
 	if err != nil {
 		return nil, err
@@ -99,10 +170,13 @@ func NewClient(c *Config) (*Client, error) {
 		Logger: cio.NewLogger("client"),
 		config: c,
 		computed: settings.Config{
-			Version: chshare.BuildVersion,
+			Version:     chshare.BuildVersion,
+			Compression: cnet.Compressions,
+			UDPFraming:  tunnel.MaxUDPFraming(),
 		},
 		server:    u.String(),
 		tlsConfig: nil,
+		retry:     make(chan struct{}, 1),
 	}
 	//set default log level
 	client.Logger.Info = true
@@ -139,12 +213,25 @@ func NewClient(c *Config) (*Client, error) {
 		}
 		client.tlsConfig = tc
 	}
+	//validate transport
+	if t := c.Transport; t != "" && t != "auto" && t != "quic" && !contains(cnet.Transports, t) {
+		return nil, fmt.Errorf("Unknown transport '%s' (expected auto, %s, quic)", t, strings.Join(cnet.Transports, ", "))
+	}
+	if c.Compress != "" && !contains(cnet.Compressions, c.Compress) {
+		return nil, fmt.Errorf("Unknown compression '%s' (expected %s)", c.Compress, strings.Join(cnet.Compressions, ", "))
+	}
+	if c.Transport == "quic" && (c.Proxy != "" || c.Resume) {
+		return nil, errors.New("The quic transport cannot be used with --proxy or --resume")
+	}
 	//validate remotes
 	for _, s := range c.Remotes {
 		r, err := settings.DecodeRemote(s)
 		if err != nil {
 			return nil, fmt.Errorf("Failed to decode remote '%s': %s", s, err)
 		}
+		if r.Compress == "" && c.Compress != "" && r.CanCompress() {
+			r.Compress = c.Compress
+		}
 		if r.Socks {
 			hasSocks = true
 		}
@@ -179,13 +266,37 @@ func NewClient(c *Config) (*Client, error) {
 		HostKeyCallback: client.verifyServer,
 		Timeout:         settings.EnvDuration("SSH_TIMEOUT", 30*time.Second),
 	}
+	//outbound source for reverse remotes
+	dialer, err := cnet.NewDialer(cnet.DialerConfig{
+		Source:      c.ExitSource,
+		Interface:   c.ExitInterface,
+		Proxy:       c.ExitProxy,
+		ProxyBypass: c.ExitProxyBypass,
+	})
+	if err != nil {
+		return nil, err
+	}
+	resolver, err := cnet.NewResolver(cnet.ResolverConfig{
+		Server:    c.ExitDNS,
+		HostsFile: c.ExitHostsFile,
+	}, dialer)
+	if err != nil {
+		return nil, err
+	}
 	//prepare client tunnel
 	client.tunnel = tunnel.New(tunnel.Config{
-		Logger:    client.Logger,
-		Inbound:   true, //client always accepts inbound
-		Outbound:  hasReverse,
-		Socks:     hasReverse && hasSocks,
-		KeepAlive: client.config.KeepAlive,
+		Logger:           client.Logger,
+		Inbound:          true, //client always accepts inbound
+		Outbound:         hasReverse,
+		Socks:            hasReverse && hasSocks,
+		KeepAlive:        client.config.KeepAlive,
+		MaxLatency:       client.config.MaxLatency,
+		KeepAliveTimeout: client.config.KeepAliveTimeout,
+		KeepAliveMisses:  client.config.KeepAliveMisses,
+		Dialer:           dialer,
+		Resolver:         resolver,
+		DNSDomains:       c.DNSDomains,
+		OnEvent:          c.OnEvent,
 	})
 	return client, nil
 }
@@ -247,6 +358,13 @@ func (c *Client) Start(ctx context.Context) error {
 		via = " via " + c.proxyURL.String()
 	}
 	c.Infof("Connecting to %s%s\n", c.server, via)
+	//optional health endpoint
+	if c.config.Health != "" {
+		if err := c.serveHealth(ctx); err != nil {
+			cancel()
+			return err
+		}
+	}
 	//connect to chisel server
 	eg.Go(func() error {
 		return c.connectionLoop(ctx)
@@ -259,6 +377,12 @@ func (c *Client) Start(ctx context.Context) error {
 		}
 		return c.tunnel.BindRemotes(ctx, clientInbound)
 	})
+	//tun interface
+	if c.config.Tun.Name != "" {
+		eg.Go(func() error {
+			return c.tunnel.BindTun(ctx, c.config.Tun)
+		})
+	}
 	return nil
 }
 
@@ -5,27 +5,40 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"strings"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/jpillora/backoff"
-	chshare "github.com/jpillora/chisel/share"
 	"github.com/jpillora/chisel/share/cnet"
 	"github.com/jpillora/chisel/share/cos"
 	"github.com/jpillora/chisel/share/settings"
+	"github.com/jpillora/chisel/share/tunnel"
 	"golang.org/x/crypto/ssh"
 )
 
 func (c *Client) connectionLoop(ctx context.Context) error {
 	//connection loop!
-	b := &backoff.Backoff{Max: c.config.MaxRetryInterval}
+	b := &backoff.Backoff{
+		Min:    c.config.MinRetryInterval,
+		Max:    c.config.MaxRetryInterval,
+		Factor: c.config.RetryFactor,
+		Jitter: c.config.RetryJitter,
+	}
 	for {
 		connected, err := c.connectionOnce(ctx)
+		c.setConnected(false, 0, err)
 		//reset backoff after successful connections
 		if connected {
 			b.Reset()
 		}
+		//the server is shutting down, reconnect now,
+		//which should reach another server
+		if errors.Is(err, tunnel.ErrDrained) {
+			c.Infof("Server is draining, reconnecting...")
+			b.Reset()
+			continue
+		}
 		//connection error
 		attempt := int(b.Attempt())
 		maxAttempt := c.config.MaxRetryCount
@@ -48,13 +61,21 @@ func (c *Client) connectionLoop(ctx context.Context) error {
 		//give up?
 		if maxAttempt >= 0 && attempt >= maxAttempt {
 			c.Infof("Give up")
+			c.config.Hooks.giveUp(err)
 			break
 		}
 		d := b.Duration()
 		c.Infof("Retrying in %s...", d)
+		//drop retries requested while connected
+		select {
+		case <-c.retry:
+		default:
+		}
 		select {
 		case <-cos.AfterSignal(d):
 			continue //retry now
+		case <-c.retry:
+			continue
 		case <-ctx.Done():
 			c.Infof("Cancelled")
 			return nil
@@ -73,62 +94,159 @@ func (c *Client) connectionOnce(ctx context.Context) (connected bool, err error)
 	default:
 		//still open
 	}
+	parent := ctx
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	//prepare dialer
-	d := websocket.Dialer{
-		HandshakeTimeout: settings.EnvDuration("WS_TIMEOUT", 45*time.Second),
-		Subprotocols:     []string{chshare.ProtocolVersion},
-		TLSClientConfig:  c.tlsConfig,
-		ReadBufferSize:   settings.EnvInt("WS_BUFF_SIZE", 0),
-		WriteBufferSize:  settings.EnvInt("WS_BUFF_SIZE", 0),
-		NetDialContext:   c.config.DialContext,
-	}
-	//optional proxy
-	if p := c.proxyURL; p != nil {
-		if err := c.setProxy(p, &d); err != nil {
-			return false, err
+	//optional session resumption
+	headers := c.config.Headers
+	if c.config.Resume {
+		if c.session != nil && c.session.Err() != nil {
+			c.Infof("Previous session expired")
+			c.endSession()
+		}
+		headers = http.Header{}
+		for k, v := range c.config.Headers {
+			headers[k] = v
 		}
+		headers.Set(cnet.ResumeHeader, c.resumeProof())
 	}
-	wsConn, _, err := d.DialContext(ctx, c.server, c.config.Headers)
+	conn, respHeader, err := c.dial(ctx, headers)
 	if err != nil {
 		return false, err
 	}
-	conn := cnet.NewWebSocketConn(wsConn)
+	var session *cnet.ResumableConn
+	var attached <-chan struct{}
+	if c.config.Resume {
+		status := respHeader.Get(cnet.ResumeHeader)
+		if c.session != nil {
+			if status == "resumed" {
+				return c.resumeSession(ctx, conn)
+			}
+			c.Infof("Previous session expired")
+			c.endSession()
+		}
+		if status == "new" {
+			grace, _ := time.ParseDuration(respHeader.Get(cnet.ResumeGraceHeader))
+			session = cnet.NewResumableConn(grace, settings.EnvInt("RESUME_BUFFER", 4<<20))
+			if attached, err = session.Attach(conn); err != nil {
+				return false, err
+			}
+			conn = session
+		} else {
+			c.Debugf("Server does not support session resumption")
+		}
+	}
 	// perform SSH handshake on net.Conn
 	c.Debugf("Handshaking...")
 	sshConn, chans, reqs, err := ssh.NewClientConn(conn, "", c.sshConfig)
 	if err != nil {
+		if session != nil {
+			session.Close()
+		}
 		e := err.Error()
 		if strings.Contains(e, "unable to authenticate") {
 			c.Infof("Authentication failed")
 			c.Debugf(e)
+			c.config.Hooks.authFailure(err)
+			c.emit(tunnel.Event{Type: tunnel.EventAuthFailed, Addr: c.server, Err: err})
 		} else {
 			c.Infof(e)
 		}
 		return false, err
 	}
-	defer sshConn.Close()
+	if session == nil {
+		defer func() {
+			//drained connections are closed by the
+			//server, once their open streams finish
+			if !errors.Is(err, tunnel.ErrDrained) {
+				sshConn.Close()
+			}
+		}()
+	}
+	//the channels of the quic transport are QUIC streams, and the
+	//config proves to the server that there is no proxy between them
+	config := c.computed
+	if qc, ok := conn.(*cnet.QUICConn); ok {
+		if config.Binding, err = qc.Binding(); err != nil {
+			return false, err
+		}
+		sshConn, chans = tunnel.WithQUIC(sshConn, chans, qc.QUIC())
+	}
 	// chisel client handshake (reverse of server handshake)
 	// send configuration
 	c.Debugf("Sending config")
 	t0 := time.Now()
-	_, configerr, err := sshConn.SendRequest(
+	ok, reply, err := sshConn.SendRequest(
 		"config",
 		true,
-		settings.EncodeConfig(c.computed),
+		settings.EncodeConfig(config),
 	)
 	if err != nil {
 		c.Infof("Config verification failed")
+		if session != nil {
+			sshConn.Close()
+		}
 		return false, err
 	}
-	if len(configerr) > 0 {
-		return false, errors.New(string(configerr))
+	if !ok {
+		if session != nil {
+			sshConn.Close()
+		}
+		err := errors.New(string(reply))
+		c.emit(tunnel.Event{Type: tunnel.EventConfigRejected, Addr: c.server, Err: err})
+		return false, err
+	}
+	//newer servers reply with their config
+	server := &settings.Config{}
+	if len(reply) > 0 {
+		if server, err = settings.DecodeConfig(reply); err != nil {
+			if session != nil {
+				sshConn.Close()
+			}
+			return false, err
+		}
+	}
+	if session != nil {
+		//the token is sent within the ssh connection
+		c.resumeToken, c.resumeAttempts = cnet.ResumeToken{}, 0
+		if t, err := cnet.ParseResumeToken(server.Resume); err == nil {
+			c.resumeToken = t
+		} else {
+			c.Infof("Server did not issue a session token, the session is not resumable")
+		}
+	}
+	c.setServerCompression(server.Compression)
+	c.tunnel.SetPeerUDPFraming(server.UDPFraming)
+	latency := time.Since(t0)
+	c.Infof("Connected (Latency %s)", latency)
+	c.setConnected(true, latency, nil)
+	if session != nil {
+		//the tunnel outlives this connection, until the session ends
+		c.session = session
+		c.sessionDone = make(chan struct{})
+		go func(done chan struct{}) {
+			c.sessionErr = c.tunnel.BindSSH(parent, sshConn, reqs, chans)
+			close(done)
+		}(c.sessionDone)
+		return c.waitSession(ctx, attached, t0)
 	}
-	c.Infof("Connected (Latency %s)", time.Since(t0))
 	//connected, handover ssh connection for tunnel to use, and block
 	err = c.tunnel.BindSSH(ctx, sshConn, reqs, chans)
-	c.Infof("Disconnected")
-	connected = time.Since(t0) > 5*time.Second
+	c.disconnected()
+	if err == tunnel.ErrDrained {
+		return true, err
+	}
+	connected = time.Since(t0) > c.config.StableAfter
 	return connected, err
 }
+
+// setServerCompression sets the compression algorithms the
+// server supports, warning when compressed remotes cannot be
+func (c *Client) setServerCompression(algs []string) {
+	c.tunnel.SetPeerCompression(algs)
+	for _, r := range c.computed.Remotes {
+		if r.Compress != "" && !contains(algs, r.Compress) {
+			c.Infof("Server does not support %s compression (%s)", r.Compress, r)
+		}
+	}
+}
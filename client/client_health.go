@@ -0,0 +1,162 @@
+package chclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jpillora/chisel/share/cnet"
+	"github.com/jpillora/chisel/share/tunnel"
+)
+
+// clientState is the connection state of a client
+type clientState struct {
+	sync.Mutex
+	connected   bool
+	since       time.Time
+	latency     time.Duration
+	connections int
+}
+
+// Status is the state of a client, see Config.Health
+type Status struct {
+	Connected bool `json:"connected"`
+	//Since is when the client connected or disconnected
+	Since time.Time `json:"since"`
+	//Latency is the round trip time of the last keepalive
+	//ping, or of the config request until the first ping
+	Latency time.Duration `json:"latency"`
+	//LatencyStats are the keepalive round trip
+	//times of the current connection
+	LatencyStats tunnel.LatencyStats `json:"latency_stats"`
+	//Reconnects counts the connections after the first
+	Reconnects int                  `json:"reconnects"`
+	Remotes    []tunnel.ProxyStatus `json:"remotes"`
+}
+
+// setConnected records the client connecting, with the latency
+// of the config request, or disconnecting, with the error of the
+// connection, calling the hooks and sending the event on changes
+func (c *Client) setConnected(connected bool, latency time.Duration, err error) {
+	c.state.Lock()
+	changed := c.state.connected != connected
+	since := c.state.since
+	if changed {
+		c.state.connected = connected
+		c.state.since = time.Now()
+		c.state.latency = latency
+		if connected {
+			c.state.connections++
+		}
+	}
+	c.state.Unlock()
+	if !changed {
+		return
+	}
+	if connected {
+		c.config.Hooks.connect()
+		c.emit(tunnel.Event{Type: tunnel.EventConnected, Addr: c.server})
+		return
+	}
+	c.config.Hooks.disconnect(err)
+	c.emit(tunnel.Event{
+		Type:     tunnel.EventDisconnected,
+		Addr:     c.server,
+		Duration: time.Since(since),
+		Err:      err,
+	})
+}
+
+// Status returns the current state of the client
+func (c *Client) Status() Status {
+	c.state.Lock()
+	s := Status{
+		Connected: c.state.connected,
+		Since:     c.state.since,
+		Latency:   c.state.latency,
+	}
+	if c.state.connections > 1 {
+		s.Reconnects = c.state.connections - 1
+	}
+	c.state.Unlock()
+	if !s.Connected {
+		s.Latency = 0
+	} else if l := c.tunnel.Latency(); l.Pings > 0 {
+		s.Latency = l.Last
+		s.LatencyStats = l
+	}
+	s.Remotes = c.tunnel.Proxies()
+	return s
+}
+
+// disconnected logs the disconnect, with the
+// latency of the connection, when it was pinged
+func (c *Client) disconnected() {
+	if l := c.tunnel.Latency(); l.Pings > 0 {
+		c.Infof("Disconnected (Latency %s)", l)
+		return
+	}
+	c.Infof("Disconnected")
+}
+
+// LatencyStats describes the keepalive round trip times
+// of the current connection, see cos.GoStats
+func (c *Client) LatencyStats() string {
+	return "latency: " + c.tunnel.Latency().String()
+}
+
+// serveHealth serves the health endpoints until ctx is done
+func (c *Client) serveHealth(ctx context.Context) error {
+	h := cnet.NewHTTPServer()
+	if err := h.GoListenAndServeContext(ctx, c.config.Health, http.HandlerFunc(c.handleHealth)); err != nil {
+		return err
+	}
+	c.Infof("Health on http://%s", c.config.Health)
+	return nil
+}
+
+// handleHealth responds to /healthz with 503 while disconnected,
+// to /readyz with 503 until all remotes are also listening, to
+// /status with the Status of the client, and to /metrics with
+// its connection and latency in the Prometheus text format
+func (c *Client) handleHealth(w http.ResponseWriter, r *http.Request) {
+	s := c.Status()
+	switch r.URL.Path {
+	case "/healthz":
+		if !s.Connected {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("Disconnected\n"))
+			return
+		}
+		w.Write([]byte("OK\n"))
+	case "/readyz":
+		ready := s.Connected
+		for _, r := range s.Remotes {
+			ready = ready && r.Listening
+		}
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("Not ready\n"))
+			return
+		}
+		w.Write([]byte("OK\n"))
+	case "/status":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	case "/metrics":
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		connected := 0
+		if s.Connected {
+			connected = 1
+		}
+		fmt.Fprintf(w, "# HELP chisel_connected Whether the client is connected.\n# TYPE chisel_connected gauge\nchisel_connected %d\n", connected)
+		fmt.Fprintf(w, "# HELP chisel_reconnects_total Connections after the first.\n# TYPE chisel_reconnects_total counter\nchisel_reconnects_total %d\n", s.Reconnects)
+		tunnel.WriteLatencyMetrics(w, map[string]tunnel.LatencyStats{"": s.LatencyStats})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found"))
+	}
+}
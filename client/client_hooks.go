@@ -0,0 +1,55 @@
+package chclient
+
+import "github.com/jpillora/chisel/share/tunnel"
+
+// Hooks are optional callbacks on changes of the connection state.
+// They are called from the connection loop, and should not block.
+type Hooks struct {
+	//Connect is called once connected (or resumed)
+	Connect func()
+	//Disconnect is called once a connection ends
+	Disconnect func(err error)
+	//AuthFailure is called when the server rejects the credentials
+	AuthFailure func(err error)
+	//GiveUp is called when the client stops retrying,
+	//after MaxRetryCount attempts, with the last error
+	GiveUp func(err error)
+}
+
+func (h Hooks) connect() {
+	if h.Connect != nil {
+		h.Connect()
+	}
+}
+
+func (h Hooks) disconnect(err error) {
+	if h.Disconnect != nil {
+		h.Disconnect(err)
+	}
+}
+
+func (h Hooks) authFailure(err error) {
+	if h.AuthFailure != nil {
+		h.AuthFailure(err)
+	}
+}
+
+func (h Hooks) giveUp(err error) {
+	if h.GiveUp != nil {
+		h.GiveUp(err)
+	}
+}
+
+// emit sends the event to Config.OnEvent, if set
+func (c *Client) emit(e tunnel.Event) {
+	tunnel.Emit(c.config.OnEvent, e)
+}
+
+// Reconnect retries now, when the client is waiting
+// to retry, like a SIGHUP does
+func (c *Client) Reconnect() {
+	select {
+	case c.retry <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,80 @@
+package chclient
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"github.com/jpillora/chisel/share/cnet"
+	"github.com/jpillora/chisel/share/tunnel"
+)
+
+// resumeProof returns the ResumeHeader value, proving the client
+// holds the token of its session, or requesting a new session
+func (c *Client) resumeProof() string {
+	if c.session == nil || c.resumeToken.ID == "" {
+		return cnet.ResumeNew
+	}
+	c.resumeAttempts++
+	return c.resumeToken.Proof(c.resumeAttempts)
+}
+
+// resumeSession attaches the new connection to the current
+// session, so its ssh connection and streams continue
+func (c *Client) resumeSession(ctx context.Context, conn net.Conn) (bool, error) {
+	t0 := time.Now()
+	attached, err := c.session.Attach(conn)
+	if err != nil {
+		if c.session.Err() != nil {
+			c.Infof("Failed to resume session (%s)", err)
+			c.endSession()
+		}
+		return false, err
+	}
+	c.Infof("Resumed session")
+	c.setConnected(true, time.Since(t0), nil)
+	return c.waitSession(ctx, attached, t0)
+}
+
+// waitSession blocks until the connection of the session drops,
+// which may be resumed, or until the session itself ends
+func (c *Client) waitSession(ctx context.Context, attached <-chan struct{}, t0 time.Time) (bool, error) {
+	select {
+	case <-attached:
+	case <-c.sessionDone:
+	case <-ctx.Done():
+	}
+	connected := time.Since(t0) > c.config.StableAfter
+	select {
+	case <-c.sessionDone:
+		if c.sessionErr == tunnel.ErrDrained {
+			//the server closes the session, once its open
+			//streams finish, so it is left open but not resumed
+			c.session = nil
+			c.disconnected()
+			return true, tunnel.ErrDrained
+		}
+	default:
+	}
+	if c.session.Err() == nil && ctx.Err() == nil {
+		c.Infof("Connection lost, resuming session...")
+		return connected, io.EOF
+	}
+	//closed or cancelled, wait for the tunnel to finish
+	<-c.sessionDone
+	err := c.session.Err()
+	c.session = nil
+	c.disconnected()
+	if err == io.EOF || err == net.ErrClosed {
+		err = io.EOF
+	}
+	return connected, err
+}
+
+// endSession closes the current session and waits for its tunnel
+func (c *Client) endSession() {
+	c.session.Close()
+	<-c.sessionDone
+	c.session = nil
+}
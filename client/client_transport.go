@@ -0,0 +1,246 @@
+package chclient
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	chshare "github.com/jpillora/chisel/share"
+	"github.com/jpillora/chisel/share/cnet"
+	"github.com/jpillora/chisel/share/settings"
+)
+
+// dial connects to the server with the configured transport,
+// returning the connection and the server's response headers.
+// By default, websockets are used, and when their upgrade fails,
+// the other HTTP transports which the server lists are tried.
+func (c *Client) dial(ctx context.Context, headers http.Header) (net.Conn, http.Header, error) {
+	if t := c.config.Transport; t != "" && t != "auto" {
+		return c.dialTransport(ctx, t, headers)
+	}
+	//start with the transport which last connected
+	first := c.transport
+	if first == "" {
+		first = "websocket"
+	}
+	conn, h, err := c.dialTransport(ctx, first, headers)
+	if err == nil {
+		c.transport = first
+		return conn, h, nil
+	}
+	c.transport = ""
+	//fall back, if the server supports other transports
+	supported := cnet.ParseTransports(h)
+	if len(supported) > 0 {
+		c.Infof("Transport %s failed (%s)", first, err)
+	}
+	for _, t := range cnet.Transports {
+		if t == first || t == "tcp" || !contains(supported, t) {
+			continue
+		}
+		c.Infof("Falling back to %s", t)
+		conn, h, err2 := c.dialTransport(ctx, t, headers)
+		if err2 == nil {
+			c.transport = t
+			return conn, h, nil
+		}
+		c.Debugf("Transport %s failed (%s)", t, err2)
+	}
+	return nil, nil, err
+}
+
+// dialTransport connects to the server with the given transport
+func (c *Client) dialTransport(ctx context.Context, transport string, headers http.Header) (net.Conn, http.Header, error) {
+	h := http.Header{}
+	for k, v := range headers {
+		h[k] = v
+	}
+	h.Set(cnet.ProtocolHeader, chshare.ProtocolVersion)
+	h.Set(cnet.TransportHeader, transport)
+	c.Debugf("Connecting via %s", transport)
+	var conn net.Conn
+	var resp *http.Response
+	var err error
+	switch transport {
+	case "websocket":
+		return c.dialWebsocket(ctx, h)
+	case "http2":
+		conn, resp, err = cnet.DialHTTPStream(ctx, c.httpClient(true), c.httpURL(), h)
+	case "poll":
+		conn, resp, err = cnet.DialPoll(ctx, c.httpClient(false), c.httpURL(), h)
+	case "tcp":
+		return c.dialRaw(ctx, h)
+	case "quic":
+		return c.dialQUIC(ctx)
+	default:
+		return nil, nil, fmt.Errorf("unknown transport: %s", transport)
+	}
+	if resp == nil {
+		return conn, nil, err
+	}
+	return conn, resp.Header, err
+}
+
+func (c *Client) dialWebsocket(ctx context.Context, headers http.Header) (net.Conn, http.Header, error) {
+	d := websocket.Dialer{
+		HandshakeTimeout: settings.EnvDuration("WS_TIMEOUT", 45*time.Second),
+		Subprotocols:     []string{chshare.ProtocolVersion},
+		TLSClientConfig:  c.tlsConfig,
+		ReadBufferSize:   settings.EnvInt("WS_BUFF_SIZE", 0),
+		WriteBufferSize:  settings.EnvInt("WS_BUFF_SIZE", 0),
+		NetDialContext:   c.config.DialContext,
+	}
+	//optional proxy
+	if p := c.proxyURL; p != nil {
+		if err := c.setProxy(p, &d); err != nil {
+			return nil, nil, err
+		}
+	}
+	wsConn, resp, err := d.DialContext(ctx, c.server, headers)
+	if err != nil {
+		if resp != nil {
+			return nil, resp.Header, err
+		}
+		return nil, nil, err
+	}
+	conn := cnet.NewWebSocketConn(wsConn)
+	if c.config.KeepAlive > 0 && c.config.KeepAliveTimeout > 0 {
+		go cnet.WebSocketKeepAlive(conn, settings.EnvDuration("WS_PING", 5*time.Second), c.config.KeepAliveTimeout, c.config.KeepAliveMisses)
+	}
+	return conn, resp.Header, nil
+}
+
+// httpClient creates the client of the http2 and poll transports,
+// where http2 streams require HTTP/2, cleartext (h2c) or over TLS
+func (c *Client) httpClient(http2 bool) *http.Client {
+	timeout := settings.EnvDuration("WS_TIMEOUT", 45*time.Second)
+	t := &http.Transport{
+		TLSClientConfig:     c.tlsConfig,
+		DialContext:         c.config.DialContext,
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: timeout,
+	}
+	if u := c.proxyURL; u != nil {
+		p := *u
+		if p.Scheme == "socks" {
+			p.Scheme = "socks5h"
+		}
+		t.Proxy = http.ProxyURL(&p)
+	}
+	client := &http.Client{Transport: t}
+	if http2 {
+		t.Protocols = &http.Protocols{}
+		t.Protocols.SetHTTP2(true)
+		t.Protocols.SetUnencryptedHTTP2(true)
+		t.ResponseHeaderTimeout = timeout
+	} else {
+		client.Timeout = settings.EnvDuration("POLL_TIMEOUT", 25*time.Second) + timeout
+	}
+	return client
+}
+
+func (c *Client) httpURL() string {
+	return "http" + strings.TrimPrefix(c.server, "ws")
+}
+
+// dialRaw connects over tcp (or tls for https servers) without
+// http, exchanging the protocol version and headers before ssh
+func (c *Client) dialRaw(ctx context.Context, headers http.Header) (net.Conn, http.Header, error) {
+	u, err := url.Parse(c.server)
+	if err != nil {
+		return nil, nil, err
+	}
+	timeout := settings.EnvDuration("WS_TIMEOUT", 45*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var conn net.Conn
+	if c.proxyURL != nil {
+		var d *cnet.Dialer
+		if d, err = cnet.NewDialer(cnet.DialerConfig{Proxy: c.proxyURL.String()}); err != nil {
+			return nil, nil, err
+		}
+		conn, err = d.DialContext(ctx, "tcp", u.Host)
+	} else if c.config.DialContext != nil {
+		conn, err = c.config.DialContext(ctx, "tcp", u.Host)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", u.Host)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if u.Scheme == "wss" {
+		tc := c.tlsConfig.Clone()
+		tc.NextProtos = []string{cnet.TransportALPN}
+		if tc.ServerName == "" {
+			tc.ServerName = u.Hostname()
+		}
+		tlsConn := tls.Client(conn, tc)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		if tlsConn.ConnectionState().NegotiatedProtocol != cnet.TransportALPN {
+			conn.Close()
+			return nil, nil, errors.New("server does not support the tcp transport")
+		}
+		conn = tlsConn
+	}
+	if err := cnet.WriteRawHeader(conn, chshare.ProtocolVersion, headers); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	status, h, raw, err := cnet.ReadRawHeader(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if !strings.HasPrefix(status, "200 ") {
+		conn.Close()
+		return nil, h, fmt.Errorf("server rejected connection: %s", status)
+	}
+	conn.SetDeadline(time.Time{})
+	return raw, h, nil
+}
+
+// dialQUIC connects over QUIC to the udp port of the server. The
+// server is verified by its ssh fingerprint, and for https servers,
+// by its certificate too, otherwise it may use a self-signed one.
+func (c *Client) dialQUIC(ctx context.Context) (net.Conn, http.Header, error) {
+	u, err := url.Parse(c.server)
+	if err != nil {
+		return nil, nil, err
+	}
+	tc := &tls.Config{InsecureSkipVerify: true}
+	if u.Scheme == "wss" {
+		tc = c.tlsConfig.Clone()
+		if tc.ServerName == "" {
+			tc.ServerName = u.Hostname()
+		}
+	}
+	tc.NextProtos = []string{cnet.TransportALPN}
+	ctx, cancel := context.WithTimeout(ctx, settings.EnvDuration("WS_TIMEOUT", 45*time.Second))
+	defer cancel()
+	conf := cnet.QUICConfig(settings.EnvInt("QUIC_MAX_STREAMS", 1000))
+	conn, err := cnet.DialQUIC(ctx, u.Host, tc, conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, http.Header{}, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
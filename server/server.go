@@ -4,11 +4,13 @@ import (
 	"context"
 	"errors"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"regexp"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -17,7 +19,9 @@ import (
 	"github.com/jpillora/chisel/share/cio"
 	"github.com/jpillora/chisel/share/cnet"
 	"github.com/jpillora/chisel/share/settings"
+	"github.com/jpillora/chisel/share/tunnel"
 	"github.com/jpillora/requestlog"
+	"github.com/quic-go/quic-go"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -32,19 +36,86 @@ type Config struct {
 	Reverse   bool
 	KeepAlive time.Duration
 	TLS       TLSConfig
+	//KeepAliveTimeout optionally limits how long to wait for the
+	//reply to a keepalive ping, or websocket ping, and more than
+	//KeepAliveMisses unanswered pings close the connection
+	KeepAliveTimeout time.Duration
+	KeepAliveMisses  int
+	//LoginAttempts is the number of failed logins allowed per
+	//source IP and per username before a temporary ban (0 disables)
+	LoginAttempts int
+	//LoginBan is the initial ban duration, doubled on each repeated ban
+	LoginBan time.Duration
+	//LoginAllow lists trusted networks which are never banned
+	LoginAllow []string
+	//AllowIP and DenyIP restrict which client networks
+	//may connect, DenyIP taking precedence
+	AllowIP []string
+	DenyIP  []string
+	//TrustedProxies lists the networks of proxies whose
+	//X-Forwarded-For header is used to find the client IP
+	TrustedProxies []string
+	//ExitAllow and ExitDeny restrict which networks the server
+	//dials on behalf of any client, ExitDeny taking precedence
+	ExitAllow []string
+	ExitDeny  []string
+	//ExitSource and ExitInterface optionally set the source
+	//IP and network interface of outbound connections
+	ExitSource    string
+	ExitInterface string
+	//ExitProxy optionally dials outbound TCP connections through an
+	//upstream HTTP CONNECT or SOCKS5 proxy, except ExitProxyBypass
+	ExitProxy       string
+	ExitProxyBypass []string
+	//ExitDNS and ExitHostsFile optionally resolve outbound
+	//destinations via a specific DNS server and static hosts
+	ExitDNS       string
+	ExitHostsFile string
+	//ResumeGrace is how long the session of a disconnected client is
+	//kept, for the client to reconnect and resume it (0 disables)
+	ResumeGrace time.Duration
+	//QUIC also listens for clients of the QUIC transport,
+	//on the udp port of the same address
+	QUIC bool
+	//HealthPath optionally serves the healthz and readyz
+	//endpoints under this path, e.g. / or /chisel
+	HealthPath string
+	//OnEvent optionally receives the events of all sessions, and
+	//of their remotes and channels, synchronously, see tunnel.Event
+	OnEvent func(tunnel.Event)
 }
 
 // Server respresent a chisel service
 type Server struct {
 	*cio.Logger
-	config       *Config
-	fingerprint  string
-	httpServer   *cnet.HTTPServer
-	reverseProxy *httputil.ReverseProxy
-	sessCount    int32
-	sessions     *settings.Users
-	sshConfig    *ssh.ServerConfig
-	users        *settings.UserIndex
+	config         *Config
+	fingerprint    string
+	httpServer     *cnet.HTTPServer
+	logins         *loginLimiter
+	allowIPs       settings.CIDRs
+	denyIPs        settings.CIDRs
+	trustedProxies settings.CIDRs
+	exitAllow      settings.CIDRs
+	exitDeny       settings.CIDRs
+	exitDialer     *cnet.Dialer
+	exitResolver   *cnet.Resolver
+	reverseProxy   *httputil.ReverseProxy
+	backend        string
+	sessCount      int32
+	sessions       *settings.Users
+	resumables     *resumables
+	polls          *polls
+	quic           *quic.Listener
+	udp            net.PacketConn
+	ln             *handoffListener
+	sockets        []socket
+	tunnels        *tunnels
+	drain          int32
+	started        time.Time
+	sshConfig      *ssh.ServerConfig
+	users          *settings.UserIndex
+	backendMut     sync.Mutex
+	backendCheck   *HealthCheck
 }
 
 var upgrader = websocket.Upgrader{
@@ -60,9 +131,48 @@ func NewServer(c *Config) (*Server, error) {
 		httpServer: cnet.NewHTTPServer(),
 		Logger:     cio.NewLogger("server"),
 		sessions:   settings.NewUsers(),
+		resumables: &resumables{m: map[string]*resumable{}, max: settings.EnvInt("RESUME_SESSIONS", 8)},
+		polls:      &polls{m: map[string]*cnet.PollConn{}},
+		tunnels: &tunnels{
+			m:     map[*tunnel.Tunnel]ssh.Conn{},
+			names: map[*tunnel.Tunnel]string{},
+		},
 	}
 	server.Info = true
 	server.users = settings.NewUserIndex(server.Logger)
+	if c.LoginAttempts > 0 {
+		trusted, err := settings.ParseCIDRs(c.LoginAllow)
+		if err != nil {
+			return nil, err
+		}
+		server.logins = newLoginLimiter(server.Logger, c.LoginAttempts, c.LoginBan, trusted)
+	}
+	var err error
+	if server.allowIPs, err = settings.ParseCIDRs(c.AllowIP); err != nil {
+		return nil, err
+	}
+	if server.denyIPs, err = settings.ParseCIDRs(c.DenyIP); err != nil {
+		return nil, err
+	}
+	if server.trustedProxies, err = settings.ParseCIDRs(c.TrustedProxies); err != nil {
+		return nil, err
+	}
+	if server.exitAllow, err = settings.ParseCIDRs(c.ExitAllow); err != nil {
+		return nil, err
+	}
+	if server.exitDeny, err = settings.ParseCIDRs(c.ExitDeny); err != nil {
+		return nil, err
+	}
+	if server.exitDialer, err = cnet.NewDialer(c.exitDialerConfig()); err != nil {
+		return nil, err
+	}
+	server.exitResolver, err = cnet.NewResolver(cnet.ResolverConfig{
+		Server:    c.ExitDNS,
+		HostsFile: c.ExitHostsFile,
+	}, server.exitDialer)
+	if err != nil {
+		return nil, err
+	}
 	if c.AuthFile != "" {
 		if err := server.users.LoadUsers(c.AuthFile); err != nil {
 			return nil, err
@@ -77,7 +187,6 @@ func NewServer(c *Config) (*Server, error) {
 	}
 
 	var pemBytes []byte
-	var err error
 	if c.KeyFile != "" {
 		var key []byte
 
@@ -135,6 +244,15 @@ func NewServer(c *Config) (*Server, error) {
 			r.URL.Host = u.Host
 			r.Host = u.Host
 		}
+		//host and port, to check the backend is reachable
+		server.backend = u.Host
+		if u.Port() == "" {
+			port := "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+			server.backend = net.JoinHostPort(u.Hostname(), port)
+		}
 	}
 	//print when reverse tunnelling is enabled
 	if c.Reverse {
@@ -143,6 +261,15 @@ func NewServer(c *Config) (*Server, error) {
 	return server, nil
 }
 
+func (c *Config) exitDialerConfig() cnet.DialerConfig {
+	return cnet.DialerConfig{
+		Source:      c.ExitSource,
+		Interface:   c.ExitInterface,
+		Proxy:       c.ExitProxy,
+		ProxyBypass: c.ExitProxyBypass,
+	}
+}
+
 // Run is responsible for starting the chisel service.
 // Internally this calls Start then Wait.
 func (s *Server) Run(host, port string) error {
@@ -167,17 +294,46 @@ func (s *Server) StartContext(ctx context.Context, host, port string) error {
 	if s.reverseProxy != nil {
 		s.Infof("Reverse proxy enabled")
 	}
+	if len(s.allowIPs) > 0 || len(s.denyIPs) > 0 {
+		s.Infof("Client IP filtering enabled")
+	}
+	if len(s.exitAllow) > 0 || len(s.exitDeny) > 0 {
+		s.Infof("Exit restrictions enabled")
+	}
+	if s.exitDialer != nil {
+		s.Infof("Outbound connections use %s", s.exitDialer)
+	}
+	if s.exitResolver != nil {
+		s.Infof("Outbound connections resolve via %s", s.exitResolver)
+	}
 	l, err := s.listener(host, port)
 	if err != nil {
 		return err
 	}
+	s.started = time.Now()
+	s.configureTransports()
+	if s.quic != nil {
+		go s.serveQUIC(ctx)
+	}
+	go func() {
+		<-ctx.Done()
+		s.polls.closeAll()
+		if s.quic != nil {
+			s.quic.Close()
+			s.udp.Close()
+		}
+	}()
 	h := http.Handler(http.HandlerFunc(s.handleClientHandler))
 	if s.Debug {
 		o := requestlog.DefaultOptions
 		o.TrustProxy = true
 		h = requestlog.WrapWith(h, o)
 	}
-	return s.httpServer.GoServe(ctx, l, h)
+	if err := s.httpServer.GoServe(ctx, l, h); err != nil {
+		return err
+	}
+	handoffReady()
+	return nil
 }
 
 // Wait waits for the http server to close
@@ -185,8 +341,13 @@ func (s *Server) Wait() error {
 	return s.httpServer.Wait()
 }
 
-// Close forcibly closes the http server
+// Close forcibly closes the http server, see Shutdown
 func (s *Server) Close() error {
+	s.polls.closeAll()
+	if s.quic != nil {
+		s.quic.Close()
+		s.udp.Close()
+	}
 	return s.httpServer.Close()
 }
 
@@ -201,12 +362,29 @@ func (s *Server) authUser(c ssh.ConnMetadata, password []byte) (*ssh.Permissions
 	if s.users.Len() == 0 {
 		return nil, nil
 	}
-	// check the user exists and has matching password
+	// reject locked out addresses and users before checking the password
 	n := c.User()
+	addr := c.RemoteAddr().String()
+	if key, d := s.logins.banned(addr, n); d > 0 {
+		s.Debugf("Login denied for user: %s (%s locked out for %s)", n, key, d.Round(time.Second))
+		return nil, s.authFailed(n, addr, errors.New("Too many failed logins"))
+	}
+	// slow down guessing the password of a user from many addresses
+	if d := s.logins.slowed(addr, n); d > 0 {
+		time.Sleep(d)
+	}
+	// check the user exists and has matching password
 	user, found := s.users.Get(n)
 	if !found || user.Pass != string(password) {
 		s.Debugf("Login failed for user: %s", n)
-		return nil, errors.New("Invalid authentication for username: %s")
+		s.logins.failed(addr, n)
+		return nil, s.authFailed(n, addr, errors.New("Invalid authentication for username: %s"))
+	}
+	s.logins.succeeded(addr, n)
+	// check the user may connect from this network
+	if ip := settings.HostIP(addr); !user.AllowsIP(ip) {
+		s.Infof("Login denied for user: %s (from %s)", n, ip)
+		return nil, s.authFailed(n, addr, errors.New("Access denied from this network"))
 	}
 	// insert the user session map
 	// TODO this should probably have a lock on it given the map isn't thread-safe
@@ -214,6 +392,17 @@ func (s *Server) authUser(c ssh.ConnMetadata, password []byte) (*ssh.Permissions
 	return nil, nil
 }
 
+// authFailed sends the auth-failed event of a rejected login
+func (s *Server) authFailed(user, addr string, err error) error {
+	s.emit(tunnel.Event{Type: tunnel.EventAuthFailed, User: user, Addr: addr, Err: err})
+	return err
+}
+
+// emit sends the event to Config.OnEvent, if set
+func (s *Server) emit(e tunnel.Event) {
+	tunnel.Emit(s.config.OnEvent, e)
+}
+
 // AddUser adds a new user into the server user index
 func (s *Server) AddUser(user, pass string, addrs ...string) error {
 	authorizedAddrs := []*regexp.Regexp{}
@@ -0,0 +1,117 @@
+package chserver
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/jpillora/chisel/share/cnet"
+	"github.com/jpillora/chisel/share/settings"
+)
+
+// clientIP returns the IP address of the websocket client. When
+// the peer is a trusted proxy, the X-Forwarded-For chain is walked
+// from right to left, skipping over further trusted proxies.
+func (s *Server) clientIP(r *http.Request) net.IP {
+	ip := settings.HostIP(r.RemoteAddr)
+	if !s.trustedProxies.Contains(ip) {
+		return ip
+	}
+	hops := []string{}
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !s.trustedProxies.Contains(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// allowsIP checks the client IP against the
+// server-wide allowed and denied networks
+func (s *Server) allowsIP(ip net.IP) bool {
+	if s.denyIPs.Contains(ip) {
+		return false
+	}
+	if len(s.allowIPs) > 0 && !s.allowIPs.Contains(ip) {
+		return false
+	}
+	return true
+}
+
+// allowsExit checks a resolved outbound destination
+// against the server-wide exit restrictions
+func (s *Server) allowsExit(ip net.IP) bool {
+	if s.exitDeny.Contains(ip) {
+		return false
+	}
+	if len(s.exitAllow) > 0 && !s.exitAllow.Contains(ip) {
+		return false
+	}
+	return true
+}
+
+// destACL combines the server-wide exit restrictions with the
+// user's ACL, returning nil when neither restricts destinations
+func (s *Server) destACL(user *settings.User) func(host string, ip net.IP, port int) bool {
+	exits := len(s.exitAllow) > 0 || len(s.exitDeny) > 0
+	var acl settings.ACL
+	if user != nil {
+		acl = user.ACL
+	}
+	if !exits && len(acl) == 0 {
+		return nil
+	}
+	return func(host string, ip net.IP, port int) bool {
+		if !s.allowsExit(ip) {
+			return false
+		}
+		return len(acl) == 0 || acl.Allows(host, ip, port)
+	}
+}
+
+// userDialer returns the dialer for outbound connections
+// of the given user, applying the user's overrides
+func (s *Server) userDialer(user *settings.User) (*cnet.Dialer, error) {
+	if user == nil || (user.ExitSource == "" && user.ExitInterface == "") {
+		return s.exitDialer, nil
+	}
+	c := s.config.exitDialerConfig()
+	if user.ExitSource != "" {
+		c.Source = user.ExitSource
+	}
+	if user.ExitInterface != "" {
+		c.Interface = user.ExitInterface
+	}
+	return cnet.NewDialer(c)
+}
+
+// clientConn overrides the remote address of a websocket
+// connection with the client address, so that the ssh
+// auth handler sees the client instead of any proxy
+type clientConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *clientConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func newClientConn(conn net.Conn, ip net.IP) net.Conn {
+	if ip == nil {
+		return conn
+	}
+	addr := &net.TCPAddr{IP: ip}
+	if a, ok := conn.RemoteAddr().(*net.TCPAddr); ok && a.IP.Equal(ip) {
+		addr.Port = a.Port
+	}
+	return &clientConn{Conn: conn, addr: addr}
+}
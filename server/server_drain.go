@@ -0,0 +1,121 @@
+package chserver
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jpillora/chisel/share/tunnel"
+	"golang.org/x/crypto/ssh"
+)
+
+// tunnels holds the tunnel, ssh connection and name of each session
+type tunnels struct {
+	mu    sync.Mutex
+	m     map[*tunnel.Tunnel]ssh.Conn
+	names map[*tunnel.Tunnel]string
+}
+
+func (ts *tunnels) add(t *tunnel.Tunnel, c ssh.Conn, name string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.m[t] = c
+	ts.names[t] = name
+}
+
+func (ts *tunnels) del(t *tunnel.Tunnel) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	delete(ts.m, t)
+	delete(ts.names, t)
+}
+
+func (ts *tunnels) each(fn func(t *tunnel.Tunnel, c ssh.Conn)) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for t, c := range ts.m {
+		fn(t, c)
+	}
+}
+
+// len returns the number of sessions
+func (ts *tunnels) len() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return len(ts.m)
+}
+
+// latencies returns the keepalive round trip times of each session
+func (ts *tunnels) latencies() map[string]tunnel.LatencyStats {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	m := map[string]tunnel.LatencyStats{}
+	for t := range ts.m {
+		m[ts.names[t]] = t.Latency()
+	}
+	return m
+}
+
+// streams returns the number of open streams of every session
+func (ts *tunnels) streams() int {
+	n := 0
+	ts.each(func(t *tunnel.Tunnel, _ ssh.Conn) {
+		n += t.Streams()
+	})
+	return n
+}
+
+// draining reports whether the server is shutting down
+func (s *Server) draining() bool {
+	return atomic.LoadInt32(&s.drain) == 1
+}
+
+// bindTunnel registers the tunnel of a session until it
+// ends, draining it already when the server is draining
+func (s *Server) bindTunnel(t *tunnel.Tunnel, c ssh.Conn, name string) func() {
+	s.tunnels.add(t, c, name)
+	if s.draining() {
+		t.Drain()
+	}
+	return func() {
+		s.tunnels.del(t)
+	}
+}
+
+// Shutdown gracefully closes the server. New sessions and streams
+// are refused, and connected clients are asked to reconnect (to
+// another server), while their open streams continue, until they
+// finish or the context is done, after which the server is closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if atomic.CompareAndSwapInt32(&s.drain, 0, 1) {
+		s.Infof("Draining...")
+		//close idle http connections, so their
+		//next requests reach another server
+		s.httpServer.SetKeepAlivesEnabled(false)
+		s.tunnels.each(func(t *tunnel.Tunnel, _ ssh.Conn) {
+			t.Drain()
+		})
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+	wait:
+		for {
+			n := s.tunnels.streams()
+			if n == 0 {
+				s.Infof("Drained")
+				break
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				s.Infof("Closing %d open streams", n)
+				break wait
+			}
+		}
+	}
+	//hijacked connections are not closed by the http server
+	s.tunnels.each(func(_ *tunnel.Tunnel, c ssh.Conn) {
+		c.Close()
+	})
+	return s.Close()
+}
@@ -1,6 +1,10 @@
 package chserver
 
 import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
 	"net/http"
 	"strings"
 	"sync/atomic"
@@ -28,6 +32,20 @@ func (s *Server) handleClientHandler(w http.ResponseWriter, r *http.Request) {
 		s.Infof("ignored client connection using protocol '%s', expected '%s'",
 			protocol, chshare.ProtocolVersion)
 	}
+	//other transports name the protocol in a header
+	if protocol := r.Header.Get(cnet.ProtocolHeader); protocol != "" {
+		if protocol == chshare.ProtocolVersion {
+			s.handleTransport(w, r)
+			return
+		}
+		s.Infof("ignored client connection using protocol '%s', expected '%s'",
+			protocol, chshare.ProtocolVersion)
+	}
+	//liveness and readiness checks, also with a proxy target
+	if s.isHealthPath(r.URL.Path) {
+		s.handleHealth(w, r)
+		return
+	}
 	//proxy target was provided
 	if s.reverseProxy != nil {
 		s.reverseProxy.ServeHTTP(w, r)
@@ -36,6 +54,10 @@ func (s *Server) handleClientHandler(w http.ResponseWriter, r *http.Request) {
 	//no proxy defined, provide access to health/version checks
 	switch r.URL.Path {
 	case "/health":
+		if h := s.Health(); !h.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
 		w.Write([]byte("OK\n"))
 		return
 	case "/version":
@@ -49,21 +71,99 @@ func (s *Server) handleClientHandler(w http.ResponseWriter, r *http.Request) {
 
 // handleWebsocket is responsible for handling the websocket connection
 func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
+	s.handleClient(req.Context(), s.clientIP(req), req.Header, func(status int, header http.Header) (net.Conn, error) {
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return nil, nil
+		}
+		wsConn, err := upgrader.Upgrade(w, req, header)
+		if err != nil {
+			return nil, err
+		}
+		conn := cnet.NewWebSocketConn(wsConn)
+		if s.config.KeepAlive > 0 && s.config.KeepAliveTimeout > 0 {
+			go cnet.WebSocketKeepAlive(conn, settings.EnvDuration("WS_PING", 5*time.Second), s.config.KeepAliveTimeout, s.config.KeepAliveMisses)
+		}
+		return conn, nil
+	})
+}
+
+// acceptFunc responds to a client on any transport with the given
+// status and headers, returning the connection when the status is OK
+type acceptFunc func(status int, header http.Header) (net.Conn, error)
+
+// handleClient authenticates and serves a client, given the
+// client IP and request headers of its transport
+func (s *Server) handleClient(ctx context.Context, ip net.IP, reqHeader http.Header, accept acceptFunc) {
 	id := atomic.AddInt32(&s.sessCount, 1)
 	l := s.Fork("session#%d", id)
-	wsConn, err := upgrader.Upgrade(w, req, nil)
+	if !s.allowsIP(ip) {
+		l.Infof("Denied client connection from %s", ip)
+		accept(http.StatusForbidden, nil)
+		return
+	}
+	if s.draining() {
+		l.Debugf("Denied client connection from %s (draining)", ip)
+		accept(http.StatusServiceUnavailable, nil)
+		return
+	}
+	//optional session resumption, where the client
+	//requests a new session, or proves it holds the
+	//token of its session, see resumables
+	resumeReq := reqHeader.Get(cnet.ResumeHeader)
+	if s.config.ResumeGrace <= 0 {
+		resumeReq = ""
+	}
+	header := http.Header{}
+	header.Set(cnet.TransportsHeader, strings.Join(s.transports(), ","))
+	resume := s.resumables.resume(resumeReq, s.resumeAllowed(l, ip))
+	if resume != nil {
+		header.Set(cnet.ResumeHeader, "resumed")
+	} else if resumeReq != "" {
+		header.Set(cnet.ResumeHeader, cnet.ResumeNew)
+		header.Set(cnet.ResumeGraceHeader, s.config.ResumeGrace.String())
+	}
+	transportConn, err := accept(http.StatusOK, header)
 	if err != nil {
-		l.Debugf("Failed to upgrade (%s)", err)
+		l.Debugf("Failed to accept transport (%s)", err)
 		return
 	}
-	conn := cnet.NewWebSocketConn(wsConn)
+	defer transportConn.Close()
+	conn := newClientConn(transportConn, ip)
+	if resume != nil {
+		s.resumeSession(l, resume, conn)
+		return
+	}
+	//resumable once the client is authenticated
+	var rc *cnet.ResumableConn
+	if resumeReq != "" {
+		rc = cnet.NewResumableConn(s.config.ResumeGrace, settings.EnvInt("RESUME_BUFFER", 4<<20))
+		if _, err := rc.Attach(conn); err != nil {
+			l.Debugf("Failed to start resumable session (%s)", err)
+			return
+		}
+		defer rc.Close()
+		conn = rc
+	}
 	// perform SSH handshake on net.Conn
-	l.Debugf("Handshaking with %s...", req.RemoteAddr)
+	l.Debugf("Handshaking with %s...", conn.RemoteAddr())
 	sshConn, chans, reqs, err := ssh.NewServerConn(conn, s.sshConfig)
 	if err != nil {
 		s.Debugf("Failed to handshake (%s)", err)
 		return
 	}
+	//the channels of QUIC clients are QUIC streams, and the client
+	//proves it is connected to this server with the tls keying material
+	var tunnelConn ssh.Conn = sshConn
+	var binding []byte
+	if qc, ok := transportConn.(*cnet.QUICConn); ok {
+		if binding, err = qc.Binding(); err != nil {
+			l.Debugf("Failed to bind QUIC connection (%s)", err)
+			sshConn.Close()
+			return
+		}
+		tunnelConn, chans = tunnel.WithQUIC(sshConn, chans, qc.QUIC())
+	}
 	// pull the users from the session map
 	var user *settings.User
 	if s.users.Len() > 0 {
@@ -87,9 +187,20 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
 		sshConn.Close()
 		return
 	}
+	//events of the session name its user and address
+	session := fmt.Sprintf("session#%d", id)
+	emit := func(e tunnel.Event) {
+		e.Session = session
+		if user != nil {
+			e.User = user.Name
+		}
+		e.Addr = ip.String()
+		s.emit(e)
+	}
 	failed := func(err error) {
 		l.Debugf("Failed: %s", err)
 		r.Reply(false, []byte(err.Error()))
+		emit(tunnel.Event{Type: tunnel.EventConfigRejected, Err: err})
 	}
 	if r.Type != "config" {
 		failed(s.Errorf("expecting config request"))
@@ -100,6 +211,10 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
 		failed(s.Errorf("invalid config"))
 		return
 	}
+	if binding != nil && subtle.ConstantTimeCompare(c.Binding, binding) != 1 {
+		failed(s.Errorf("QUIC connection binding mismatch"))
+		return
+	}
 	//print if client and server  versions dont match
 	cv := strings.TrimPrefix(c.Version, "v")
 	if cv == "" {
@@ -132,26 +247,69 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 	}
-	//successfuly validated config!
-	r.Reply(true, nil)
+	dialer, err := s.userDialer(user)
+	if err != nil {
+		failed(s.Errorf("%s", err))
+		return
+	}
+	//successfuly validated config! resumable sessions
+	//are issued their token, within the ssh connection
+	var token string
+	if rc != nil {
+		owner, name := ip.String(), ""
+		if user != nil {
+			owner, name = user.Name, user.Name
+		}
+		if t, ok := s.resumables.add(owner, name, rc); ok {
+			defer s.resumables.del(t.ID, rc)
+			token = t.String()
+		} else {
+			l.Infof("Session is not resumable (too many sessions for %s)", owner)
+		}
+	}
+	//clients which list their compression algorithms,
+	//udp framing or resume are sent the server's config
+	var reply []byte
+	if len(c.Compression) > 0 || c.UDPFraming > 0 || token != "" {
+		reply = settings.EncodeConfig(settings.Config{
+			Version:     chshare.BuildVersion,
+			Compression: cnet.Compressions,
+			UDPFraming:  tunnel.MaxUDPFraming(),
+			Resume:      token,
+		})
+	}
+	r.Reply(true, reply)
 	//tunnel per ssh connection
 	tunnelConfig := tunnel.Config{
-		Logger:    l,
-		Inbound:   s.config.Reverse,
-		Outbound:  true, //server always accepts outbound
-		Socks:     s.config.Socks5,
-		KeepAlive: s.config.KeepAlive,
+		Logger:           l,
+		Inbound:          s.config.Reverse,
+		Outbound:         true, //server always accepts outbound
+		Socks:            s.config.Socks5,
+		KeepAlive:        s.config.KeepAlive,
+		AllowDest:        s.destACL(user),
+		KeepAliveTimeout: s.config.KeepAliveTimeout,
+		KeepAliveMisses:  s.config.KeepAliveMisses,
+		Dialer:           dialer,
+		Resolver:         s.exitResolver,
+	}
+	if s.config.OnEvent != nil {
+		tunnelConfig.OnEvent = emit
 	}
 	//enforce ACL on every channel, not just the initial config
 	if user != nil {
 		tunnelConfig.ACL = user.HasAccess
 	}
-	tunnel := tunnel.New(tunnelConfig)
+	t := tunnel.New(tunnelConfig)
+	t.SetPeerCompression(c.Compression)
+	t.SetPeerUDPFraming(c.UDPFraming)
+	defer s.bindTunnel(t, tunnelConn, session)()
+	connected := time.Now()
+	emit(tunnel.Event{Type: tunnel.EventConnected})
 	//bind
-	eg, ctx := errgroup.WithContext(req.Context())
+	eg, ctx := errgroup.WithContext(ctx)
 	eg.Go(func() error {
 		//connected, handover ssh connection for tunnel to use, and block
-		return tunnel.BindSSH(ctx, sshConn, reqs, chans)
+		return t.BindSSH(ctx, tunnelConn, reqs, chans)
 	})
 	eg.Go(func() error {
 		//connected, setup reversed-remotes?
@@ -160,12 +318,14 @@ func (s *Server) handleWebsocket(w http.ResponseWriter, req *http.Request) {
 			return nil
 		}
 		//block
-		return tunnel.BindRemotes(ctx, serverInbound)
+		return t.BindRemotes(ctx, serverInbound)
 	})
 	err = eg.Wait()
 	if err != nil && !strings.HasSuffix(err.Error(), "EOF") {
 		l.Debugf("Closed connection (%s)", err)
 	} else {
 		l.Debugf("Closed connection")
+		err = nil
 	}
+	emit(tunnel.Event{Type: tunnel.EventDisconnected, Duration: time.Since(connected), Err: err})
 }
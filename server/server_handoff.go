@@ -0,0 +1,239 @@
+package chserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jpillora/chisel/share/settings"
+)
+
+// socket is a listening socket which can be passed to another process
+type socket interface {
+	File() (*os.File, error)
+}
+
+var inherit struct {
+	once  sync.Once
+	files []*os.File
+}
+
+// inheritedFiles returns the sockets passed to this process, either by
+// the previous server process (see Handoff), or by systemd socket
+// activation, following the sd_listen_fds convention
+func inheritedFiles() []*os.File {
+	inherit.once.Do(func() {
+		if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+			return
+		}
+		n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		for i := 0; i < n; i++ {
+			fd := 3 + i
+			inherit.files = append(inherit.files, os.NewFile(uintptr(fd), "listen-fd-"+strconv.Itoa(fd)))
+		}
+		for _, k := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+			os.Unsetenv(k)
+		}
+	})
+	return inherit.files
+}
+
+// inheritedListener returns the first inherited stream socket
+func inheritedListener() net.Listener {
+	for i, f := range inheritedFiles() {
+		if f == nil {
+			continue
+		}
+		if l, err := net.FileListener(f); err == nil {
+			f.Close()
+			inherit.files[i] = nil
+			return l
+		}
+	}
+	return nil
+}
+
+// inheritedPacketConn returns the first inherited datagram socket
+func inheritedPacketConn() net.PacketConn {
+	for i, f := range inheritedFiles() {
+		if f == nil {
+			continue
+		}
+		if c, err := net.FilePacketConn(f); err == nil {
+			f.Close()
+			inherit.files[i] = nil
+			return c
+		}
+	}
+	return nil
+}
+
+// handoffListener stops accepting connections once the listening
+// socket is handed off, while the http server lives on, serving
+// (and draining) the connections it has, until it is closed
+type handoffListener struct {
+	net.Listener
+	inner   net.Listener
+	once    sync.Once
+	stopped chan struct{}
+	closed  chan struct{}
+}
+
+func newHandoffListener(l, inner net.Listener) *handoffListener {
+	return &handoffListener{
+		Listener: l,
+		inner:    inner,
+		stopped:  make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (l *handoffListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		select {
+		case <-l.stopped:
+			<-l.closed
+			return nil, net.ErrClosed
+		default:
+		}
+	}
+	return c, err
+}
+
+// stop closes the listening socket of this process only
+func (l *handoffListener) stop() {
+	select {
+	case <-l.stopped:
+	default:
+		close(l.stopped)
+		l.inner.Close()
+	}
+}
+
+// isStopped reports whether the listening socket was handed off or closed
+func (l *handoffListener) isStopped() bool {
+	select {
+	case <-l.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *handoffListener) Close() error {
+	l.once.Do(func() {
+		l.stop()
+		close(l.closed)
+	})
+	return l.Listener.Close()
+}
+
+// Handoff upgrades the server without downtime. It starts the current
+// executable again, with the same arguments, passing it the listening
+// sockets. Once the new process is listening, this server stops
+// accepting connections and drains its sessions, like Shutdown.
+// QUIC sessions are closed, as their packets now reach the new process.
+func (s *Server) Handoff(ctx context.Context) error {
+	if s.ln == nil {
+		return errors.New("not started yet")
+	}
+	if s.draining() {
+		return errors.New("already draining")
+	}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, sock := range s.sockets {
+		f, err := sock.File()
+		if err != nil {
+			return fmt.Errorf("listener file: %w", err)
+		}
+		files = append(files, f)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	//the new process closes the pipe once listening
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	cmd.Env = append(handoffEnv(),
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"CHISEL_HANDOFF_FD="+strconv.Itoa(3+len(files)),
+	)
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	ready := make(chan bool, 1)
+	go func() {
+		b := make([]byte, 1)
+		n, _ := r.Read(b)
+		ready <- n == 1
+	}()
+	select {
+	case ok := <-ready:
+		if !ok {
+			cmd.Wait()
+			return fmt.Errorf("new process exited (%s)", cmd.ProcessState)
+		}
+	case <-time.After(settings.EnvDuration("HANDOFF_TIMEOUT", 30*time.Second)):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return errors.New("timed out waiting for the new process")
+	}
+	go cmd.Wait()
+	s.Infof("Handed off listener to process %d", cmd.Process.Pid)
+	s.ln.stop()
+	if s.quic != nil {
+		s.quic.Close()
+		s.udp.Close()
+	}
+	return s.Shutdown(ctx)
+}
+
+// handoffEnv is the environment of this process,
+// without the variables which pass sockets
+func handoffEnv() []string {
+	env := []string{}
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "LISTEN_") || strings.HasPrefix(kv, "CHISEL_HANDOFF_FD=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
+
+// handoffReady tells the previous process, if any,
+// that this process is listening
+func handoffReady() {
+	fd, err := strconv.Atoi(settings.Env("HANDOFF_FD"))
+	if err != nil || len(inheritedFiles()) == 0 {
+		return
+	}
+	os.Unsetenv("CHISEL_HANDOFF_FD")
+	f := os.NewFile(uintptr(fd), "handoff")
+	f.Write([]byte{1})
+	f.Close()
+}
@@ -0,0 +1,195 @@
+package chserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jpillora/chisel/share/settings"
+	"github.com/jpillora/chisel/share/tunnel"
+)
+
+// Health is the readiness of a server, and the
+// checks which it is derived from, see Config.HealthPath
+type Health struct {
+	Ready bool `json:"ready"`
+	//Errors are the reasons the server is not ready
+	Errors    []string      `json:"errors,omitempty"`
+	Listening bool          `json:"listening"`
+	Draining  bool          `json:"draining"`
+	Uptime    time.Duration `json:"uptime"`
+	//Sessions and Streams are currently connected
+	Sessions int `json:"sessions"`
+	Streams  int `json:"streams"`
+	//Latency are the keepalive round trip times of each session
+	Latency map[string]tunnel.LatencyStats `json:"latency,omitempty"`
+	//AuthFile is the last load of the authfile, when set
+	AuthFile *HealthCheck `json:"authfile,omitempty"`
+	//Backend is the reachability of the backend, when set
+	Backend *HealthCheck `json:"backend,omitempty"`
+}
+
+// HealthCheck is the result of a check of Health
+type HealthCheck struct {
+	OK    bool      `json:"ok"`
+	Time  time.Time `json:"time"`
+	Error string    `json:"error,omitempty"`
+}
+
+// Health checks the readiness of the server
+func (s *Server) Health() Health {
+	h := Health{
+		Listening: s.ln != nil && !s.ln.isStopped(),
+		Draining:  s.draining(),
+		Sessions:  s.tunnels.len(),
+		Streams:   s.tunnels.streams(),
+		Latency:   s.tunnels.latencies(),
+	}
+	if !s.started.IsZero() {
+		h.Uptime = time.Since(s.started)
+	}
+	if !h.Listening {
+		h.Errors = append(h.Errors, "Not listening")
+	}
+	if h.Draining {
+		h.Errors = append(h.Errors, "Draining")
+	}
+	if s.config.AuthFile != "" {
+		t, err := s.users.LastLoad()
+		h.AuthFile = newHealthCheck(t, err)
+		if err != nil {
+			h.Errors = append(h.Errors, "Authfile failed to load: "+err.Error())
+		}
+	}
+	if s.backend != "" {
+		h.Backend = s.checkBackend()
+		if !h.Backend.OK {
+			h.Errors = append(h.Errors, "Backend unreachable: "+h.Backend.Error)
+		}
+	}
+	h.Ready = len(h.Errors) == 0
+	return h
+}
+
+// LatencyStats describes the keepalive round trip
+// times of each session, see cos.GoStats
+func (s *Server) LatencyStats() string {
+	latencies := s.tunnels.latencies()
+	names := make([]string, 0, len(latencies))
+	for name := range latencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := []string{fmt.Sprintf("latency: %d sessions", len(names))}
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("  %s: %s", name, latencies[name]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// checkBackend dials the backend, reusing the last
+// check for CHISEL_HEALTH_CACHE (defaults to 5s)
+func (s *Server) checkBackend() *HealthCheck {
+	s.backendMut.Lock()
+	defer s.backendMut.Unlock()
+	if c := s.backendCheck; c != nil && time.Since(c.Time) < settings.EnvDuration("HEALTH_CACHE", 5*time.Second) {
+		return c
+	}
+	t := time.Now()
+	c, err := net.DialTimeout("tcp", s.backend, settings.EnvDuration("HEALTH_TIMEOUT", 2*time.Second))
+	if err == nil {
+		c.Close()
+	}
+	s.backendCheck = newHealthCheck(t, err)
+	return s.backendCheck
+}
+
+func newHealthCheck(t time.Time, err error) *HealthCheck {
+	c := &HealthCheck{OK: err == nil, Time: t}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	return c
+}
+
+// handleHealth responds to healthz while the server is alive,
+// and to readyz with 503 when it is not ready, both under the
+// HealthPath. Only the status is sent, unless the request has
+// the basic auth credentials of a user, who receives the Health
+// as JSON (as does everyone, when authentication is disabled).
+// Users may also request metrics, in the Prometheus text format
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	switch path.Base(r.URL.Path) {
+	case "healthz":
+		w.WriteHeader(http.StatusOK)
+		return
+	case "metrics":
+		if !s.healthAuthorised(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="chisel"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprintf(w, "# HELP chisel_sessions Connected sessions.\n# TYPE chisel_sessions gauge\nchisel_sessions %d\n", s.tunnels.len())
+		fmt.Fprintf(w, "# HELP chisel_streams Open streams of all sessions.\n# TYPE chisel_streams gauge\nchisel_streams %d\n", s.tunnels.streams())
+		tunnel.WriteLatencyMetrics(w, s.tunnels.latencies())
+		return
+	}
+	h := s.Health()
+	status := http.StatusOK
+	if !h.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	if !s.healthAuthorised(r) {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(h)
+}
+
+// isHealthPath is true for the healthz, readyz and
+// metrics paths, when Config.HealthPath enables them
+func (s *Server) isHealthPath(p string) bool {
+	if s.config.HealthPath == "" {
+		return false
+	}
+	dir, base := path.Split(p)
+	if path.Clean(dir) != path.Join("/", s.config.HealthPath) {
+		return false
+	}
+	return base == "healthz" || base == "readyz" || base == "metrics"
+}
+
+// healthAuthorised checks the basic auth credentials of a
+// health request, sharing the lockout of ssh logins
+func (s *Server) healthAuthorised(r *http.Request) bool {
+	if s.users.Len() == 0 {
+		return true
+	}
+	n, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	ip := s.clientIP(r)
+	addr := ip.String()
+	if _, d := s.logins.banned(addr, n); d > 0 {
+		return false
+	}
+	if d := s.logins.slowed(addr, n); d > 0 {
+		time.Sleep(d)
+	}
+	user, found := s.users.Get(n)
+	if !found || user.Pass != pass || !user.AllowsIP(ip) {
+		s.logins.failed(addr, n)
+		return false
+	}
+	s.logins.succeeded(addr, n)
+	return true
+}
@@ -9,6 +9,7 @@ import (
 	"os/user"
 	"path/filepath"
 
+	"github.com/jpillora/chisel/share/cnet"
 	"github.com/jpillora/chisel/share/settings"
 	"golang.org/x/crypto/acme/autocert"
 )
@@ -42,21 +43,44 @@ func (s *Server) listener(host, port string) (net.Listener, error) {
 			extra = " (WARNING: LetsEncrypt will attempt to connect to your domain on port 443)"
 		}
 	}
-	//tcp listen
-	l, err := net.Listen("tcp", host+":"+port)
-	if err != nil {
-		return nil, err
+	//tcp listen, unless the socket was inherited (see Handoff)
+	l := inheritedListener()
+	if l != nil {
+		host, port, _ = net.SplitHostPort(l.Addr().String())
+		extra += " (inherited)"
+	} else {
+		var err error
+		if l, err = net.Listen("tcp", host+":"+port); err != nil {
+			return nil, err
+		}
+	}
+	inner := l
+	s.sockets = nil
+	if sock, ok := l.(socket); ok {
+		s.sockets = append(s.sockets, sock)
 	}
-	//optionally wrap in tls
+	//optional quic listen, on the same udp port
+	if s.config.QUIC {
+		if err := s.listenQUIC(host, port, tlsConf); err != nil {
+			l.Close()
+			return nil, err
+		}
+		if sock, ok := s.udp.(socket); ok {
+			s.sockets = append(s.sockets, sock)
+		}
+	}
+	//optionally wrap in tls, both also accept raw tcp clients
 	proto := "http"
 	if tlsConf != nil {
 		proto += "s"
+		tlsConf.NextProtos = appendProtos(tlsConf.NextProtos, "h2", "http/1.1", cnet.TransportALPN)
 		l = tls.NewListener(l, tlsConf)
+	} else {
+		l = newRawListener(l, s.handleRaw)
 	}
-	if err == nil {
-		s.Infof("Listening on %s://%s:%s%s", proto, host, port, extra)
-	}
-	return l, nil
+	s.Infof("Listening on %s://%s:%s%s", proto, host, port, extra)
+	s.ln = newHandoffListener(l, inner)
+	return s.ln, nil
 }
 
 func (s *Server) tlsLetsEncrypt(domains []string) *tls.Config {
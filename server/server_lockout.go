@@ -0,0 +1,182 @@
+package chserver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jpillora/chisel/share/cio"
+	"github.com/jpillora/chisel/share/settings"
+)
+
+// loginLimiter tracks failed logins per source IP, and per
+// username from each source IP. Once a key reaches the maximum
+// number of failed attempts, it is banned for the ban duration,
+// which doubles with every subsequent ban (up to
+// CHISEL_LOGIN_MAX_BAN). Failed logins of a username from any
+// source IP only slow down its logins, so that knowing the
+// username is not enough to lock its user out.
+type loginLimiter struct {
+	*cio.Logger
+	attempts int
+	ban      time.Duration
+	maxBan   time.Duration
+	delay    time.Duration
+	trusted  settings.CIDRs
+	mut      sync.Mutex
+	entries  map[string]*loginEntry
+	swept    time.Time
+}
+
+type loginEntry struct {
+	failures int
+	bans     uint
+	last     time.Time
+	until    time.Time
+}
+
+func newLoginLimiter(l *cio.Logger, attempts int, ban time.Duration, trusted settings.CIDRs) *loginLimiter {
+	if ban <= 0 {
+		ban = time.Minute
+	}
+	maxBan := settings.EnvDuration("LOGIN_MAX_BAN", time.Hour)
+	if maxBan < ban {
+		maxBan = ban
+	}
+	return &loginLimiter{
+		Logger:   l.Fork("login"),
+		attempts: attempts,
+		ban:      ban,
+		maxBan:   maxBan,
+		delay:    settings.EnvDuration("LOGIN_DELAY", time.Second),
+		trusted:  trusted,
+		entries:  map[string]*loginEntry{},
+	}
+}
+
+// enabled is false when lockouts are disabled
+func (l *loginLimiter) enabled() bool {
+	return l != nil && l.attempts > 0
+}
+
+// banned returns the remaining ban time of the
+// given address, or username from that address
+func (l *loginLimiter) banned(addr, user string) (string, time.Duration) {
+	if !l.enabled() || l.isTrusted(addr) {
+		return "", 0
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	now := time.Now()
+	for _, key := range l.keys(addr, user) {
+		if e, ok := l.entries[key]; ok && now.Before(e.until) {
+			return key, e.until.Sub(now)
+		}
+	}
+	return "", 0
+}
+
+// slowed returns how long to delay a login of the given
+// username, once it has failed too often from any address
+func (l *loginLimiter) slowed(addr, user string) time.Duration {
+	if !l.enabled() || l.isTrusted(addr) {
+		return 0
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if e, ok := l.entries["user "+user]; ok && e.failures >= l.attempts {
+		return l.delay
+	}
+	return 0
+}
+
+// failed records a failed login for the given address and
+// username, banning either key if it crosses the limit
+func (l *loginLimiter) failed(addr, user string) {
+	if !l.enabled() || l.isTrusted(addr) {
+		return
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	now := time.Now()
+	l.sweep(now)
+	if user != "" {
+		e := l.entry("user " + user)
+		e.failures++
+		e.last = now
+	}
+	for _, key := range l.keys(addr, user) {
+		e := l.entry(key)
+		e.failures++
+		e.last = now
+		if e.failures < l.attempts {
+			continue
+		}
+		//exponential backoff on repeat offenders
+		d := l.ban << e.bans
+		if d <= 0 || d > l.maxBan {
+			d = l.maxBan
+		}
+		e.bans++
+		e.failures = 0
+		e.until = now.Add(d)
+		l.Infof("Locked out %s for %s (%d failed logins)", key, d, l.attempts)
+	}
+}
+
+// succeeded clears the failure counts of the given
+// username, and of the username from the address
+func (l *loginLimiter) succeeded(addr, user string) {
+	if !l.enabled() {
+		return
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	keys := []string{"user " + user}
+	if ip := settings.HostIP(addr); ip != nil {
+		keys = append(keys, "user "+user+" from "+ip.String())
+	}
+	for _, key := range keys {
+		if e, ok := l.entries[key]; ok {
+			e.failures = 0
+		}
+	}
+}
+
+func (l *loginLimiter) entry(key string) *loginEntry {
+	e, ok := l.entries[key]
+	if !ok {
+		e = &loginEntry{}
+		l.entries[key] = e
+	}
+	return e
+}
+
+// keys returns the keys which may be banned
+func (l *loginLimiter) keys(addr, user string) []string {
+	keys := []string{}
+	if ip := settings.HostIP(addr); ip != nil {
+		keys = append(keys, "ip "+ip.String())
+		if user != "" {
+			keys = append(keys, "user "+user+" from "+ip.String())
+		}
+	}
+	return keys
+}
+
+func (l *loginLimiter) isTrusted(addr string) bool {
+	return l.trusted.Contains(settings.HostIP(addr))
+}
+
+// sweep removes entries which are neither banned nor
+// have failed within the maximum ban duration
+func (l *loginLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	for key, e := range l.entries {
+		if now.After(e.until) && now.Sub(e.last) > l.maxBan {
+			delete(l.entries, key)
+		}
+	}
+}
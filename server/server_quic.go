@@ -0,0 +1,118 @@
+package chserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/jpillora/chisel/share/cnet"
+	"github.com/jpillora/chisel/share/settings"
+	"github.com/quic-go/quic-go"
+)
+
+// listenQUIC listens for clients of the QUIC transport on the
+// udp port of the same address, using the server's TLS config,
+// or else a self-signed certificate, since either way, clients
+// authenticate the server with its ssh fingerprint
+func (s *Server) listenQUIC(host, port string, tlsConf *tls.Config) error {
+	if tlsConf != nil {
+		tlsConf = tlsConf.Clone()
+	} else {
+		cert, err := selfSignedCert()
+		if err != nil {
+			return err
+		}
+		tlsConf = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	tlsConf.NextProtos = []string{cnet.TransportALPN}
+	conf := cnet.QUICConfig(settings.EnvInt("QUIC_MAX_STREAMS", 1000))
+	//the udp socket may be inherited too (see Handoff)
+	c := inheritedPacketConn()
+	if c == nil {
+		var err error
+		if c, err = net.ListenPacket("udp", net.JoinHostPort(host, port)); err != nil {
+			return err
+		}
+	}
+	l, err := quic.Listen(c, tlsConf, conf)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	s.quic = l
+	s.udp = c
+	s.Infof("Listening on quic://%s:%s", host, port)
+	return nil
+}
+
+// serveQUIC accepts QUIC clients until the listener closes
+func (s *Server) serveQUIC(ctx context.Context) {
+	for {
+		conn, err := s.quic.Accept(ctx)
+		if err != nil {
+			return
+		}
+		go s.handleQUIC(conn)
+	}
+}
+
+// handleQUIC serves a client of the QUIC transport, whose
+// first stream carries the ssh connection, see cnet.QUICConn
+func (s *Server) handleQUIC(conn *quic.Conn) {
+	ctx, cancel := context.WithTimeout(conn.Context(), settings.EnvDuration("WS_TIMEOUT", 45*time.Second))
+	stream, err := conn.AcceptStream(ctx)
+	cancel()
+	if err != nil {
+		s.Debugf("Failed to accept QUIC stream (%s)", err)
+		conn.CloseWithError(0, "")
+		return
+	}
+	ip := settings.HostIP(conn.RemoteAddr().String())
+	s.handleClient(context.Background(), ip, http.Header{}, func(status int, header http.Header) (net.Conn, error) {
+		if status != http.StatusOK {
+			conn.CloseWithError(quic.ApplicationErrorCode(status), http.StatusText(status))
+			return nil, nil
+		}
+		return cnet.NewQUICConn(conn, stream), nil
+	})
+}
+
+// transports lists the transports of the server
+func (s *Server) transports() []string {
+	if s.quic != nil {
+		return append(cnet.Transports[:len(cnet.Transports):len(cnet.Transports)], "quic")
+	}
+	return cnet.Transports
+}
+
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "chisel"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,110 @@
+package chserver
+
+import (
+	"net"
+	"sync"
+
+	"github.com/jpillora/chisel/share/cio"
+	"github.com/jpillora/chisel/share/cnet"
+)
+
+// resumables holds the resumable sessions by id. Sessions are
+// added once their client has authenticated, and are issued a token,
+// whose proof the client must send to resume them.
+type resumables struct {
+	mu sync.Mutex
+	m  map[string]*resumable
+	//max is the limit of sessions per user (or per
+	//client IP, without authentication)
+	max int
+}
+
+type resumable struct {
+	rc    *cnet.ResumableConn
+	token cnet.ResumeToken
+	owner string
+	//user is the name of the authenticated user, if any
+	user string
+	//last is the latest accepted resume attempt,
+	//so that proofs cannot be replayed
+	last uint64
+}
+
+// resume returns the session of the proof, when it is valid,
+// and its user is allowed to resume it, see resumeAllowed
+func (r *resumables) resume(proof string, allowed func(user string) bool) *cnet.ResumableConn {
+	if proof == "" || proof == cnet.ResumeNew {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.m[cnet.ResumeProofID(proof)]
+	if !ok {
+		return nil
+	}
+	n, ok := e.token.Verify(proof)
+	if !ok || n <= e.last {
+		return nil
+	}
+	e.last = n
+	if !allowed(e.user) {
+		return nil
+	}
+	return e.rc
+}
+
+// add issues a token for the session, unless
+// its owner has too many resumable sessions
+func (r *resumables) add(owner, user string, rc *cnet.ResumableConn) (cnet.ResumeToken, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, e := range r.m {
+		if e.owner == owner {
+			n++
+		}
+	}
+	if n >= r.max {
+		return cnet.ResumeToken{}, false
+	}
+	t := cnet.NewResumeToken()
+	r.m[t.ID] = &resumable{rc: rc, token: t, owner: owner, user: user}
+	return t, true
+}
+
+func (r *resumables) del(id string, rc *cnet.ResumableConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.m[id]; ok && e.rc == rc {
+		delete(r.m, id)
+	}
+}
+
+// resumeAllowed checks the user of a session may still
+// connect from the network the client reconnects from
+func (s *Server) resumeAllowed(l *cio.Logger, ip net.IP) func(user string) bool {
+	return func(name string) bool {
+		if name == "" {
+			return true
+		}
+		user, found := s.users.Get(name)
+		if !found || !user.AllowsIP(ip) {
+			l.Infof("Denied resuming the session of user: %s (from %s)", name, ip)
+			return false
+		}
+		return true
+	}
+}
+
+// resumeSession attaches a reconnected client to its existing
+// session, and blocks until this connection drops again
+func (s *Server) resumeSession(l *cio.Logger, rc *cnet.ResumableConn, conn net.Conn) {
+	done, err := rc.Attach(conn)
+	if err != nil {
+		l.Infof("Failed to resume session (%s)", err)
+		return
+	}
+	l.Infof("Resumed session from %s", conn.RemoteAddr())
+	<-done
+	l.Debugf("Session detached")
+}
@@ -0,0 +1,305 @@
+package chserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	chshare "github.com/jpillora/chisel/share"
+	"github.com/jpillora/chisel/share/cnet"
+	"github.com/jpillora/chisel/share/settings"
+)
+
+// configureTransports enables HTTP/2 (including cleartext h2c)
+// and raw TLS clients, alongside HTTP/1 websockets
+func (s *Server) configureTransports() {
+	p := &http.Protocols{}
+	p.SetHTTP1(true)
+	p.SetHTTP2(true)
+	p.SetUnencryptedHTTP2(true)
+	s.httpServer.Protocols = p
+	s.httpServer.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){
+		cnet.TransportALPN: func(_ *http.Server, conn *tls.Conn, _ http.Handler) {
+			s.handleRaw(conn)
+		},
+	}
+}
+
+// handleTransport handles the clients of transports
+// other than websockets, see cnet.Transports
+func (s *Server) handleTransport(w http.ResponseWriter, r *http.Request) {
+	if id := r.Header.Get(cnet.PollHeader); id != "" {
+		if c := s.polls.get(id); c != nil {
+			c.ServeHTTP(w, r)
+		} else {
+			w.WriteHeader(http.StatusGone)
+		}
+		return
+	}
+	switch t := r.Header.Get(cnet.TransportHeader); {
+	case t == "http2" && r.Method == http.MethodPost:
+		s.handleHTTPStream(w, r)
+	case t == "poll" && r.Method == http.MethodPost:
+		s.handlePoll(w, r)
+	default:
+		//most likely a websocket upgrade which was stripped by a
+		//proxy, list the transports for the client to fall back to
+		w.Header().Set(cnet.TransportsHeader, strings.Join(s.transports(), ","))
+		http.Error(w, "Unsupported transport", http.StatusBadRequest)
+	}
+}
+
+// handleHTTPStream serves a client over a bidirectional HTTP/2 stream.
+// The session is not tied to the request, which is cancelled when the
+// stream drops, since a resumable session outlives its stream
+func (s *Server) handleHTTPStream(w http.ResponseWriter, r *http.Request) {
+	s.handleClient(context.Background(), s.clientIP(r), r.Header, func(status int, header http.Header) (net.Conn, error) {
+		copyHeader(w.Header(), header)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return nil, nil
+		}
+		return cnet.NewHTTPStreamConn(w, r)
+	})
+}
+
+// handlePoll starts a long-polling session, which serves
+// the client beyond this request, see cnet.PollConn
+func (s *Server) handlePoll(w http.ResponseWriter, r *http.Request) {
+	ip := s.clientIP(r)
+	local, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	remote := &net.TCPAddr{IP: ip}
+	accepted := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		id := ""
+		s.handleClient(context.Background(), ip, r.Header, func(status int, header http.Header) (net.Conn, error) {
+			defer close(accepted)
+			copyHeader(w.Header(), header)
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return nil, nil
+			}
+			id = newPollID()
+			c := cnet.NewPollConn(
+				settings.EnvDuration("POLL_TIMEOUT", 25*time.Second),
+				settings.EnvDuration("POLL_IDLE", time.Minute),
+				local, remote,
+			)
+			s.polls.add(id, c)
+			w.Header().Set(cnet.PollHeader, id)
+			w.WriteHeader(http.StatusOK)
+			return c, nil
+		})
+		if id != "" {
+			s.polls.del(id)
+		}
+	}()
+	select {
+	case <-accepted:
+	case <-done:
+	}
+}
+
+// handleRaw serves a client of the raw tcp transport, which
+// starts with the protocol version and headers before the
+// ssh connection, see cnet.WriteRawHeader
+func (s *Server) handleRaw(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(settings.EnvDuration("WS_TIMEOUT", 45*time.Second)))
+	line, reqHeader, raw, err := cnet.ReadRawHeader(conn)
+	if err != nil {
+		s.Debugf("Failed to read raw client header (%s)", err)
+		return
+	}
+	if line != chshare.ProtocolVersion {
+		s.Infof("ignored client connection using protocol '%s', expected '%s'",
+			line, chshare.ProtocolVersion)
+		cnet.WriteRawHeader(conn, rawStatus(http.StatusBadRequest), http.Header{})
+		return
+	}
+	ip := settings.HostIP(conn.RemoteAddr().String())
+	s.handleClient(context.Background(), ip, reqHeader, func(status int, header http.Header) (net.Conn, error) {
+		if header == nil {
+			header = http.Header{}
+		}
+		if err := cnet.WriteRawHeader(conn, rawStatus(status), header); err != nil {
+			return nil, err
+		}
+		if status != http.StatusOK {
+			return nil, nil
+		}
+		conn.SetDeadline(time.Time{})
+		return raw, nil
+	})
+}
+
+func rawStatus(status int) string {
+	return fmt.Sprintf("%d %s", status, http.StatusText(status))
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, v := range src {
+		dst[k] = v
+	}
+}
+
+func appendProtos(protos []string, add ...string) []string {
+	for _, p := range add {
+		found := false
+		for _, q := range protos {
+			found = found || p == q
+		}
+		if !found {
+			protos = append(protos, p)
+		}
+	}
+	return protos
+}
+
+func newPollID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// polls holds the long-polling sessions by id
+type polls struct {
+	mu sync.Mutex
+	m  map[string]*cnet.PollConn
+}
+
+func (p *polls) get(id string) *cnet.PollConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.m[id]
+}
+
+func (p *polls) add(id string, c *cnet.PollConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.m[id] = c
+}
+
+func (p *polls) del(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.m, id)
+}
+
+func (p *polls) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.m {
+		c.Close()
+	}
+}
+
+// rawListener passes the connections of raw tcp clients, which
+// start with the protocol version, to handle, and all others
+// (http) on to Accept
+type rawListener struct {
+	net.Listener
+	handle   func(net.Conn)
+	accepted chan rawAccept
+	done     chan struct{}
+	once     sync.Once
+	mu       sync.Mutex
+	raw      map[net.Conn]bool
+}
+
+type rawAccept struct {
+	conn net.Conn
+	err  error
+}
+
+// rawPrefix starts the protocol version (chisel-vN)
+// which raw tcp clients send first
+const rawPrefix = "chisel-"
+
+func newRawListener(l net.Listener, handle func(net.Conn)) net.Listener {
+	r := &rawListener{
+		Listener: l,
+		handle:   handle,
+		accepted: make(chan rawAccept),
+		done:     make(chan struct{}),
+		raw:      map[net.Conn]bool{},
+	}
+	go r.run()
+	return r
+}
+
+func (r *rawListener) run() {
+	for {
+		conn, err := r.Listener.Accept()
+		if err != nil {
+			select {
+			case r.accepted <- rawAccept{err: err}:
+			case <-r.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go r.sniff(conn)
+	}
+}
+
+// sniff peeks at the first bytes sent by the client
+func (r *rawListener) sniff(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(settings.EnvDuration("WS_TIMEOUT", 45*time.Second)))
+	prefix, err := br.Peek(len(rawPrefix))
+	conn.SetReadDeadline(time.Time{})
+	c := cnet.NewBufferedConn(conn, br)
+	if err == nil && string(prefix) == rawPrefix {
+		r.mu.Lock()
+		r.raw[c] = true
+		r.mu.Unlock()
+		r.handle(c)
+		r.mu.Lock()
+		delete(r.raw, c)
+		r.mu.Unlock()
+		return
+	}
+	select {
+	case r.accepted <- rawAccept{conn: c}:
+	case <-r.done:
+		conn.Close()
+	}
+}
+
+func (r *rawListener) Accept() (net.Conn, error) {
+	select {
+	case a := <-r.accepted:
+		return a.conn, a.err
+	case <-r.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops listening and closes the raw connections,
+// which unlike http connections are not tracked elsewhere
+func (r *rawListener) Close() error {
+	r.once.Do(func() {
+		close(r.done)
+		r.mu.Lock()
+		for c := range r.raw {
+			c.Close()
+		}
+		r.mu.Unlock()
+	})
+	return r.Listener.Close()
+}
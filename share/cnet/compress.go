@@ -0,0 +1,144 @@
+package cnet
+
+import (
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressions lists the supported channel compression algorithms
+var Compressions = []string{"zstd", "deflate"}
+
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// CompressedRWC compresses the data written to a stream, and
+// decompresses the data read from it. Each write is flushed,
+// so the other side receives it without waiting for more.
+type CompressedRWC struct {
+	rwc io.ReadWriteCloser
+	alg string
+	wmu sync.Mutex
+	w   compressor
+	rmu sync.Mutex
+	r   io.ReadCloser
+	//uncompressed and compressed byte counts
+	rawOut, wireOut int64
+	rawIn, wireIn   int64
+}
+
+// NewCompressedRWC wraps rwc with the given compression algorithm,
+// which must be used by the other side of the stream too
+func NewCompressedRWC(rwc io.ReadWriteCloser, alg string) (*CompressedRWC, error) {
+	c := &CompressedRWC{rwc: rwc, alg: alg}
+	out := &countWriter{w: rwc, n: &c.wireOut}
+	in := &countReader{r: rwc, n: &c.wireIn}
+	switch alg {
+	case "zstd":
+		w, err := zstd.NewWriter(out,
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithWindowSize(1<<20),
+			zstd.WithLowerEncoderMem(true),
+		)
+		if err != nil {
+			return nil, err
+		}
+		r, err := zstd.NewReader(in,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderLowmem(true),
+		)
+		if err != nil {
+			return nil, err
+		}
+		c.w, c.r = w, r.IOReadCloser()
+	case "deflate":
+		w, err := flate.NewWriter(out, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		c.w, c.r = w, flate.NewReader(in)
+	default:
+		return nil, fmt.Errorf("unknown compression '%s'", alg)
+	}
+	return c, nil
+}
+
+func (c *CompressedRWC) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	n, err := c.r.Read(b)
+	atomic.AddInt64(&c.rawIn, int64(n))
+	//each write is flushed, so the stream may end after any of them
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (c *CompressedRWC) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	n, err := c.w.Write(b)
+	if err == nil {
+		err = c.w.Flush()
+	}
+	atomic.AddInt64(&c.rawOut, int64(n))
+	return n, err
+}
+
+// Close closes the stream first, which
+// unblocks any pending reads and writes
+func (c *CompressedRWC) Close() error {
+	err := c.rwc.Close()
+	c.wmu.Lock()
+	c.w.Close()
+	c.wmu.Unlock()
+	c.rmu.Lock()
+	c.r.Close()
+	c.rmu.Unlock()
+	return err
+}
+
+// String describes the compression ratios of both directions
+func (c *CompressedRWC) String() string {
+	return fmt.Sprintf("%s ratio %s/%s", c.alg,
+		ratio(atomic.LoadInt64(&c.rawOut), atomic.LoadInt64(&c.wireOut)),
+		ratio(atomic.LoadInt64(&c.rawIn), atomic.LoadInt64(&c.wireIn)),
+	)
+}
+
+func ratio(raw, wire int64) string {
+	if wire == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1fx", float64(raw)/float64(wire))
+}
+
+type countWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+type countReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
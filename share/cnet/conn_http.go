@@ -0,0 +1,164 @@
+package cnet
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// httpStreamConn is a net.Conn over a bidirectional HTTP
+// stream, which reads one body while writing the other
+type httpStreamConn struct {
+	r       io.ReadCloser
+	w       io.Writer
+	flush   func() error
+	closer  func()
+	wmu     sync.Mutex
+	once    sync.Once
+	closed  bool
+	local   net.Addr
+	remote  net.Addr
+	control *http.ResponseController
+}
+
+// NewHTTPStreamConn converts the request and response of an
+// HTTP/2 (or full duplex HTTP/1) handler into a net.Conn. The
+// response is flushed, so the handler must not return until
+// the conn is closed.
+func NewHTTPStreamConn(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	rc := http.NewResponseController(w)
+	if r.ProtoMajor == 1 {
+		if err := rc.EnableFullDuplex(); err != nil {
+			return nil, err
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return nil, err
+	}
+	c := &httpStreamConn{
+		r:       r.Body,
+		w:       w,
+		flush:   rc.Flush,
+		local:   addrOf(r.Context().Value(http.LocalAddrContextKey)),
+		remote:  addrOf(r.RemoteAddr),
+		control: rc,
+	}
+	c.closer = func() {
+		r.Body.Close()
+		//unblock pending writes
+		rc.SetWriteDeadline(time.Now())
+	}
+	return c, nil
+}
+
+// DialHTTPStream requests a bidirectional stream from the
+// server, which lasts until the conn is closed or ctx ends
+func DialHTTPStream(ctx context.Context, client *http.Client, url string, h http.Header) (net.Conn, *http.Response, error) {
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, pr)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header = h
+	req.ContentLength = -1
+	resp, err := client.Do(req)
+	if err != nil {
+		pw.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		pw.Close()
+		resp.Body.Close()
+		return nil, resp, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	c := &httpStreamConn{
+		r:      resp.Body,
+		w:      pw,
+		local:  addrOf(nil),
+		remote: addrOf(req.URL.Host),
+	}
+	c.closer = func() {
+		pw.Close()
+		resp.Body.Close()
+	}
+	return c, resp, nil
+}
+
+func (c *httpStreamConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *httpStreamConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	n, err := c.w.Write(b)
+	if err == nil && c.flush != nil {
+		err = c.flush()
+	}
+	return n, err
+}
+
+// Close ends both bodies, after which nothing
+// is written to the response
+func (c *httpStreamConn) Close() error {
+	c.once.Do(func() {
+		c.closer()
+		c.wmu.Lock()
+		c.closed = true
+		c.wmu.Unlock()
+	})
+	return nil
+}
+
+func (c *httpStreamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *httpStreamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *httpStreamConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *httpStreamConn) SetReadDeadline(t time.Time) error {
+	if c.control == nil {
+		return nil //no-op
+	}
+	return c.control.SetReadDeadline(t)
+}
+
+func (c *httpStreamConn) SetWriteDeadline(t time.Time) error {
+	if c.control == nil {
+		return nil //no-op
+	}
+	return c.control.SetWriteDeadline(t)
+}
+
+// addrOf converts a net.Addr or a host:port string into a
+// net.Addr, which is the zero TCPAddr when unknown
+func addrOf(v interface{}) net.Addr {
+	switch a := v.(type) {
+	case net.Addr:
+		return a
+	case string:
+		if host, port, err := net.SplitHostPort(a); err == nil {
+			p, _ := strconv.Atoi(port)
+			return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+		}
+	}
+	return &net.TCPAddr{}
+}
@@ -0,0 +1,434 @@
+package cnet
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PollHeader carries the id of a long-polling session, and
+// PollOffsetHeader the stream offset of each request
+const (
+	PollHeader       = "X-Chisel-Poll"
+	PollOffsetHeader = "X-Chisel-Poll-Offset"
+)
+
+const (
+	maxPollBody   = 1 << 20
+	maxPollBuffer = 4 << 20
+	pollRetries   = 3
+)
+
+var errPollIdle = errors.New("poll session idle")
+
+// pollConn is a net.Conn over a sequence of HTTP requests. Each
+// side keeps its outbound bytes until the other side acknowledges
+// them with its next request, so failed requests can be retried.
+type pollConn struct {
+	mu      sync.Mutex
+	changed chan struct{}
+	closed  bool
+	err     error
+	//inbound bytes, and the stream offset after them
+	in    []byte
+	recvd uint64
+	//outbound bytes, and the stream offset of the first one
+	out  []byte
+	base uint64
+	//addresses of the http connection
+	local, remote net.Addr
+}
+
+func newPollConn(local, remote net.Addr) *pollConn {
+	return &pollConn{
+		changed: make(chan struct{}),
+		local:   local,
+		remote:  remote,
+	}
+}
+
+// changedLocked wakes everything waiting on the conn
+func (c *pollConn) changedLocked() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// waitLocked waits for a change, reporting false if timeout fires first
+func (c *pollConn) waitLocked(timeout <-chan time.Time) bool {
+	ch := c.changed
+	c.mu.Unlock()
+	defer c.mu.Lock()
+	select {
+	case <-ch:
+		return true
+	case <-timeout:
+		return false
+	}
+}
+
+// receiveLocked appends data at the given stream offset,
+// skipping anything received in an earlier attempt
+func (c *pollConn) receiveLocked(offset uint64, data []byte) error {
+	if offset > c.recvd {
+		return fmt.Errorf("missing data at offset %d", c.recvd)
+	}
+	if skip := c.recvd - offset; skip < uint64(len(data)) {
+		data = data[skip:]
+		c.in = append(c.in, data...)
+		c.recvd += uint64(len(data))
+		c.changedLocked()
+	}
+	return nil
+}
+
+// ackLocked discards the outbound bytes before offset
+func (c *pollConn) ackLocked(offset uint64) error {
+	if offset < c.base || offset > c.base+uint64(len(c.out)) {
+		return fmt.Errorf("invalid offset %d", offset)
+	}
+	c.out = c.out[offset-c.base:]
+	c.base = offset
+	c.changedLocked()
+	return nil
+}
+
+// pendingLocked returns the next outbound bytes to send
+func (c *pollConn) pendingLocked() []byte {
+	if len(c.out) > maxPollBody {
+		return c.out[:maxPollBody]
+	}
+	return c.out
+}
+
+func (c *pollConn) closeLocked(err error) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.err = err
+	c.changedLocked()
+}
+
+func (c *pollConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.in) == 0 && !c.closed {
+		c.waitLocked(nil)
+	}
+	if len(c.in) == 0 {
+		return 0, c.err
+	}
+	n := copy(b, c.in)
+	c.in = c.in[n:]
+	return n, nil
+}
+
+func (c *pollConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for len(b) > 0 {
+		for !c.closed && len(c.out) >= maxPollBuffer {
+			c.waitLocked(nil)
+		}
+		if c.closed {
+			return n, c.err
+		}
+		k := maxPollBuffer - len(c.out)
+		if k > len(b) {
+			k = len(b)
+		}
+		c.out = append(c.out, b[:k]...)
+		b = b[k:]
+		n += k
+		c.changedLocked()
+	}
+	return n, nil
+}
+
+func (c *pollConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *pollConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// deadlines are not supported, since
+// the conn outlives its requests
+func (c *pollConn) SetDeadline(t time.Time) error      { return nil }
+func (c *pollConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *pollConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// PollConn is the server side of a long-polling session. Clients
+// send data in POST requests, and receive data in GET requests
+// which wait up to timeout for data to send. The session closes
+// when there are no requests for the idle duration.
+type PollConn struct {
+	*pollConn
+	timeout time.Duration
+	idle    time.Duration
+	expiry  *time.Timer
+}
+
+// NewPollConn creates the server side of a long-polling session
+func NewPollConn(timeout, idle time.Duration, local, remote net.Addr) *PollConn {
+	c := &PollConn{
+		pollConn: newPollConn(local, remote),
+		timeout:  timeout,
+		idle:     idle,
+	}
+	c.expiry = time.AfterFunc(idle, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.closeLocked(errPollIdle)
+	})
+	return c
+}
+
+// ServeHTTP handles a request of the session
+func (c *PollConn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.expiry.Reset(c.idle)
+	defer c.expiry.Reset(c.idle)
+	if r.Method == http.MethodDelete {
+		c.Close()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	offset, err := strconv.ParseUint(r.Header.Get(PollOffsetHeader), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid offset", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		c.serveGet(w, offset)
+	case http.MethodPost:
+		c.servePost(w, r, offset)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// serveGet acknowledges the data before offset, then
+// waits for data to send, or until the timeout
+func (c *PollConn) serveGet(w http.ResponseWriter, offset uint64) {
+	t := time.NewTimer(c.timeout)
+	defer t.Stop()
+	c.mu.Lock()
+	if err := c.ackLocked(offset); err != nil {
+		c.mu.Unlock()
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	for len(c.out) == 0 && !c.closed && c.waitLocked(t.C) {
+	}
+	data := c.pendingLocked()
+	gone := c.closed && len(data) == 0
+	c.mu.Unlock()
+	if gone {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(data)
+}
+
+func (c *PollConn) servePost(w http.ResponseWriter, r *http.Request, offset uint64) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxPollBody+1))
+	if err != nil {
+		return
+	}
+	if len(data) > maxPollBody {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	c.mu.Lock()
+	gone := c.closed
+	if !gone {
+		err = c.receiveLocked(offset, data)
+	}
+	c.mu.Unlock()
+	if gone {
+		w.WriteHeader(http.StatusGone)
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Close ends the session, though pending
+// data is still sent to the client
+func (c *PollConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expiry.Stop()
+	c.closeLocked(net.ErrClosed)
+	return nil
+}
+
+// pollClientConn is the client side of a long-polling session,
+// which keeps one POST and one GET request in flight
+type pollClientConn struct {
+	*pollConn
+	client *http.Client
+	url    string
+	header http.Header
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// DialPoll starts a long-polling session with the server, which
+// lasts until the conn is closed or ctx ends. It returns the
+// response which started the session.
+func DialPoll(ctx context.Context, client *http.Client, url string, h http.Header) (net.Conn, *http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header = h
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	id := resp.Header.Get(PollHeader)
+	if id == "" {
+		return nil, resp, errors.New("missing poll session")
+	}
+	c := &pollClientConn{
+		pollConn: newPollConn(addrOf(nil), addrOf(req.URL.Host)),
+		client:   client,
+		url:      url,
+		header:   h.Clone(),
+	}
+	c.header.Set(PollHeader, id)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-c.ctx.Done():
+		}
+	}()
+	go c.sendLoop()
+	go c.recvLoop()
+	return c, resp, nil
+}
+
+// sendLoop posts outbound data, and once closed, flushes
+// the remaining data before ending the session
+func (c *pollClientConn) sendLoop() {
+	defer c.cancel()
+	for {
+		c.mu.Lock()
+		for len(c.out) == 0 && !c.closed {
+			c.waitLocked(nil)
+		}
+		if local := c.err == net.ErrClosed; c.closed && (len(c.out) == 0 || !local) {
+			c.mu.Unlock()
+			if local {
+				c.request(http.MethodDelete, 0, nil)
+			}
+			return
+		}
+		offset := c.base
+		data := c.pendingLocked()
+		c.mu.Unlock()
+		if _, err := c.roundTrip(http.MethodPost, offset, data); err != nil {
+			c.fail(err)
+			return
+		}
+		c.mu.Lock()
+		c.ackLocked(offset + uint64(len(data)))
+		c.mu.Unlock()
+	}
+}
+
+// recvLoop polls for inbound data, acknowledging
+// the data received so far with each request
+func (c *pollClientConn) recvLoop() {
+	for {
+		c.mu.Lock()
+		offset := c.recvd
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
+			return
+		}
+		data, err := c.roundTrip(http.MethodGet, offset, nil)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.mu.Lock()
+		c.receiveLocked(offset, data)
+		c.mu.Unlock()
+	}
+}
+
+// roundTrip sends a request of the session, retrying
+// failed requests, and returns the response body
+func (c *pollClientConn) roundTrip(method string, offset uint64, body []byte) ([]byte, error) {
+	var err error
+	for attempt := 0; attempt < pollRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(time.Second):
+			case <-c.ctx.Done():
+				return nil, c.ctx.Err()
+			}
+		}
+		var b []byte
+		if b, err = c.request(method, offset, body); err == nil || err == io.EOF {
+			return b, err
+		}
+	}
+	return nil, err
+}
+
+func (c *pollClientConn) request(method string, offset uint64, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(c.ctx, method, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = c.header.Clone()
+	req.Header.Set(PollOffsetHeader, strconv.FormatUint(offset, 10))
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return io.ReadAll(io.LimitReader(resp.Body, maxPollBody))
+	case http.StatusGone:
+		return nil, io.EOF
+	}
+	return nil, fmt.Errorf("unexpected status %s", resp.Status)
+}
+
+func (c *pollClientConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeLocked(err)
+}
+
+// Close ends the session, after sending pending data
+func (c *pollClientConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeLocked(net.ErrClosed)
+	return nil
+}
@@ -0,0 +1,196 @@
+package cnet
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUICBindingLabel labels the keying material which both sides
+// export from a QUIC connection, which the client sends within the
+// ssh connection to prove there is no proxy between them
+const QUICBindingLabel = "chisel-quic"
+
+// QUICConfig returns the QUIC settings of both client and server,
+// with datagrams enabled, and maxStreams channels at once
+func QUICConfig(maxStreams int) *quic.Config {
+	return &quic.Config{
+		EnableDatagrams:    true,
+		MaxIncomingStreams: int64(maxStreams),
+		KeepAlivePeriod:    10 * time.Second,
+	}
+}
+
+// QUICConn is a net.Conn over the first stream of a QUIC connection,
+// which carries the ssh connection, while the other streams and the
+// datagrams of the QUIC connection carry its channels
+type QUICConn struct {
+	*quic.Stream
+	conn *quic.Conn
+	//client transports, one per local address
+	mu         sync.Mutex
+	transports []*quic.Transport
+	closed     bool
+}
+
+// NewQUICConn returns the conn of the first stream of a QUIC connection
+func NewQUICConn(conn *quic.Conn, stream *quic.Stream) *QUICConn {
+	return &QUICConn{Stream: stream, conn: conn}
+}
+
+// DialQUIC connects to a QUIC server and opens the first stream.
+// The connection migrates when the local address used to reach
+// the server changes, such as when a client roams between networks.
+func DialQUIC(ctx context.Context, addr string, tlsConf *tls.Config, conf *quic.Config) (*QUICConn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	local := localIP(raddr)
+	t, err := listenQUIC(local)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := t.Dial(ctx, raddr, tlsConf, conf)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		t.Close()
+		return nil, err
+	}
+	c := NewQUICConn(conn, stream)
+	c.transports = []*quic.Transport{t}
+	go c.migrateLoop(raddr, local)
+	return c, nil
+}
+
+func listenQUIC(ip net.IP) (*quic.Transport, error) {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		return nil, err
+	}
+	return &quic.Transport{Conn: pc}, nil
+}
+
+// localIP returns the source IP the system would
+// use to reach raddr, without sending anything
+func localIP(raddr *net.UDPAddr) net.IP {
+	c, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP
+}
+
+// migrateLoop moves the connection onto a new path
+// whenever the local IP used to reach raddr changes
+func (c *QUICConn) migrateLoop(raddr *net.UDPAddr, current net.IP) {
+	ctx := c.conn.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			c.closeTransports()
+			return
+		case <-time.After(2 * time.Second):
+		}
+		ip := localIP(raddr)
+		if ip == nil || ip.Equal(current) {
+			continue
+		}
+		if err := c.migrate(ctx, ip); err == nil {
+			current = ip
+		}
+	}
+}
+
+func (c *QUICConn) migrate(ctx context.Context, ip net.IP) error {
+	t, err := listenQUIC(ip)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		t.Close()
+		return net.ErrClosed
+	}
+	c.transports = append(c.transports, t)
+	c.mu.Unlock()
+	p, err := c.conn.AddPath(t)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := p.Probe(ctx); err != nil {
+		p.Close()
+		return err
+	}
+	return p.Switch()
+}
+
+func (c *QUICConn) closeTransports() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, t := range c.transports {
+		t.Close()
+	}
+	c.transports = nil
+}
+
+// QUIC returns the QUIC connection of the conn
+func (c *QUICConn) QUIC() *quic.Conn {
+	return c.conn
+}
+
+// Binding returns the keying material exported from the
+// TLS session, which is the same on both sides of the
+// connection, unless they are connected via a proxy
+func (c *QUICConn) Binding() ([]byte, error) {
+	tls := c.conn.ConnectionState().TLS
+	return tls.ExportKeyingMaterial(QUICBindingLabel, nil, 32)
+}
+
+func (c *QUICConn) Read(b []byte) (int, error) {
+	n, err := c.Stream.Read(b)
+	return n, QUICError(err)
+}
+
+// QUICError converts the error of a QUIC connection which was
+// closed without error into io.EOF, as with other connections
+func QUICError(err error) error {
+	var e *quic.ApplicationError
+	if errors.As(err, &e) && e.ErrorCode == 0 {
+		return io.EOF
+	}
+	return err
+}
+
+func (c *QUICConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *QUICConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close closes the QUIC connection, including all of its
+// streams, and once closed, the client transports are closed
+// by the migrate loop
+func (c *QUICConn) Close() error {
+	c.Stream.CancelRead(0)
+	c.Stream.Close()
+	return c.conn.CloseWithError(0, "")
+}
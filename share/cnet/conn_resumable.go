@@ -0,0 +1,394 @@
+package cnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ResumeHeader carries ResumeNew or the proof of a ResumeToken
+// from the client, and "new" or "resumed" from the server, which
+// also sets the ResumeGraceHeader to its grace period
+const (
+	ResumeHeader      = "X-Chisel-Session"
+	ResumeGraceHeader = "X-Chisel-Session-Grace"
+)
+
+// ErrSessionExpired is returned once a ResumableConn
+// has been detached for longer than its grace period
+var ErrSessionExpired = errors.New("session expired")
+
+const (
+	frameResume = 'R'
+	frameData   = 'D'
+	frameAck    = 'A'
+	frameClose  = 'C'
+	//type, seq, ack, length
+	frameHeaderSize = 1 + 8 + 8 + 4
+	maxFramePayload = 32 * 1024
+	ackEvery        = 64 * 1024
+)
+
+// ResumableConn is a net.Conn which outlives its underlying
+// connection. Written bytes are sent in frames numbered by their
+// stream offset, and are kept in a replay buffer until the peer
+// acknowledges them. When the underlying connection drops, a new
+// one can be attached within the grace period: both sides exchange
+// how much they have received, then resend the remainder, so the
+// stream continues without loss or duplication.
+type ResumableConn struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	attachMu sync.Mutex
+	cur      *attachment
+	grace    time.Duration
+	expiry   *time.Timer
+	closed   bool
+	err      error
+	//send side, sendBuf holds the bytes [acked, sent)
+	sendBuf []byte
+	maxBuf  int
+	acked   uint64
+	sent    uint64
+	//receive side
+	recvBuf []byte
+	recvd   uint64
+	unacked int
+	ackDue  bool
+	//addresses of the latest underlying connection
+	local, remote net.Addr
+}
+
+type attachment struct {
+	conn  net.Conn
+	wrote uint64
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewResumableConn creates a detached ResumableConn, which
+// expires when it stays detached for longer than grace, and
+// which blocks writes while maxBuf bytes are unacknowledged
+func NewResumableConn(grace time.Duration, maxBuf int) *ResumableConn {
+	c := &ResumableConn{grace: grace, maxBuf: maxBuf}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Attach resumes the stream over the given connection, replacing
+// any current one. The returned channel is closed when the
+// connection is detached, after which Attach may be called again.
+func (c *ResumableConn) Attach(conn net.Conn) (<-chan struct{}, error) {
+	c.attachMu.Lock()
+	defer c.attachMu.Unlock()
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		conn.Close()
+		return nil, c.err
+	}
+	old := c.cur
+	c.mu.Unlock()
+	if old != nil {
+		c.detach(old)
+	}
+	//exchange received offsets
+	c.mu.Lock()
+	recvd := c.recvd
+	c.mu.Unlock()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(encodeFrame(frameResume, 0, recvd, nil)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	typ, _, peerRecvd, _, err := readFrame(conn)
+	if err == nil && typ != frameResume {
+		err = errors.New("expected resume frame")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		conn.Close()
+		return nil, c.err
+	}
+	if peerRecvd < c.acked || peerRecvd > c.sent {
+		//the peer lost data which was already discarded
+		c.closeLocked(fmt.Errorf("cannot resume from offset %d (have %d-%d)", peerRecvd, c.acked, c.sent))
+		conn.Close()
+		return nil, c.err
+	}
+	c.ackLocked(peerRecvd)
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+	a := &attachment{conn: conn, wrote: peerRecvd, done: make(chan struct{})}
+	c.cur = a
+	c.local, c.remote = conn.LocalAddr(), conn.RemoteAddr()
+	c.cond.Broadcast()
+	go c.readLoop(a)
+	go c.writeLoop(a)
+	go c.ackLoop(a)
+	return a.done, nil
+}
+
+// Attached checks if there is a current underlying connection
+func (c *ResumableConn) Attached() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cur != nil
+}
+
+// detach drops the connection, and starts the grace period
+func (c *ResumableConn) detach(a *attachment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.detachLocked(a)
+}
+
+func (c *ResumableConn) detachLocked(a *attachment) {
+	a.once.Do(func() {
+		a.conn.Close()
+		close(a.done)
+	})
+	if c.cur != a {
+		return
+	}
+	c.cur = nil
+	c.cond.Broadcast()
+	if !c.closed && c.expiry == nil {
+		c.expiry = time.AfterFunc(c.grace, func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.cur == nil {
+				c.closeLocked(ErrSessionExpired)
+			}
+		})
+	}
+}
+
+func (c *ResumableConn) readLoop(a *attachment) {
+	for {
+		typ, seq, ack, payload, err := readFrame(a.conn)
+		if err != nil {
+			c.detach(a)
+			return
+		}
+		c.mu.Lock()
+		if c.cur != a {
+			c.mu.Unlock()
+			return
+		}
+		c.ackLocked(ack)
+		switch typ {
+		case frameData:
+			if seq > c.recvd {
+				//gap in the stream, resync via a new attachment
+				c.detachLocked(a)
+				c.mu.Unlock()
+				return
+			}
+			if skip := c.recvd - seq; skip < uint64(len(payload)) {
+				data := payload[skip:]
+				c.recvBuf = append(c.recvBuf, data...)
+				c.recvd += uint64(len(data))
+				c.unacked += len(data)
+				if c.unacked >= ackEvery {
+					c.ackDue = true
+				}
+			}
+		case frameClose:
+			c.closeLocked(io.EOF)
+		}
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	}
+}
+
+func (c *ResumableConn) writeLoop(a *attachment) {
+	for {
+		c.mu.Lock()
+		for c.cur == a && !c.closed && a.wrote == c.sent && !c.ackDue {
+			c.cond.Wait()
+		}
+		if c.cur != a {
+			c.mu.Unlock()
+			return
+		}
+		var frame []byte
+		if a.wrote < c.sent {
+			off := a.wrote - c.acked
+			end := off + maxFramePayload
+			if end > uint64(len(c.sendBuf)) {
+				end = uint64(len(c.sendBuf))
+			}
+			frame = encodeFrame(frameData, a.wrote, c.recvd, c.sendBuf[off:end])
+			a.wrote += end - off
+		} else if c.closed {
+			//flushed, tell the peer and stop
+			c.mu.Unlock()
+			a.conn.Write(encodeFrame(frameClose, a.wrote, 0, nil))
+			c.detach(a)
+			return
+		} else {
+			frame = encodeFrame(frameAck, a.wrote, c.recvd, nil)
+		}
+		c.ackDue = false
+		c.unacked = 0
+		c.mu.Unlock()
+		if _, err := a.conn.Write(frame); err != nil {
+			c.detach(a)
+			return
+		}
+	}
+}
+
+// ackLoop periodically acknowledges received data,
+// when there was no outbound data to carry the ack
+func (c *ResumableConn) ackLoop(a *attachment) {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-t.C:
+		}
+		c.mu.Lock()
+		if c.unacked > 0 {
+			c.ackDue = true
+			c.cond.Broadcast()
+		}
+		c.mu.Unlock()
+	}
+}
+
+// ackLocked discards acknowledged bytes from the replay buffer
+func (c *ResumableConn) ackLocked(ack uint64) {
+	if ack <= c.acked || ack > c.sent {
+		return
+	}
+	c.sendBuf = c.sendBuf[ack-c.acked:]
+	c.acked = ack
+	c.cond.Broadcast()
+}
+
+func (c *ResumableConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.recvBuf) == 0 && !c.closed {
+		c.cond.Wait()
+	}
+	if len(c.recvBuf) == 0 {
+		return 0, c.err
+	}
+	n := copy(b, c.recvBuf)
+	c.recvBuf = c.recvBuf[n:]
+	return n, nil
+}
+
+func (c *ResumableConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for len(b) > 0 {
+		for !c.closed && len(c.sendBuf) >= c.maxBuf {
+			c.cond.Wait()
+		}
+		if c.closed {
+			return n, c.err
+		}
+		k := c.maxBuf - len(c.sendBuf)
+		if k > len(b) {
+			k = len(b)
+		}
+		c.sendBuf = append(c.sendBuf, b[:k]...)
+		c.sent += uint64(k)
+		b = b[k:]
+		n += k
+		c.cond.Broadcast()
+	}
+	return n, nil
+}
+
+// Close ends the stream, flushing it to the peer if attached
+func (c *ResumableConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeLocked(net.ErrClosed)
+	return nil
+}
+
+func (c *ResumableConn) closeLocked(err error) {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.err = err
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+	c.cond.Broadcast()
+}
+
+// Err returns why the stream ended, or nil while it is open
+func (c *ResumableConn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *ResumableConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.local
+}
+
+func (c *ResumableConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remote
+}
+
+// deadlines are not supported, since the
+// stream outlives its connections
+func (c *ResumableConn) SetDeadline(t time.Time) error      { return nil }
+func (c *ResumableConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *ResumableConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func encodeFrame(typ byte, seq, ack uint64, payload []byte) []byte {
+	b := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	b[0] = typ
+	binary.BigEndian.PutUint64(b[1:9], seq)
+	binary.BigEndian.PutUint64(b[9:17], ack)
+	binary.BigEndian.PutUint32(b[17:21], uint32(len(payload)))
+	return append(b, payload...)
+}
+
+func readFrame(r io.Reader) (typ byte, seq, ack uint64, payload []byte, err error) {
+	h := make([]byte, frameHeaderSize)
+	if _, err = io.ReadFull(r, h); err != nil {
+		return
+	}
+	typ = h[0]
+	seq = binary.BigEndian.Uint64(h[1:9])
+	ack = binary.BigEndian.Uint64(h[9:17])
+	n := binary.BigEndian.Uint32(h[17:21])
+	if n > maxFramePayload {
+		err = errors.New("frame too large")
+		return
+	}
+	payload = make([]byte, n)
+	_, err = io.ReadFull(r, payload)
+	return
+}
@@ -2,6 +2,7 @@ package cnet
 
 import (
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -66,3 +67,61 @@ func (c *wsConn) SetDeadline(t time.Time) error {
 	}
 	return c.Conn.SetWriteDeadline(t)
 }
+
+//WebSocketKeepAlive pings the other side of a websocket connection
+//(see NewWebSocketConn) every interval, and closes the connection once
+//more than misses pings in a row have no pong within timeout. Each ping
+//carries its number, so that a late pong does not answer a later ping.
+//Pongs are only handled while the connection is being read. Blocks
+//until the connection is closed.
+func WebSocketKeepAlive(conn net.Conn, interval, timeout time.Duration, misses int) {
+	c, ok := conn.(*wsConn)
+	if !ok {
+		return
+	}
+	//only the reader calls the handler, so it
+	//may replace the last pong without blocking
+	pongs := make(chan uint64, 1)
+	c.SetPongHandler(func(data string) error {
+		n, err := strconv.ParseUint(data, 10, 64)
+		if err != nil {
+			return nil
+		}
+		select {
+		case <-pongs:
+		default:
+		}
+		pongs <- n
+		return nil
+	})
+	missed := 0
+	for n := uint64(1); ; n++ {
+		payload := []byte(strconv.FormatUint(n, 10))
+		if err := c.WriteControl(websocket.PingMessage, payload, time.Now().Add(timeout)); err != nil {
+			return
+		}
+		if waitPong(pongs, n, timeout) {
+			missed = 0
+		} else if missed++; missed > misses {
+			c.Close()
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+//waitPong waits for the pong of ping n, ignoring late pongs
+func waitPong(pongs <-chan uint64, n uint64, timeout time.Duration) bool {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	for {
+		select {
+		case p := <-pongs:
+			if p == n {
+				return true
+			}
+		case <-t.C:
+			return false
+		}
+	}
+}
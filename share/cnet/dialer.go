@@ -0,0 +1,139 @@
+package cnet
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+//DialerConfig configures a Dialer
+type DialerConfig struct {
+	//Source is the local IP of outbound connections
+	Source string
+	//Interface binds outbound connections to a network interface
+	Interface string
+	//Proxy is an upstream HTTP CONNECT or SOCKS5 proxy URL
+	//which outbound TCP connections are dialed through
+	Proxy string
+	//ProxyBypass lists CIDRs, IPs and host globs
+	//which are dialed directly instead of via Proxy
+	ProxyBypass []string
+}
+
+//Dialer dials outbound connections, optionally from a specific
+//source IP and/or network interface, and optionally via an
+//upstream proxy
+type Dialer struct {
+	SourceIP  net.IP
+	Interface string
+	Proxy     *url.URL
+	Bypass    []string
+}
+
+//NewDialer validates the given config,
+//returning nil when nothing is set
+func NewDialer(c DialerConfig) (*Dialer, error) {
+	if c.Source == "" && c.Interface == "" && c.Proxy == "" {
+		return nil, nil
+	}
+	d := &Dialer{Interface: c.Interface}
+	if c.Source != "" {
+		d.SourceIP = net.ParseIP(strings.Trim(c.Source, "[]"))
+		if d.SourceIP == nil {
+			return nil, fmt.Errorf("Invalid source IP: %s", c.Source)
+		}
+	}
+	if c.Interface != "" {
+		if !canBindToDevice {
+			return nil, fmt.Errorf("Binding to an interface is not supported on this platform")
+		}
+		if _, err := net.InterfaceByName(c.Interface); err != nil {
+			return nil, fmt.Errorf("Invalid interface %s: %s", c.Interface, err)
+		}
+	}
+	if c.Proxy != "" {
+		u, err := url.Parse(c.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy URL (%s)", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("Unsupported proxy type: %s://", u.Scheme)
+		}
+		if u.Port() == "" {
+			return nil, fmt.Errorf("Missing proxy port: %s", c.Proxy)
+		}
+		d.Proxy = u
+		for _, b := range c.ProxyBypass {
+			for _, p := range strings.Split(b, ",") {
+				if p = strings.TrimSpace(p); p != "" {
+					d.Bypass = append(d.Bypass, strings.ToLower(p))
+				}
+			}
+		}
+	}
+	return d, nil
+}
+
+//DialContext connects to the address on the named network,
+//a nil Dialer uses the system defaults. UDP is always dialed
+//directly, since proxies only carry TCP.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.proxied(network, addr) {
+		return d.dialProxy(ctx, addr)
+	}
+	return d.dialDirect(ctx, network, addr)
+}
+
+//DialResolved connects to the destination hostPort, which was
+//resolved (and checked) as addr. Connections bypass the proxy
+//when either matches, and the proxy is sent the host name, for
+//its own name resolution and rules.
+func (d *Dialer) DialResolved(ctx context.Context, network, hostPort, addr string) (net.Conn, error) {
+	if d.proxied(network, hostPort) && d.proxied(network, addr) {
+		return d.dialProxy(ctx, hostPort)
+	}
+	return d.dialDirect(ctx, network, addr)
+}
+
+func (d *Dialer) proxied(network, addr string) bool {
+	return d != nil && d.Proxy != nil && strings.HasPrefix(network, "tcp") && !d.bypass(addr)
+}
+
+func (d *Dialer) dialDirect(ctx context.Context, network, addr string) (net.Conn, error) {
+	nd := net.Dialer{}
+	if d != nil {
+		if d.SourceIP != nil {
+			if strings.HasPrefix(network, "udp") {
+				nd.LocalAddr = &net.UDPAddr{IP: d.SourceIP}
+			} else {
+				nd.LocalAddr = &net.TCPAddr{IP: d.SourceIP}
+			}
+		}
+		if d.Interface != "" {
+			nd.Control = bindToDevice(d.Interface)
+		}
+	}
+	return nd.DialContext(ctx, network, addr)
+}
+
+//String describes the dialer for logging
+func (d *Dialer) String() string {
+	if d == nil {
+		return "default"
+	}
+	s := []string{}
+	if d.SourceIP != nil {
+		s = append(s, "source "+d.SourceIP.String())
+	}
+	if d.Interface != "" {
+		s = append(s, "interface "+d.Interface)
+	}
+	if d.Proxy != nil {
+		s = append(s, "proxy "+d.Proxy.Redacted())
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,22 @@
+//go:build linux
+
+package cnet
+
+import (
+	"syscall"
+)
+
+const canBindToDevice = true
+
+//bindToDevice sets SO_BINDTODEVICE on outbound sockets
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package cnet
+
+import (
+	"errors"
+	"syscall"
+)
+
+const canBindToDevice = false
+
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("binding to an interface is not supported")
+	}
+}
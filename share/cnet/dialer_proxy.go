@@ -0,0 +1,124 @@
+package cnet
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+//bypass checks if the address matches any of the bypass
+//patterns, which are CIDRs, IP addresses or host globs
+func (d *Dialer) bypass(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	ip := net.ParseIP(host)
+	for _, b := range d.Bypass {
+		if _, n, err := net.ParseCIDR(b); err == nil {
+			if ip != nil && n.Contains(ip) {
+				return true
+			}
+		} else if bip := net.ParseIP(b); bip != nil {
+			if bip.Equal(ip) {
+				return true
+			}
+		} else if m, _ := path.Match(b, host); m {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Dialer) dialProxy(ctx context.Context, addr string) (net.Conn, error) {
+	u := d.Proxy
+	if strings.HasPrefix(u.Scheme, "socks") {
+		var auth *proxy.Auth
+		if u.User != nil {
+			pass, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: pass}
+		}
+		socks, err := proxy.SOCKS5("tcp", u.Host, auth, directDialer{d})
+		if err != nil {
+			return nil, err
+		}
+		return socks.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	}
+	//http connect
+	conn, err := d.dialDirect(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "https" {
+		tc := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		creds := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + pass))
+		req += "Proxy-Authorization: Basic " + creds + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT %s: %s", addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+//directDialer adapts Dialer for use as the
+//forwarding dialer of the SOCKS5 proxy client
+type directDialer struct {
+	d *Dialer
+}
+
+func (dd directDialer) Dial(network, addr string) (net.Conn, error) {
+	return dd.d.dialDirect(context.Background(), network, addr)
+}
+
+func (dd directDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dd.d.dialDirect(ctx, network, addr)
+}
+
+//bufferedConn reads any data buffered while
+//parsing the proxy response before the conn
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,208 @@
+package cnet
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ResolverConfig configures a Resolver
+type ResolverConfig struct {
+	//Server is the DNS server, in the form <ip>[:port] (udp),
+	//tcp://<ip>[:port], tls://<host>[:port] (DNS-over-TLS) or
+	//https://<host>/<path> (DNS-over-HTTPS)
+	Server string
+	//HostsFile is a hosts-style file of static overrides
+	HostsFile string
+}
+
+// Resolver looks up host names for outbound connections,
+// using static overrides and then a specific DNS server
+type Resolver struct {
+	server   string
+	resolver *net.Resolver
+	dial     dnsDialFunc
+	hosts    map[string][]net.IP
+}
+
+type dnsDialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// NewResolver creates a Resolver using the given dialer
+// to reach the DNS server, returning nil when nothing is set
+func NewResolver(c ResolverConfig, d *Dialer) (*Resolver, error) {
+	if c.Server == "" && c.HostsFile == "" {
+		return nil, nil
+	}
+	r := &Resolver{resolver: net.DefaultResolver, server: "system"}
+	if c.HostsFile != "" {
+		hosts, err := readHostsFile(c.HostsFile)
+		if err != nil {
+			return nil, err
+		}
+		r.hosts = hosts
+	}
+	if c.Server != "" {
+		dial, err := dnsDialer(c.Server, d)
+		if err != nil {
+			return nil, err
+		}
+		r.server = c.Server
+		r.dial = dial
+		r.resolver = &net.Resolver{PreferGo: true, Dial: dial}
+	}
+	return r, nil
+}
+
+// LookupIP resolves the host into its IP addresses,
+// a nil Resolver uses the system resolver
+func (r *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	host = strings.Trim(host, "[]")
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	resolver := net.DefaultResolver
+	if r != nil {
+		if ips, ok := r.hosts[strings.ToLower(strings.TrimSuffix(host, "."))]; ok {
+			return ips, nil
+		}
+		resolver = r.resolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips, nil
+}
+
+// Nameserver returns the address of the DNS server which Exchange
+// queries, with a nil IP when the server is named by its host name
+func (r *Resolver) Nameserver() (host string, ip net.IP, port int) {
+	server := SystemNameserver()
+	if r != nil && r.dial != nil {
+		server = r.server
+	}
+	if !strings.Contains(server, "://") {
+		server = "udp://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", nil, 0
+	}
+	port, _ = strconv.Atoi(u.Port())
+	if port == 0 {
+		port = map[string]int{"udp": 53, "tcp": 53, "tls": 853, "https": 443, "http": 80}[u.Scheme]
+	}
+	return u.Hostname(), net.ParseIP(u.Hostname()), port
+}
+
+// String describes the resolver for logging
+func (r *Resolver) String() string {
+	if r == nil {
+		return "system"
+	}
+	s := r.server
+	if len(r.hosts) > 0 {
+		s += fmt.Sprintf(" (%d static hosts)", len(r.hosts))
+	}
+	return s
+}
+
+// dnsDialer returns a net.Resolver dial function which
+// connects to the given DNS server, ignoring the system's
+func dnsDialer(server string, d *Dialer) (dnsDialFunc, error) {
+	if !strings.Contains(server, "://") {
+		server = "udp://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid DNS server (%s)", err)
+	}
+	hostPort := func(port string) string {
+		if u.Port() == "" {
+			return net.JoinHostPort(u.Hostname(), port)
+		}
+		return u.Host
+	}
+	switch u.Scheme {
+	case "udp":
+		//use tcp when the resolver retries truncated responses
+		addr := hostPort("53")
+		return func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return d.dialDirect(ctx, network, addr)
+		}, nil
+	case "tcp":
+		addr := hostPort("53")
+		return func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return d.dialDirect(ctx, "tcp", addr)
+		}, nil
+	case "tls":
+		addr := hostPort("853")
+		return func(ctx context.Context, network, _ string) (net.Conn, error) {
+			conn, err := d.dialDirect(ctx, "tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+			tc := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+			if err := tc.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return tc, nil
+		}, nil
+	case "https", "http":
+		client := &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext:       d.dialDirect,
+				ForceAttemptHTTP2: true,
+			},
+		}
+		return func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return newDoHConn(ctx, client, u.String()), nil
+		}, nil
+	}
+	return nil, fmt.Errorf("Unsupported DNS server type: %s://", u.Scheme)
+}
+
+// readHostsFile parses a hosts-style file of
+// "<ip> <name> [name...]" lines into a lookup table
+func readHostsFile(path string) (map[string][]net.IP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read hosts file: %s", err)
+	}
+	defer f.Close()
+	hosts := map[string][]net.IP{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid IP in hosts file: %s", fields[0])
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			hosts[name] = append(hosts[name], ip)
+		}
+	}
+	return hosts, scanner.Err()
+}
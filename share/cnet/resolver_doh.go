@@ -0,0 +1,87 @@
+package cnet
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// dohConn is a net.Conn which the Go resolver writes length-prefixed
+// DNS messages to (as with DNS over TCP). Each message is sent as
+// a DNS-over-HTTPS (RFC 8484) request, and the response is framed
+// the same way for the resolver to read back.
+type dohConn struct {
+	ctx    context.Context
+	client *http.Client
+	url    string
+	wbuf   bytes.Buffer
+	rbuf   bytes.Buffer
+}
+
+func newDoHConn(ctx context.Context, client *http.Client, url string) net.Conn {
+	return &dohConn{ctx: ctx, client: client, url: url}
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.wbuf.Write(b)
+	for c.wbuf.Len() >= 2 {
+		n := int(binary.BigEndian.Uint16(c.wbuf.Bytes()))
+		if c.wbuf.Len() < 2+n {
+			break
+		}
+		c.wbuf.Next(2)
+		if err := c.roundTrip(c.wbuf.Next(n)); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (c *dohConn) roundTrip(msg []byte) error {
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodPost, c.url, bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("DNS-over-HTTPS: %s", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return err
+	}
+	c.rbuf.Write(binary.BigEndian.AppendUint16(nil, uint16(len(b))))
+	c.rbuf.Write(b)
+	return nil
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.rbuf.Len() == 0 {
+		return 0, errors.New("DNS-over-HTTPS: no pending response")
+	}
+	return c.rbuf.Read(b)
+}
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr(c.url) }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr(c.url) }
+func (c *dohConn) SetDeadline(t time.Time) error      { return nil }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type dohAddr string
+
+func (a dohAddr) Network() string { return "https" }
+func (a dohAddr) String() string  { return string(a) }
@@ -0,0 +1,106 @@
+package cnet
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Exchange sends a raw DNS query to the resolver's DNS server (or
+// the system's nameserver) and returns the raw response. Truncated
+// UDP responses are retried over TCP.
+func (r *Resolver) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	dial := dnsDialFunc(systemDNSDial)
+	if r != nil && r.dial != nil {
+		dial = r.dial
+	}
+	resp, err := exchange(ctx, dial, "udp", query)
+	if err == nil && len(resp) > 2 && resp[2]&0x02 != 0 {
+		resp, err = exchange(ctx, dial, "tcp", query)
+	}
+	return resp, err
+}
+
+func exchange(ctx context.Context, dial dnsDialFunc, network string, query []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+	}
+	conn, err := dial(ctx, network, "")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	if _, ok := conn.(net.PacketConn); ok {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		b := make([]byte, 65535)
+		n, err := conn.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+	return ReadDNSMessage(conn)
+}
+
+// ReadDNSMessage reads a single length-prefixed
+// DNS message, as used by DNS over TCP
+func ReadDNSMessage(r io.Reader) ([]byte, error) {
+	l := make([]byte, 2)
+	if _, err := io.ReadFull(r, l); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(l))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// WriteDNSMessage writes a single length-prefixed
+// DNS message, as used by DNS over TCP
+func WriteDNSMessage(w io.Writer, msg []byte) error {
+	if len(msg) > 65535 {
+		return errors.New("DNS message too large")
+	}
+	_, err := w.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+	return err
+}
+
+// systemDNSDial dials the first nameserver of /etc/resolv.conf,
+// falling back to localhost (as the Go resolver does)
+func systemDNSDial(ctx context.Context, network, _ string) (net.Conn, error) {
+	d := net.Dialer{}
+	return d.DialContext(ctx, network, SystemNameserver())
+}
+
+// SystemNameserver returns the address of the system's
+// primary nameserver, defaulting to 127.0.0.1:53
+func SystemNameserver() string {
+	if f, err := os.Open("/etc/resolv.conf"); err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
@@ -0,0 +1,83 @@
+package cnet
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// ResumeNew is the ResumeHeader value
+// requesting a new resumable session
+const ResumeNew = "new"
+
+// ResumeToken is issued by the server over the authenticated ssh
+// connection of a resumable session. The id names the session, while
+// the secret never leaves the ssh connection: each resume attempt is
+// proven with a MAC of its attempt number, see Proof.
+type ResumeToken struct {
+	ID     string
+	Secret []byte
+}
+
+// NewResumeToken creates a random token
+func NewResumeToken() ResumeToken {
+	b := make([]byte, 16+32)
+	rand.Read(b)
+	return ResumeToken{ID: hex.EncodeToString(b[:16]), Secret: b[16:]}
+}
+
+// ParseResumeToken parses the form of String
+func ParseResumeToken(s string) (ResumeToken, error) {
+	id, secret, ok := strings.Cut(s, ".")
+	b, err := hex.DecodeString(secret)
+	if !ok || id == "" || err != nil || len(b) != 32 {
+		return ResumeToken{}, errors.New("invalid resume token")
+	}
+	return ResumeToken{ID: id, Secret: b}, nil
+}
+
+func (t ResumeToken) String() string {
+	return t.ID + "." + hex.EncodeToString(t.Secret)
+}
+
+// Proof returns the ResumeHeader value of the nth resume attempt
+func (t ResumeToken) Proof(n uint64) string {
+	msg := t.ID + "." + strconv.FormatUint(n, 10)
+	return msg + "." + hex.EncodeToString(t.mac(msg))
+}
+
+// Verify checks the proof was made with this token,
+// returning its attempt number
+func (t ResumeToken) Verify(proof string) (uint64, bool) {
+	i := strings.LastIndexByte(proof, '.')
+	if i < 0 {
+		return 0, false
+	}
+	msg := proof[:i]
+	mac, err := hex.DecodeString(proof[i+1:])
+	if err != nil || !hmac.Equal(mac, t.mac(msg)) {
+		return 0, false
+	}
+	id, n, _ := strings.Cut(msg, ".")
+	attempt, err := strconv.ParseUint(n, 10, 64)
+	if id != t.ID || err != nil {
+		return 0, false
+	}
+	return attempt, true
+}
+
+func (t ResumeToken) mac(msg string) []byte {
+	h := hmac.New(sha256.New, t.Secret)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+// ResumeProofID returns the session id of a proof
+func ResumeProofID(proof string) string {
+	id, _, _ := strings.Cut(proof, ".")
+	return id
+}
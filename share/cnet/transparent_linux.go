@@ -0,0 +1,176 @@
+//go:build linux
+
+package cnet
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soOriginalDst       = 80 //SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST
+	ipv6Transparent     = 75 //IPV6_TRANSPARENT
+	ipv6RecvOrigDstAddr = 74 //IPV6_RECVORIGDSTADDR
+)
+
+// ListenTransparentTCP listens for connections redirected by iptables
+// REDIRECT or TPROXY. TPROXY requires IP_TRANSPARENT which needs
+// CAP_NET_ADMIN, so it is only set when permitted.
+func ListenTransparentTCP(addr string) (*net.TCPListener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return c.Control(func(fd uintptr) {
+				setTransparent(int(fd), network)
+			})
+		},
+	}
+	l, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return l.(*net.TCPListener), nil
+}
+
+// OriginalDst returns the destination of a redirected connection,
+// using SO_ORIGINAL_DST (REDIRECT) and falling back to the local
+// address of the connection (TPROXY)
+func OriginalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("not a tcp connection")
+	}
+	local := tc.LocalAddr().(*net.TCPAddr)
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var addr *net.TCPAddr
+	if cerr := rc.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			//sockaddr_in fits in an ipv6_mreq
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+			if err == nil {
+				b := mreq.Multiaddr
+				addr = &net.TCPAddr{
+					IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+					Port: int(binary.BigEndian.Uint16(b[2:4])),
+				}
+			}
+		} else {
+			//sockaddr_in6 fits in an ip6_mtuinfo
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst)
+			if err == nil {
+				port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+				addr = &net.TCPAddr{
+					IP:   net.IP(append([]byte(nil), info.Addr.Addr[:]...)),
+					Port: int(binary.BigEndian.Uint16(port[:])),
+				}
+			}
+		}
+	}); cerr != nil {
+		return nil, cerr
+	}
+	if addr == nil {
+		addr = local
+	}
+	return addr, nil
+}
+
+// ListenTransparentUDP listens for packets redirected by iptables
+// TPROXY, recording their original destination. This requires
+// CAP_NET_ADMIN.
+func ListenTransparentUDP(addr string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				if err = setTransparent(int(fd), network); err != nil {
+					return
+				}
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1)
+				if err == nil && network == "udp6" {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6RecvOrigDstAddr, 1)
+				}
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	c, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
+
+// ReadTransparentUDP reads a packet from a transparent UDP
+// listener, along with its source and original destination
+func ReadTransparentUDP(conn *net.UDPConn, b []byte) (n int, src, dst *net.UDPAddr, err error) {
+	oob := make([]byte, 128)
+	n, oobn, _, src, err := conn.ReadMsgUDP(b, oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	for _, m := range msgs {
+		d := m.Data
+		switch {
+		case m.Header.Level == syscall.SOL_IP && m.Header.Type == syscall.IP_RECVORIGDSTADDR && len(d) >= 8:
+			dst = &net.UDPAddr{
+				IP:   net.IPv4(d[4], d[5], d[6], d[7]),
+				Port: int(binary.BigEndian.Uint16(d[2:4])),
+			}
+		case m.Header.Level == syscall.SOL_IPV6 && m.Header.Type == ipv6RecvOrigDstAddr && len(d) >= 24:
+			dst = &net.UDPAddr{
+				IP:   net.IP(append([]byte(nil), d[8:24]...)),
+				Port: int(binary.BigEndian.Uint16(d[2:4])),
+			}
+		}
+	}
+	if dst == nil {
+		return 0, nil, nil, errors.New("missing original destination")
+	}
+	return n, src, dst, nil
+}
+
+// DialTransparentUDP returns a socket which sends packets to the
+// client as if they came from the original destination
+func DialTransparentUDP(from, to *net.UDPAddr) (*net.UDPConn, error) {
+	d := net.Dialer{
+		LocalAddr: from,
+		Control: func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				if err = setTransparent(int(fd), network); err != nil {
+					return
+				}
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+	c, err := d.Dial("udp", to.String())
+	if err != nil {
+		return nil, err
+	}
+	return c.(*net.UDPConn), nil
+}
+
+func setTransparent(fd int, network string) error {
+	if network == "tcp6" || network == "udp6" {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_IPV6, ipv6Transparent, 1); err != nil {
+			return err
+		}
+	}
+	return syscall.SetsockoptInt(fd, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+}
@@ -0,0 +1,35 @@
+//go:build !linux
+
+package cnet
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparent = errors.New("transparent proxying is only supported on linux")
+
+// ListenTransparentTCP is only supported on linux
+func ListenTransparentTCP(addr string) (*net.TCPListener, error) {
+	return nil, errTransparent
+}
+
+// OriginalDst is only supported on linux
+func OriginalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errTransparent
+}
+
+// ListenTransparentUDP is only supported on linux
+func ListenTransparentUDP(addr string) (*net.UDPConn, error) {
+	return nil, errTransparent
+}
+
+// ReadTransparentUDP is only supported on linux
+func ReadTransparentUDP(conn *net.UDPConn, b []byte) (n int, src, dst *net.UDPAddr, err error) {
+	return 0, nil, nil, errTransparent
+}
+
+// DialTransparentUDP is only supported on linux
+func DialTransparentUDP(from, to *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errTransparent
+}
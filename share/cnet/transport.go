@@ -0,0 +1,76 @@
+package cnet
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// Transports lists the supported transports, in the order
+// clients fall back to them when websockets are blocked
+var Transports = []string{"websocket", "http2", "poll", "tcp"}
+
+// Clients name the protocol and transport of requests which are
+// not websocket upgrades, and servers list their transports in
+// the TransportsHeader of responses to chisel requests
+const (
+	ProtocolHeader   = "X-Chisel-Protocol"
+	TransportHeader  = "X-Chisel-Transport"
+	TransportsHeader = "X-Chisel-Transports"
+)
+
+// TransportALPN is the TLS application protocol of the raw tcp
+// transport, so servers can tell it apart from HTTPS
+const TransportALPN = "chisel"
+
+// ParseTransports parses the transports listed in a
+// response header, which is empty for older servers
+func ParseTransports(h http.Header) []string {
+	var list []string
+	for _, t := range strings.Split(h.Get(TransportsHeader), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+// WriteRawHeader writes the first line and headers which start
+// a raw tcp transport, in the same format as an HTTP/1 message
+func WriteRawHeader(w io.Writer, line string, h http.Header) error {
+	b := bytes.Buffer{}
+	b.WriteString(line + "\r\n")
+	h.Write(&b)
+	b.WriteString("\r\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// ReadRawHeader reads the first line and headers of a raw tcp
+// transport, returning the conn to continue the stream with
+func ReadRawHeader(conn net.Conn) (string, http.Header, net.Conn, error) {
+	br := bufio.NewReader(conn)
+	tr := textproto.NewReader(br)
+	line, err := tr.ReadLine()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	h, err := tr.ReadMIMEHeader()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if br.Buffered() > 0 {
+		conn = &bufferedConn{Conn: conn, r: br}
+	}
+	return line, http.Header(h), conn, nil
+}
+
+// NewBufferedConn returns a conn which first reads the data
+// buffered by r, such as after peeking at the conn
+func NewBufferedConn(conn net.Conn, r *bufio.Reader) net.Conn {
+	return &bufferedConn{Conn: conn, r: r}
+}
@@ -0,0 +1,135 @@
+//go:build linux
+
+package cnet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/link/tun"
+)
+
+// OpenTun creates (or attaches to) the named TUN interface, sets
+// its MTU, brings it up and routes the given networks into it.
+// The returned file descriptor reads and writes raw IP packets.
+func OpenTun(name string, mtu int, routes []*net.IPNet) (int, error) {
+	fd, err := tun.Open(name)
+	if err != nil {
+		return -1, fmt.Errorf("open %s: %s", name, err)
+	}
+	if err := setupTun(name, mtu, routes); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+func setupTun(name string, mtu int, routes []*net.IPNet) error {
+	sock, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(sock)
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		return err
+	}
+	ifr.SetUint32(uint32(mtu))
+	if err := unix.IoctlIfreq(sock, unix.SIOCSIFMTU, ifr); err != nil {
+		return fmt.Errorf("set mtu: %s", err)
+	}
+	if err := unix.IoctlIfreq(sock, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("get flags: %s", err)
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP | unix.IFF_RUNNING)
+	if err := unix.IoctlIfreq(sock, unix.SIOCSIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("set up: %s", err)
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	for _, r := range routes {
+		if err := addRoute(iface.Index, r); err != nil {
+			return fmt.Errorf("route %s: %s", r, err)
+		}
+	}
+	return nil
+}
+
+// addRoute adds a route to the network via the
+// interface, using an RTM_NEWROUTE netlink request
+func addRoute(index int, dst *net.IPNet) error {
+	family, ip := unix.AF_INET, dst.IP.To4()
+	if ip == nil {
+		family, ip = unix.AF_INET6, dst.IP.To16()
+	}
+	ones, _ := dst.Mask.Size()
+	//struct rtmsg, with no flags
+	body := []byte{
+		uint8(family), uint8(ones), 0, 0,
+		unix.RT_TABLE_MAIN, unix.RTPROT_BOOT, unix.RT_SCOPE_LINK, unix.RTN_UNICAST,
+		0, 0, 0, 0,
+	}
+	body = appendRtAttr(body, unix.RTA_DST, ip)
+	oif := binary.NativeEndian.AppendUint32(nil, uint32(index))
+	body = appendRtAttr(body, unix.RTA_OIF, oif)
+	return netlinkRequest(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, body)
+}
+
+func appendRtAttr(b []byte, typ uint16, data []byte) []byte {
+	l := unix.SizeofRtAttr + len(data)
+	b = binary.NativeEndian.AppendUint16(b, uint16(l))
+	b = binary.NativeEndian.AppendUint16(b, typ)
+	b = append(b, data...)
+	for l%unix.RTA_ALIGNTO != 0 {
+		b = append(b, 0)
+		l++
+	}
+	return b
+}
+
+// netlinkRequest sends a single route netlink
+// request and waits for its acknowledgement
+func netlinkRequest(typ uint16, flags uint16, body []byte) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+	msg := make([]byte, 0, unix.SizeofNlMsghdr+len(body))
+	msg = binary.NativeEndian.AppendUint32(msg, uint32(unix.SizeofNlMsghdr+len(body)))
+	msg = binary.NativeEndian.AppendUint16(msg, typ)
+	msg = binary.NativeEndian.AppendUint16(msg, flags|unix.NLM_F_REQUEST|unix.NLM_F_ACK)
+	msg = binary.NativeEndian.AppendUint32(msg, 1) //seq
+	msg = binary.NativeEndian.AppendUint32(msg, 0) //pid
+	msg = append(msg, body...)
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+	b := make([]byte, os.Getpagesize())
+	n, _, err := unix.Recvfrom(fd, b, 0)
+	if err != nil {
+		return err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(b[:n])
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		if m.Header.Type == unix.NLMSG_ERROR && len(m.Data) >= 4 {
+			if errno := int32(binary.NativeEndian.Uint32(m.Data[:4])); errno != 0 {
+				return unix.Errno(-errno)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("no netlink acknowledgement")
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package cnet
+
+import (
+	"errors"
+	"net"
+)
+
+// OpenTun is only supported on linux
+func OpenTun(name string, mtu int, routes []*net.IPNet) (int, error) {
+	return -1, errors.New("tun is only supported on linux")
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -21,6 +22,20 @@ func InterruptContext() context.Context {
 	return ctx
 }
 
+//TermSignal returns a channel which
+//is closed on the first SIGTERM
+func TermSignal() <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM)
+		<-sig
+		signal.Stop(sig)
+		close(ch)
+	}()
+	return ch
+}
+
 //SleepSignal sleeps for the given duration,
 //or until a SIGHUP is received
 func SleepSignal(d time.Duration) {
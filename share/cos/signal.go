@@ -13,9 +13,9 @@ import (
 	"github.com/jpillora/sizestr"
 )
 
-//GoStats prints statistics to
-//stdout on SIGUSR2 (posix-only)
-func GoStats() {
+//GoStats prints statistics to stdout on SIGUSR2
+//(posix-only), followed by those of each stats func
+func GoStats(stats ...func() string) {
 	//silence complaints from windows
 	const SIGUSR2 = syscall.Signal(0x1f)
 	time.Sleep(time.Second)
@@ -27,9 +27,20 @@ func GoStats() {
 		log.Printf("recieved SIGUSR2, go-routines: %d, go-memory-usage: %s",
 			runtime.NumGoroutine(),
 			sizestr.ToString(int64(memStats.Alloc)))
+		for _, s := range stats {
+			log.Print(s())
+		}
 	}
 }
 
+//UpgradeSignal returns a channel which receives
+//each SIGUSR1 (posix-only), see Server.Handoff
+func UpgradeSignal() <-chan os.Signal {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	return c
+}
+
 //AfterSignal returns a channel which will be closed
 //after the given duration or until a SIGHUP is received
 func AfterSignal(d time.Duration) <-chan struct{} {
@@ -3,13 +3,19 @@
 package cos
 
 import (
+	"os"
 	"time"
 )
 
-func GoStats() {
+func GoStats(stats ...func() string) {
 	//noop
 }
 
+func UpgradeSignal() <-chan os.Signal {
+	//noop
+	return nil
+}
+
 func AfterSignal(d time.Duration) <-chan struct{} {
 	ch := make(chan struct{})
 	go func() {
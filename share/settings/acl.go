@@ -0,0 +1,184 @@
+package settings
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ACL is an ordered list of destination rules. The first
+// rule matching a destination decides whether it is allowed,
+// and destinations matching no rule are denied. Rules are
+// written as "<allow|deny> <target>[:<ports>]", where:
+//
+//	target is a CIDR (10.0.0.0/8, [fd00::/8]), an IP address,
+//	  or a hostname glob (*.example.com, *)
+//	ports is a comma separated list of ports or port ranges
+//	  (22, 80,443, 8000-9000, *), defaulting to all ports
+//
+// CIDR and IP targets are matched against the resolved address
+// of the destination, hostname globs against the requested host.
+type ACL []*ACLRule
+
+// ACLRule is a single allow or deny rule
+type ACLRule struct {
+	Allow bool
+	Net   *net.IPNet
+	Host  string
+	Ports []PortRange
+}
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	Min, Max int
+}
+
+// ParseACL parses each of the given rules
+func ParseACL(rules []string) (ACL, error) {
+	acl := ACL{}
+	for _, s := range rules {
+		r, err := ParseACLRule(s)
+		if err != nil {
+			return nil, err
+		}
+		acl = append(acl, r)
+	}
+	return acl, nil
+}
+
+// ParseACLRule parses a single "<allow|deny> <target>[:<ports>]" rule
+func ParseACLRule(s string) (*ACLRule, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("Invalid ACL rule '%s'", s)
+	}
+	r := &ACLRule{}
+	switch strings.ToLower(fields[0]) {
+	case "allow":
+		r.Allow = true
+	case "deny":
+	default:
+		return nil, fmt.Errorf("Invalid ACL rule '%s': expected allow or deny", s)
+	}
+	target, ports := splitTargetPorts(fields[1])
+	if ports == "" || ports == "*" {
+		r.Ports = []PortRange{{1, 65535}}
+	} else {
+		for _, p := range strings.Split(ports, ",") {
+			pr, err := parsePortRange(p)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid ACL rule '%s': %s", s, err)
+			}
+			r.Ports = append(r.Ports, pr)
+		}
+	}
+	if strings.Contains(target, "/") || net.ParseIP(target) != nil {
+		n, err := ParseCIDR(target)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ACL rule '%s': %s", s, err)
+		}
+		r.Net = n
+	} else {
+		if _, err := path.Match(target, ""); err != nil {
+			return nil, fmt.Errorf("Invalid ACL rule '%s': bad pattern", s)
+		}
+		r.Host = strings.ToLower(target)
+	}
+	return r, nil
+}
+
+// splitTargetPorts splits "target:ports" where
+// IPv6 targets are wrapped in square brackets
+func splitTargetPorts(s string) (target, ports string) {
+	if strings.HasPrefix(s, "[") {
+		if i := strings.Index(s, "]"); i > 0 {
+			return s[1:i], strings.TrimPrefix(s[i+1:], ":")
+		}
+	}
+	if strings.Count(s, ":") > 1 {
+		return s, "" //bare IPv6
+	}
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+func parsePortRange(s string) (PortRange, error) {
+	lo, hi, isRange := strings.Cut(s, "-")
+	if !isRange {
+		hi = lo
+	}
+	min, err1 := strconv.Atoi(lo)
+	max, err2 := strconv.Atoi(hi)
+	if err1 != nil || err2 != nil || min < 1 || max > 65535 || min > max {
+		return PortRange{}, errors.New("bad port range " + s)
+	}
+	return PortRange{min, max}, nil
+}
+
+// Allows checks if the destination host, resolved to
+// the given IP, may be dialed on the given port
+func (acl ACL) Allows(host string, ip net.IP, port int) bool {
+	for _, r := range acl {
+		if r.Matches(host, ip, port) {
+			return r.Allow
+		}
+	}
+	return false
+}
+
+// Matches checks if the rule applies to the given destination
+func (r *ACLRule) Matches(host string, ip net.IP, port int) bool {
+	inRange := false
+	for _, pr := range r.Ports {
+		if port >= pr.Min && port <= pr.Max {
+			inRange = true
+			break
+		}
+	}
+	if !inRange {
+		return false
+	}
+	if r.Net != nil {
+		return ip != nil && r.Net.Contains(ip)
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	m, _ := path.Match(r.Host, host)
+	return m
+}
+
+// String converts the rule back into its text form
+func (r *ACLRule) String() string {
+	sb := strings.Builder{}
+	if r.Allow {
+		sb.WriteString("allow ")
+	} else {
+		sb.WriteString("deny ")
+	}
+	if r.Net != nil {
+		if r.Net.IP.To4() == nil {
+			sb.WriteString("[" + r.Net.String() + "]")
+		} else {
+			sb.WriteString(r.Net.String())
+		}
+	} else {
+		sb.WriteString(r.Host)
+	}
+	ports := make([]string, len(r.Ports))
+	for i, pr := range r.Ports {
+		switch {
+		case pr.Min == 1 && pr.Max == 65535:
+			ports[i] = "*"
+		case pr.Min == pr.Max:
+			ports[i] = strconv.Itoa(pr.Min)
+		default:
+			ports[i] = strconv.Itoa(pr.Min) + "-" + strconv.Itoa(pr.Max)
+		}
+	}
+	sb.WriteString(":" + strings.Join(ports, ","))
+	return sb.String()
+}
@@ -0,0 +1,59 @@
+package settings
+
+import (
+	"net"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	acl, err := ParseACL([]string{
+		"deny 169.254.169.254",
+		"allow 10.0.0.0/8:22,80-90",
+		"deny *.internal.example.com",
+		"allow *.example.com:443",
+		"allow [fd00::/8]:*",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, test := range []struct {
+		Host    string
+		IP      string
+		Port    int
+		Allowed bool
+	}{
+		{"10.1.2.3", "10.1.2.3", 22, true},
+		{"db.local", "10.1.2.3", 85, true},
+		{"10.1.2.3", "10.1.2.3", 443, false},
+		{"169.254.169.254", "169.254.169.254", 80, false},
+		{"www.example.com", "93.184.216.34", 443, true},
+		{"WWW.Example.com", "93.184.216.34", 443, true},
+		{"www.example.com", "93.184.216.34", 80, false},
+		{"db.internal.example.com", "93.184.216.34", 443, false},
+		{"rebind.example.com", "169.254.169.254", 443, false},
+		{"[fd00::1]", "fd00::1", 8080, true},
+		{"google.com", "142.250.0.1", 443, false},
+	} {
+		got := acl.Allows(test.Host, net.ParseIP(test.IP), test.Port)
+		if got != test.Allowed {
+			t.Fatalf("#%d %s (%s) port %d expected allowed=%v", i+1, test.Host, test.IP, test.Port, test.Allowed)
+		}
+	}
+	expected := []string{
+		"deny 169.254.169.254/32:*",
+		"allow 10.0.0.0/8:22,80-90",
+		"deny *.internal.example.com:*",
+		"allow *.example.com:443",
+		"allow [fd00::/8]:*",
+	}
+	for i, r := range acl {
+		if r.String() != expected[i] {
+			t.Fatalf("rule #%d expected %s, got %s", i+1, expected[i], r.String())
+		}
+	}
+	for _, bad := range []string{"permit *", "allow", "allow *:0", "allow *:9-1", "allow 10.0.0.0/33"} {
+		if _, err := ParseACLRule(bad); err == nil {
+			t.Fatalf("expected '%s' to fail", bad)
+		}
+	}
+}
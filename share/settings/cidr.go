@@ -0,0 +1,84 @@
+package settings
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// CIDRs is a list of networks, bare IP
+// addresses are stored as single-host networks
+type CIDRs []*net.IPNet
+
+// ParseCIDRs converts the given strings into CIDRs,
+// where each string may also be a comma separated list
+func ParseCIDRs(ss []string) (CIDRs, error) {
+	cs := CIDRs{}
+	for _, s := range ss {
+		for _, c := range strings.Split(s, ",") {
+			c = strings.TrimSpace(c)
+			if c == "" {
+				continue
+			}
+			n, err := ParseCIDR(c)
+			if err != nil {
+				return nil, err
+			}
+			cs = append(cs, n)
+		}
+	}
+	return cs, nil
+}
+
+// ParseCIDR parses a network (10.0.0.0/8) or
+// a single address (10.0.0.1) into an IPNet
+func ParseCIDR(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR: %s", s)
+		}
+		return n, nil
+	}
+	ip := net.ParseIP(strings.Trim(s, "[]"))
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid IP: %s", s)
+	}
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// Contains checks if any of the networks contain the given IP
+func (cs CIDRs) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range cs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Strings converts the networks back into strings
+func (cs CIDRs) Strings() []string {
+	s := make([]string, len(cs))
+	for i, n := range cs {
+		s[i] = n.String()
+	}
+	return s
+}
+
+// HostIP extracts the IP from a host:port address,
+// returning nil when the host is not an IP
+func HostIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(strings.Trim(host, "[]"))
+}
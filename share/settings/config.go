@@ -8,6 +8,19 @@ import (
 type Config struct {
 	Version string
 	Remotes
+	//Binding is the keying material of the QUIC connection
+	//the client sends this config over, see cnet.QUICConn
+	Binding []byte `json:",omitempty"`
+	//Compression lists the channel compression algorithms
+	//the sender supports. Servers reply to configs which list
+	//them with their own config, listing their algorithms.
+	Compression []string `json:",omitempty"`
+	//UDPFraming is the latest udp framing version the sender
+	//supports, where zero (older peers) is encoding/gob
+	UDPFraming int `json:",omitempty"`
+	//Resume is the token of a resumable session,
+	//which the server sends the client
+	Resume string `json:",omitempty"`
 }
 
 func DecodeConfig(b []byte) (*Config, error) {
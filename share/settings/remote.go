@@ -25,17 +25,30 @@ import (
 //   127.0.0.1:1080:socks
 //     local  127.0.0.1:1080
 //     remote socks
+//   127.0.0.1:5353:dns
+//     local  127.0.0.1:5353 (tcp and udp)
+//     remote dns
+//   12345:transparent
+//     local  127.0.0.1:12345 (tcp and udp)
+//     remote original destination
 //   stdio:example.com:22
 //     local  stdio
 //     remote example.com:22
 //   1.1.1.1:53/udp
 //     local  127.0.0.1:53/udp
 //     remote 1.1.1.1:53/udp
+//   5432:db:5432/zstd
+//     local  127.0.0.1:5432
+//     remote db:5432 (zstd compressed)
 
 type Remote struct {
 	LocalHost, LocalPort, LocalProto    string
 	RemoteHost, RemotePort, RemoteProto string
-	Socks, Reverse, Stdio               bool
+	Socks, Reverse, Stdio, DNS          bool
+	Transparent                         bool
+	//Compress optionally names the compression
+	//algorithm of the remote's connections
+	Compress string `json:",omitempty"`
 }
 
 const revPrefix = "R:"
@@ -46,11 +59,12 @@ func DecodeRemote(s string) (*Remote, error) {
 		s = strings.TrimPrefix(s, revPrefix)
 		reverse = true
 	}
+	s, compress := compressSuffix(s)
 	parts := regexp.MustCompile(`(\[[^\[\]]+\]|[^\[\]:]+):?`).FindAllStringSubmatch(s, -1)
 	if len(parts) <= 0 || len(parts) >= 5 {
 		return nil, errors.New("Invalid remote")
 	}
-	r := &Remote{Reverse: reverse}
+	r := &Remote{Reverse: reverse, Compress: compress}
 	//parse from back to front, to set 'remote' fields first,
 	//then to set 'local' fields second (allows the 'remote' side
 	//to provide the defaults)
@@ -61,6 +75,16 @@ func DecodeRemote(s string) (*Remote, error) {
 			r.Socks = true
 			continue
 		}
+		//remote portion is dns?
+		if i == len(parts)-1 && p == "dns" {
+			r.DNS = true
+			continue
+		}
+		//remote portion is transparent?
+		if i == len(parts)-1 && p == "transparent" {
+			r.Transparent = true
+			continue
+		}
 		//local portion is stdio?
 		if i == 0 && p == "stdio" {
 			r.Stdio = true
@@ -75,19 +99,19 @@ func DecodeRemote(s string) (*Remote, error) {
 			}
 		}
 		if isPort(p) {
-			if !r.Socks && r.RemotePort == "" {
+			if r.hasRemoteAddr() && r.RemotePort == "" {
 				r.RemotePort = p
 			}
 			r.LocalPort = p
 			continue
 		}
-		if !r.Socks && (r.RemotePort == "" && r.LocalPort == "") {
+		if r.hasRemoteAddr() && (r.RemotePort == "" && r.LocalPort == "") {
 			return nil, errors.New("Missing ports")
 		}
 		if !isHost(p) {
 			return nil, errors.New("Invalid host")
 		}
-		if !r.Socks && r.RemoteHost == "" {
+		if r.hasRemoteAddr() && r.RemoteHost == "" {
 			r.RemoteHost = p
 		} else {
 			r.LocalHost = p
@@ -102,6 +126,22 @@ func DecodeRemote(s string) (*Remote, error) {
 		if r.LocalPort == "" {
 			r.LocalPort = "1080"
 		}
+	} else if r.DNS {
+		//dns defaults
+		if r.LocalHost == "" {
+			r.LocalHost = "127.0.0.1"
+		}
+		if r.LocalPort == "" {
+			r.LocalPort = "53"
+		}
+	} else if r.Transparent {
+		//transparent defaults
+		if r.LocalHost == "" {
+			r.LocalHost = "127.0.0.1"
+		}
+		if r.LocalPort == "" {
+			return nil, errors.New("Missing ports")
+		}
 	} else {
 		//non-socks defaults
 		if r.LocalHost == "" {
@@ -126,12 +166,39 @@ func DecodeRemote(s string) (*Remote, error) {
 	if r.Socks && r.RemoteProto != "tcp" {
 		return nil, errors.New("only TCP SOCKS is supported")
 	}
+	if r.DNS && r.RemoteProto != "tcp" {
+		return nil, errors.New("dns remotes always listen on both TCP and UDP")
+	}
+	if r.DNS && r.Stdio {
+		return nil, errors.New("dns cannot be used with stdio")
+	}
+	if r.Transparent && r.RemoteProto != "tcp" {
+		return nil, errors.New("transparent remotes always listen on both TCP and UDP")
+	}
+	if r.Transparent && r.Stdio {
+		return nil, errors.New("transparent cannot be used with stdio")
+	}
 	if r.Stdio && r.Reverse {
 		return nil, errors.New("stdio cannot be reversed")
 	}
+	if r.Compress != "" && !r.CanCompress() {
+		return nil, errors.New("only TCP remotes can be compressed")
+	}
 	return r, nil
 }
 
+//CanCompress is true for remotes whose connections
+//are streams, which can be compressed
+func (r *Remote) CanCompress() bool {
+	return r.RemoteProto == "tcp" && !r.DNS
+}
+
+//hasRemoteAddr is false when the remote
+//portion is not a host and port
+func (r *Remote) hasRemoteAddr() bool {
+	return !r.Socks && !r.DNS && !r.Transparent
+}
+
 func isPort(s string) bool {
 	n, err := strconv.Atoi(s)
 	if err != nil {
@@ -162,6 +229,26 @@ func L4Proto(s string) (head, proto string) {
 	return s, ""
 }
 
+var compressRe = regexp.MustCompile(`(?i)\/(zstd|deflate)$`)
+
+//compressSuffix extracts the compression algorithm
+//from the end of the given remote
+func compressSuffix(s string) (head, compress string) {
+	if m := compressRe.FindStringSubmatch(s); m != nil {
+		return s[:len(s)-len(m[0])], strings.ToLower(m[1])
+	}
+	return s, ""
+}
+
+//Compression extracts the compression algorithm
+//from the extra data of a channel (host:port+zstd)
+func Compression(s string) (head, compress string) {
+	if i := strings.LastIndex(s, "+"); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
 //implement Stringer
 func (r Remote) String() string {
 	sb := strings.Builder{}
@@ -174,6 +261,9 @@ func (r Remote) String() string {
 	if r.RemoteProto == "udp" {
 		sb.WriteString("/udp")
 	}
+	if r.Compress != "" {
+		sb.WriteString("/" + r.Compress)
+	}
 	return sb.String()
 }
 
@@ -187,6 +277,9 @@ func (r Remote) Encode() string {
 	if r.RemoteProto == "udp" {
 		remote += "/udp"
 	}
+	if r.Compress != "" {
+		remote += "/" + r.Compress
+	}
 	if r.Reverse {
 		return "R:" + local + ":" + remote
 	}
@@ -209,6 +302,12 @@ func (r Remote) Remote() string {
 	if r.Socks {
 		return "socks"
 	}
+	if r.DNS {
+		return "dns"
+	}
+	if r.Transparent {
+		return "transparent"
+	}
 	if r.RemoteHost == "" {
 		r.RemoteHost = "127.0.0.1"
 	}
@@ -221,11 +320,24 @@ func (r Remote) UserAddr() string {
 	if r.Reverse {
 		return "R:" + r.LocalHost + ":" + r.LocalPort
 	}
+	if r.DNS {
+		return "dns"
+	}
+	if r.Transparent {
+		return "transparent"
+	}
 	return r.RemoteHost + ":" + r.RemotePort
 }
 
 //CanListen checks if the port can be listened on
 func (r Remote) CanListen() bool {
+	//dns listens on both protocols
+	if r.DNS {
+		tcp, udp := r, r
+		tcp.DNS, udp.DNS = false, false
+		udp.LocalProto = "udp"
+		return tcp.CanListen() && udp.CanListen()
+	}
 	//valid protocols
 	switch r.LocalProto {
 	case "tcp":
@@ -67,6 +67,33 @@ func TestRemoteDecode(t *testing.T) {
 			},
 			"127.0.0.1:1081:socks",
 		},
+		{
+			"dns",
+			Remote{
+				LocalHost: "127.0.0.1",
+				LocalPort: "53",
+				DNS:       true,
+			},
+			"127.0.0.1:53:dns",
+		},
+		{
+			"5353:dns",
+			Remote{
+				LocalHost: "127.0.0.1",
+				LocalPort: "5353",
+				DNS:       true,
+			},
+			"127.0.0.1:5353:dns",
+		},
+		{
+			"12345:transparent",
+			Remote{
+				LocalHost:   "127.0.0.1",
+				LocalPort:   "12345",
+				Transparent: true,
+			},
+			"127.0.0.1:12345:transparent",
+		},
 		{
 			"1.1.1.1:53/udp",
 			Remote{
@@ -90,6 +117,27 @@ func TestRemoteDecode(t *testing.T) {
 			},
 			"localhost:5353:1.1.1.1:53/udp",
 		},
+		{
+			"5432:db:5432/zstd",
+			Remote{
+				LocalPort:  "5432",
+				RemoteHost: "db",
+				RemotePort: "5432",
+				Compress:   "zstd",
+			},
+			"0.0.0.0:5432:db:5432/zstd",
+		},
+		{
+			"R:1080:socks/deflate",
+			Remote{
+				LocalHost: "127.0.0.1",
+				LocalPort: "1080",
+				Socks:     true,
+				Reverse:   true,
+				Compress:  "deflate",
+			},
+			"R:127.0.0.1:1080:socks/deflate",
+		},
 		{
 			"[::1]:8080:google.com:80",
 			Remote{
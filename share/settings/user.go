@@ -1,6 +1,7 @@
 package settings
 
 import (
+	"net"
 	"regexp"
 	"strings"
 )
@@ -16,9 +17,16 @@ func ParseAuth(auth string) (string, string) {
 }
 
 type User struct {
-	Name  string
-	Pass  string
-	Addrs []*regexp.Regexp
+	Name     string
+	Pass     string
+	Addrs    []*regexp.Regexp
+	AllowIPs CIDRs
+	DenyIPs  CIDRs
+	ACL      ACL
+	//ExitSource and ExitInterface override the source IP and
+	//network interface of the user's outbound connections
+	ExitSource    string
+	ExitInterface string
 }
 
 func (u *User) HasAccess(addr string) bool {
@@ -31,3 +39,16 @@ func (u *User) HasAccess(addr string) bool {
 	}
 	return m
 }
+
+// AllowsIP checks if the user may connect from the given
+// client IP. Denied networks take precedence, and when allowed
+// networks are set, the IP must be inside one of them.
+func (u *User) AllowsIP(ip net.IP) bool {
+	if u.DenyIPs.Contains(ip) {
+		return false
+	}
+	if len(u.AllowIPs) > 0 && !u.AllowIPs.Contains(ip) {
+		return false
+	}
+	return true
+}
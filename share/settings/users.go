@@ -4,9 +4,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"regexp"
 	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/jpillora/chisel/share/cio"
@@ -73,6 +75,10 @@ type UserIndex struct {
 	*cio.Logger
 	*Users
 	configFile string
+	//result of the last load, see LastLoad
+	loadMut sync.Mutex
+	loaded  time.Time
+	loadErr error
 }
 
 // NewUserIndex creates a source for users
@@ -87,7 +93,7 @@ func NewUserIndex(logger *cio.Logger) *UserIndex {
 func (u *UserIndex) LoadUsers(configFile string) error {
 	u.configFile = configFile
 	u.Infof("Loading configuration file %s", configFile)
-	if err := u.loadUserIndex(); err != nil {
+	if err := u.reload(); err != nil {
 		return err
 	}
 	if err := u.addWatchEvents(); err != nil {
@@ -110,7 +116,7 @@ func (u *UserIndex) addWatchEvents() error {
 			if e.Op&fsnotify.Write != fsnotify.Write {
 				continue
 			}
-			if err := u.loadUserIndex(); err != nil {
+			if err := u.reload(); err != nil {
 				u.Infof("Failed to reload the users configuration: %s", err)
 			} else {
 				u.Debugf("Users configuration successfully reloaded from: %s", u.configFile)
@@ -120,6 +126,24 @@ func (u *UserIndex) addWatchEvents() error {
 	return nil
 }
 
+// LastLoad returns when the configuration file was last
+// loaded, and the error of that load, if it failed
+func (u *UserIndex) LastLoad() (time.Time, error) {
+	u.loadMut.Lock()
+	defer u.loadMut.Unlock()
+	return u.loaded, u.loadErr
+}
+
+// reload loads the configuration file, recording the result
+func (u *UserIndex) reload() error {
+	err := u.loadUserIndex()
+	u.loadMut.Lock()
+	u.loaded = time.Now()
+	u.loadErr = err
+	u.loadMut.Unlock()
+	return err
+}
+
 // loadUserIndex is responsible for loading the users configuration
 func (u *UserIndex) loadUserIndex() error {
 	if u.configFile == "" {
@@ -129,18 +153,18 @@ func (u *UserIndex) loadUserIndex() error {
 	if err != nil {
 		return fmt.Errorf("Failed to read auth file: %s, error: %s", u.configFile, err)
 	}
-	var raw map[string][]string
+	var raw map[string]userConfig
 	if err := json.Unmarshal(b, &raw); err != nil {
 		return errors.New("Invalid JSON: " + err.Error())
 	}
 	users := []*User{}
-	for auth, remotes := range raw {
+	for auth, uc := range raw {
 		user := &User{}
 		user.Name, user.Pass = ParseAuth(auth)
 		if user.Name == "" {
 			return errors.New("Invalid user:pass string")
 		}
-		for _, r := range remotes {
+		for _, r := range uc.Addrs {
 			if r == "" || r == "*" {
 				user.Addrs = append(user.Addrs, UserAllowAll)
 			} else {
@@ -151,9 +175,44 @@ func (u *UserIndex) loadUserIndex() error {
 				user.Addrs = append(user.Addrs, re)
 			}
 		}
+		if user.AllowIPs, err = ParseCIDRs(uc.AllowIP); err != nil {
+			return fmt.Errorf("Invalid allow-ip for user %s: %s", user.Name, err)
+		}
+		if user.DenyIPs, err = ParseCIDRs(uc.DenyIP); err != nil {
+			return fmt.Errorf("Invalid deny-ip for user %s: %s", user.Name, err)
+		}
+		if user.ACL, err = ParseACL(uc.ACL); err != nil {
+			return fmt.Errorf("Invalid acl for user %s: %s", user.Name, err)
+		}
+		if uc.ExitSource != "" && net.ParseIP(uc.ExitSource) == nil {
+			return fmt.Errorf("Invalid exit-source for user %s", user.Name)
+		}
+		user.ExitSource = uc.ExitSource
+		user.ExitInterface = uc.ExitInterface
 		users = append(users, user)
 	}
 	//swap
 	u.Reset(users)
 	return nil
 }
+
+// userConfig is a single user entry in the auth file,
+// which is either a list of address regular expressions,
+// or an object containing the list and further settings
+type userConfig struct {
+	Addrs   []string `json:"addrs"`
+	AllowIP []string `json:"allow-ip"`
+	DenyIP  []string `json:"deny-ip"`
+	ACL     []string `json:"acl"`
+	//outbound overrides
+	ExitSource    string `json:"exit-source"`
+	ExitInterface string `json:"exit-interface"`
+}
+
+func (uc *userConfig) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &uc.Addrs); err == nil {
+		return nil
+	}
+	type plain userConfig
+	return json.Unmarshal(b, (*plain)(uc))
+}
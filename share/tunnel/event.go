@@ -0,0 +1,71 @@
+package tunnel
+
+import (
+	"time"
+)
+
+// EventType is the type of an Event
+type EventType string
+
+const (
+	//EventConnected and EventDisconnected are sent
+	//as ssh connections (sessions) begin and end
+	EventConnected    EventType = "connected"
+	EventDisconnected EventType = "disconnected"
+	//EventRemoteBound and EventRemoteFailed are sent as
+	//remotes start listening, and when they fail to
+	EventRemoteBound  EventType = "remote-bound"
+	EventRemoteFailed EventType = "remote-failed"
+	//EventChannelOpened and EventChannelClosed are sent as
+	//channels open and close, which are the tcp streams of
+	//local remotes, and any channel the other side opens
+	EventChannelOpened EventType = "channel-opened"
+	EventChannelClosed EventType = "channel-closed"
+	//EventAuthFailed is sent when a login is rejected
+	EventAuthFailed EventType = "auth-failed"
+	//EventConfigRejected is sent when the server
+	//rejects the configuration (remotes) of a client
+	EventConfigRejected EventType = "config-rejected"
+)
+
+// Event describes a change in a client or server, which
+// receive them with their OnEvent config, see Config.OnEvent
+type Event struct {
+	Type EventType
+	Time time.Time
+	//Session names the session on the server (e.g. session#1)
+	Session string
+	//User is the user of the session or login, on the server
+	User string
+	//Addr is the address of the other side of the session
+	Addr string
+	//Remote is the remote of remote and inbound channel events
+	Remote string
+	//Target is the destination of channel events, and
+	//Outbound is set when this side connects to it
+	Target   string
+	Outbound bool
+	//Sent and Received count the bytes of closed tcp channels
+	Sent     int64
+	Received int64
+	//Duration is how long the closed channel or session was open
+	Duration time.Duration
+	//Err is why the event happened, if it failed
+	Err error
+}
+
+// emit sends the event to the OnEvent func, if any
+func (t *Tunnel) emit(e Event) {
+	Emit(t.Config.OnEvent, e)
+}
+
+// Emit sends the event to fn, if set, timestamping it
+func Emit(fn func(Event), e Event) {
+	if fn == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	fn(e)
+}
@@ -0,0 +1,95 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// LatencyStats are the round trip times of the keepalive
+// pings on an ssh connection, see Tunnel.Latency
+type LatencyStats struct {
+	Pings int           `json:"pings"`
+	Last  time.Duration `json:"last"`
+	Min   time.Duration `json:"min"`
+	Avg   time.Duration `json:"avg"`
+	Max   time.Duration `json:"max"`
+	//Jitter is the mean difference between consecutive pings
+	Jitter time.Duration `json:"jitter"`
+}
+
+func (l *LatencyStats) add(rtt time.Duration) {
+	l.Pings++
+	n := time.Duration(l.Pings)
+	if l.Pings == 1 {
+		l.Min = rtt
+		l.Max = rtt
+	} else {
+		d := rtt - l.Last
+		if d < 0 {
+			d = -d
+		}
+		l.Jitter += (d - l.Jitter) / (n - 1)
+	}
+	l.Min = min(l.Min, rtt)
+	l.Max = max(l.Max, rtt)
+	l.Avg += (rtt - l.Avg) / n
+	l.Last = rtt
+}
+
+func (l LatencyStats) String() string {
+	if l.Pings == 0 {
+		return "no pings"
+	}
+	return fmt.Sprintf("%s (min/avg/max/jitter %s/%s/%s/%s, %d pings)",
+		round(l.Last), round(l.Min), round(l.Avg), round(l.Max), round(l.Jitter), l.Pings)
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(time.Microsecond)
+}
+
+// WriteLatencyMetrics writes the stats of each session in the
+// Prometheus text format, labelled by the session when named
+func WriteLatencyMetrics(w io.Writer, sessions map[string]LatencyStats) {
+	names := make([]string, 0, len(sessions))
+	for name := range sessions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "# HELP chisel_latency_seconds Round trip time of keepalive pings.")
+	fmt.Fprintln(w, "# TYPE chisel_latency_seconds gauge")
+	for _, name := range names {
+		l := sessions[name]
+		if l.Pings == 0 {
+			continue
+		}
+		for _, s := range []struct {
+			stat string
+			d    time.Duration
+		}{{"last", l.Last}, {"min", l.Min}, {"avg", l.Avg}, {"max", l.Max}, {"jitter", l.Jitter}} {
+			fmt.Fprintf(w, "chisel_latency_seconds%s %g\n", metricLabels(name, s.stat), s.d.Seconds())
+		}
+	}
+	fmt.Fprintln(w, "# HELP chisel_latency_pings_total Keepalive pings answered.")
+	fmt.Fprintln(w, "# TYPE chisel_latency_pings_total counter")
+	for _, name := range names {
+		fmt.Fprintf(w, "chisel_latency_pings_total%s %d\n", metricLabels(name, ""), sessions[name].Pings)
+	}
+}
+
+func metricLabels(session, stat string) string {
+	labels := []string{}
+	if session != "" {
+		labels = append(labels, fmt.Sprintf("session=%q", session))
+	}
+	if stat != "" {
+		labels = append(labels, fmt.Sprintf("stat=%q", stat))
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
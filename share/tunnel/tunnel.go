@@ -4,10 +4,13 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/armon/go-socks5"
@@ -25,9 +28,33 @@ type Config struct {
 	Outbound  bool
 	Socks     bool
 	KeepAlive time.Duration
+	//KeepAliveTimeout optionally limits how long to wait for
+	//the reply to a keepalive ping, after which it is missed,
+	//and KeepAliveMisses is the number of consecutive misses
+	//allowed before the ssh connection is closed
+	KeepAliveTimeout time.Duration
+	KeepAliveMisses  int
+	//MaxLatency optionally closes the ssh connection once the
+	//keepalive round trip time stays above it, for several pings
+	MaxLatency time.Duration
 	//ACL optionally checks if a given address (host:port) is allowed.
 	//When set, outbound connections are denied if this returns false.
 	ACL func(addr string) bool
+	//AllowDest optionally checks the resolved destination of outbound
+	//connections (including SOCKS). When set, only resolved addresses
+	//it permits are dialed.
+	AllowDest func(host string, ip net.IP, port int) bool
+	//Dialer optionally sets the source IP, interface
+	//and upstream proxy of outbound connections
+	Dialer *cnet.Dialer
+	//Resolver optionally sets how outbound destinations are resolved
+	Resolver *cnet.Resolver
+	//DNSDomains optionally restricts the names which dns remotes
+	//forward through the tunnel, others use the local nameserver
+	DNSDomains []string
+	//OnEvent optionally receives the remote and channel events of
+	//the tunnel, synchronously, so it should not block, see Event
+	OnEvent func(Event)
 }
 
 //Tunnel represents an SSH tunnel with proxy capabilities.
@@ -45,6 +72,22 @@ type Tunnel struct {
 	activeConn     ssh.Conn
 	//proxies
 	proxyCount int
+	//compression algorithms of the other side
+	peerCompression []string
+	//udp framing version agreed with the other side
+	peerUDPFraming int
+	//draining tunnels refuse new streams, see Drain
+	draining bool
+	//open tcp and socks streams, in both directions
+	streams int32
+	//keepalive round trip times of the ssh connection, see Latency
+	latencyMut sync.Mutex
+	latency    LatencyStats
+	//proxies of the bound remotes, see Proxies
+	proxiesMut sync.Mutex
+	proxies    []*Proxy
+	//dns queries in flight, of all dns channels
+	dnsQueued chan struct{}
 	//internals
 	connStats   cnet.ConnCount
 	socksServer *socks5.Server
@@ -54,7 +97,8 @@ type Tunnel struct {
 func New(c Config) *Tunnel {
 	c.Logger = c.Logger.Fork("tun")
 	t := &Tunnel{
-		Config: c,
+		Config:    c,
+		dnsQueued: make(chan struct{}, dnsQueries()),
 	}
 	t.activatingConn.Add(1)
 	//setup socks server (not listening on any port!)
@@ -64,20 +108,49 @@ func New(c Config) *Tunnel {
 		if t.Logger.Debug {
 			sl = log.New(os.Stdout, "[socks]", log.Ldate|log.Ltime)
 		}
-		t.socksServer, _ = socks5.New(&socks5.Config{Logger: sl})
+		sc := &socks5.Config{Logger: sl}
+		if c.AllowDest != nil {
+			sc.Rules = socksRules{allow: c.AllowDest}
+		}
+		if c.Dialer != nil {
+			sc.Dial = socksDial(c.Dialer)
+			sc.Rewriter = socksRewriter{}
+		}
+		if c.Resolver != nil {
+			sc.Resolver = socksResolver{r: c.Resolver}
+		}
+		t.socksServer, _ = socks5.New(sc)
 		extra += " (SOCKS enabled)"
 	}
+	if c.Dialer != nil {
+		extra += " (outbound " + c.Dialer.String() + ")"
+	}
+	if c.Resolver != nil {
+		extra += " (resolver " + c.Resolver.String() + ")"
+	}
 	t.Debugf("Created%s", extra)
 	return t
 }
 
 //BindSSH provides an active SSH for use for tunnelling
 func (t *Tunnel) BindSSH(ctx context.Context, c ssh.Conn, reqs <-chan *ssh.Request, chans <-chan ssh.NewChannel) error {
+	//the other side may drain the connection, see Drain
+	drained := make(chan struct{})
+	drainOnce := sync.Once{}
+	drain := func() {
+		drainOnce.Do(func() { close(drained) })
+	}
 	//link ctx to ssh-conn
 	go func() {
 		<-ctx.Done()
-		if c.Close() == nil {
-			t.Debugf("SSH cancelled")
+		select {
+		case <-drained:
+			//left open for its streams to finish,
+			//until the other side closes it
+		default:
+			if c.Close() == nil {
+				t.Debugf("SSH cancelled")
+			}
 		}
 		t.activatingConn.DoneAll()
 	}()
@@ -87,18 +160,35 @@ func (t *Tunnel) BindSSH(ctx context.Context, c ssh.Conn, reqs <-chan *ssh.Reque
 		panic("double bind ssh")
 	}
 	t.activeConn = c
+	draining := t.draining
+	t.latencyMut.Lock()
+	t.latency = LatencyStats{}
+	t.latencyMut.Unlock()
 	t.activeConnMut.Unlock()
+	if draining {
+		go c.SendRequest("drain", false, nil)
+	}
 	t.activatingConn.Done()
 	//optional keepalive loop against this connection
 	if t.Config.KeepAlive > 0 {
 		go t.keepAliveLoop(c)
 	}
 	//block until closed
-	go t.handleSSHRequests(reqs)
+	go t.handleSSHRequests(reqs, drain)
 	go t.handleSSHChannels(chans)
 	t.Debugf("SSH connected")
-	err := c.Wait()
-	t.Debugf("SSH disconnected")
+	waited := make(chan error, 1)
+	go func() {
+		waited <- c.Wait()
+	}()
+	var err error
+	select {
+	case err = <-waited:
+		t.Debugf("SSH disconnected (latency %s)", t.Latency())
+	case <-drained:
+		err = ErrDrained
+		t.Debugf("SSH drained")
+	}
 	//mark inactive and block
 	t.activatingConn.Add(1)
 	t.activeConnMut.Lock()
@@ -107,6 +197,65 @@ func (t *Tunnel) BindSSH(ctx context.Context, c ssh.Conn, reqs <-chan *ssh.Reque
 	return err
 }
 
+//ErrDrained is returned by BindSSH when the other side drains the
+//connection, which stays open until the streams on it finish
+var ErrDrained = errors.New("connection drained")
+
+//Drain refuses new streams in both directions, and asks the other
+//side to reconnect, while the open streams continue (see Streams)
+func (t *Tunnel) Drain() {
+	t.activeConnMut.Lock()
+	t.draining = true
+	c := t.activeConn
+	t.activeConnMut.Unlock()
+	if c != nil {
+		c.SendRequest("drain", false, nil)
+	}
+}
+
+//Streams returns the number of open tcp and socks streams. Udp and
+//dns channels are not streams, since they are always open.
+func (t *Tunnel) Streams() int {
+	return int(atomic.LoadInt32(&t.streams))
+}
+
+func (t *Tunnel) countStream(delta int32) {
+	atomic.AddInt32(&t.streams, delta)
+}
+
+//SetPeerCompression sets the channel compression algorithms which the
+//other side of the next ssh connection supports, see Remote.Compress
+func (t *Tunnel) SetPeerCompression(algs []string) {
+	t.activeConnMut.Lock()
+	t.peerCompression = algs
+	t.activeConnMut.Unlock()
+}
+
+//compression returns alg, if both sides support it
+func (t *Tunnel) compression(alg string) string {
+	t.activeConnMut.RLock()
+	defer t.activeConnMut.RUnlock()
+	if contains(cnet.Compressions, alg) && contains(t.peerCompression, alg) {
+		return alg
+	}
+	return ""
+}
+
+//SetPeerUDPFraming sets the latest udp framing version which the
+//other side of the next ssh connection supports, zero for gob
+func (t *Tunnel) SetPeerUDPFraming(version int) {
+	t.activeConnMut.Lock()
+	t.peerUDPFraming = min(version, MaxUDPFraming())
+	t.activeConnMut.Unlock()
+}
+
+//udpFraming returns the udp framing version both sides support
+func (t *Tunnel) udpFraming() int {
+	t.activeConnMut.RLock()
+	defer t.activeConnMut.RUnlock()
+	return t.peerUDPFraming
+}
+
 //getSSH blocks while connecting
 func (t *Tunnel) getSSH(ctx context.Context) ssh.Conn {
 	//cancelled already?
@@ -115,7 +264,11 @@ func (t *Tunnel) getSSH(ctx context.Context) ssh.Conn {
 	}
 	t.activeConnMut.RLock()
 	c := t.activeConn
+	draining := t.draining
 	t.activeConnMut.RUnlock()
+	if draining {
+		return nil
+	}
 	//connected already?
 	if c != nil {
 		return c
@@ -156,17 +309,29 @@ func (t *Tunnel) BindRemotes(ctx context.Context, remotes []*settings.Remote) er
 	for i, remote := range remotes {
 		p, err := NewProxy(t.Logger, t, t.proxyCount, remote)
 		if err != nil {
+			t.emit(Event{Type: EventRemoteFailed, Remote: remote.String(), Err: err})
 			return err
 		}
+		if p.dns != nil {
+			p.dns.domains = t.Config.DNSDomains
+		}
 		proxies[i] = p
 		t.proxyCount++
 	}
+	t.proxiesMut.Lock()
+	t.proxies = append(t.proxies, proxies...)
+	t.proxiesMut.Unlock()
 	//TODO: handle tunnel close
 	eg, ctx := errgroup.WithContext(ctx)
 	for _, proxy := range proxies {
 		p := proxy
+		t.emit(Event{Type: EventRemoteBound, Remote: p.remote.String()})
 		eg.Go(func() error {
-			return p.Run(ctx)
+			err := p.Run(ctx)
+			if err != nil {
+				t.emit(Event{Type: EventRemoteFailed, Remote: p.remote.String(), Err: err})
+			}
+			return err
 		})
 	}
 	t.Debugf("Bound proxies")
@@ -175,19 +340,89 @@ func (t *Tunnel) BindRemotes(ctx context.Context, remotes []*settings.Remote) er
 	return err
 }
 
+//Proxies returns the status of the proxies of the bound remotes
+func (t *Tunnel) Proxies() []ProxyStatus {
+	t.proxiesMut.Lock()
+	defer t.proxiesMut.Unlock()
+	statuses := make([]ProxyStatus, len(t.proxies))
+	for i, p := range t.proxies {
+		statuses[i] = p.Status()
+	}
+	return statuses
+}
+
+//Latency returns the round trip times of the keepalive
+//pings on the current (or last) ssh connection
+func (t *Tunnel) Latency() LatencyStats {
+	t.latencyMut.Lock()
+	defer t.latencyMut.Unlock()
+	return t.latency
+}
+
 func (t *Tunnel) keepAliveLoop(sshConn ssh.Conn) {
+	//consecutive pings above the max latency
+	above := 0
+	maxAbove := settings.EnvInt("MAX_LATENCY_PINGS", 3)
 	//ping forever
 	for {
 		time.Sleep(t.Config.KeepAlive)
-		_, b, err := sshConn.SendRequest("ping", true, nil)
+		rtt, err := t.ping(sshConn)
 		if err != nil {
 			break
 		}
-		if len(b) > 0 && !bytes.Equal(b, []byte("pong")) {
-			t.Debugf("strange ping response")
+		//drained connections may outlive their successor
+		t.activeConnMut.RLock()
+		active := t.activeConn == sshConn
+		t.activeConnMut.RUnlock()
+		if active {
+			t.latencyMut.Lock()
+			t.latency.add(rtt)
+			t.latencyMut.Unlock()
+		}
+		t.Debugf("Ping %s", round(rtt))
+		if t.Config.MaxLatency > 0 && rtt > t.Config.MaxLatency {
+			above++
+		} else {
+			above = 0
+		}
+		if above >= maxAbove {
+			t.Infof("Latency above %s for %d pings, closing connection", t.Config.MaxLatency, above)
 			break
 		}
 	}
 	//close ssh connection on abnormal ping
 	sshConn.Close()
 }
+
+//ping sends a keepalive ping and returns its round trip time. Each
+//KeepAliveTimeout without a reply is a miss, and more than
+//KeepAliveMisses in a row fail the ping. Pings are sent one at a
+//time by the ssh connection, so a miss does not send another.
+func (t *Tunnel) ping(sshConn ssh.Conn) (time.Duration, error) {
+	t0 := time.Now()
+	replied := make(chan error, 1)
+	go func() {
+		_, b, err := sshConn.SendRequest("ping", true, nil)
+		if err == nil && len(b) > 0 && !bytes.Equal(b, []byte("pong")) {
+			t.Debugf("strange ping response")
+			err = errors.New("strange ping response")
+		}
+		replied <- err
+	}()
+	var timeout <-chan time.Time
+	for misses := 0; ; misses++ {
+		if t.Config.KeepAliveTimeout > 0 {
+			timeout = time.After(t.Config.KeepAliveTimeout)
+		}
+		select {
+		case err := <-replied:
+			return time.Since(t0), err
+		case <-timeout:
+		}
+		if misses >= t.Config.KeepAliveMisses {
+			t.Infof("Missed %d pings, closing connection", misses+1)
+			return 0, fmt.Errorf("%d pings missed", misses+1)
+		}
+		t.Debugf("Ping missed (%d/%d)", misses+1, t.Config.KeepAliveMisses)
+	}
+}
@@ -5,8 +5,10 @@ import (
 	"io"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/jpillora/chisel/share/cio"
+	"github.com/jpillora/chisel/share/cnet"
 	"github.com/jpillora/chisel/share/settings"
 	"github.com/jpillora/sizestr"
 	"golang.org/x/crypto/ssh"
@@ -15,6 +17,10 @@ import (
 //sshTunnel exposes a subset of Tunnel to subtypes
 type sshTunnel interface {
 	getSSH(ctx context.Context) ssh.Conn
+	compression(alg string) string
+	udpFraming() int
+	countStream(delta int32)
+	emit(e Event)
 }
 
 //Proxy is the inbound portion of a Tunnel
@@ -27,7 +33,19 @@ type Proxy struct {
 	dialer net.Dialer
 	tcp    *net.TCPListener
 	udp    *udpListener
+	dns    *dnsListener
+	tproxy *transparentUDP
 	mu     sync.Mutex
+	//running while Run is active
+	running bool
+}
+
+//ProxyStatus describes a Proxy, see Tunnel.Proxies
+type ProxyStatus struct {
+	Remote    string `json:"remote"`
+	Listening bool   `json:"listening"`
+	//Connections is the number of accepted tcp connections
+	Connections int `json:"connections"`
 }
 
 //NewProxy creates a Proxy
@@ -45,6 +63,26 @@ func NewProxy(logger *cio.Logger, sshTun sshTunnel, index int, remote *settings.
 func (p *Proxy) listen() error {
 	if p.remote.Stdio {
 		//TODO check if pipes active?
+	} else if p.remote.DNS {
+		l, err := listenDNS(p.Logger, p.sshTun, p.remote)
+		if err != nil {
+			return err
+		}
+		p.Infof("Listening")
+		p.dns = l
+	} else if p.remote.Transparent {
+		l, err := cnet.ListenTransparentTCP(p.remote.Local())
+		if err != nil {
+			return p.Errorf("tcp: %s", err)
+		}
+		p.tcp = l
+		u, err := listenTransparentUDP(p.Logger, p.sshTun, p.remote)
+		if err != nil {
+			//tproxy needs CAP_NET_ADMIN, tcp redirects still work
+			p.Infof("UDP disabled: %s", err)
+		}
+		p.Infof("Listening")
+		p.tproxy = u
 	} else if p.remote.LocalProto == "tcp" {
 		addr, err := net.ResolveTCPAddr("tcp", p.remote.LocalHost+":"+p.remote.LocalPort)
 		if err != nil {
@@ -69,11 +107,34 @@ func (p *Proxy) listen() error {
 	return nil
 }
 
+//Status returns the current status of the proxy
+func (p *Proxy) Status() ProxyStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return ProxyStatus{
+		Remote:      p.remote.String(),
+		Listening:   p.running,
+		Connections: p.count,
+	}
+}
+
+func (p *Proxy) setRunning(running bool) {
+	p.mu.Lock()
+	p.running = running
+	p.mu.Unlock()
+}
+
 //Run enables the proxy and blocks while its active,
 //close the proxy by cancelling the context.
 func (p *Proxy) Run(ctx context.Context) error {
+	p.setRunning(true)
+	defer p.setRunning(false)
 	if p.remote.Stdio {
 		return p.runStdio(ctx)
+	} else if p.remote.DNS {
+		return p.dns.run(ctx)
+	} else if p.remote.Transparent {
+		return p.runTransparent(ctx)
 	} else if p.remote.LocalProto == "tcp" {
 		return p.runTCP(ctx)
 	} else if p.remote.LocalProto == "udp" {
@@ -132,19 +193,63 @@ func (p *Proxy) pipeRemote(ctx context.Context, src io.ReadWriteCloser) {
 
 	l := p.Fork("conn#%d", cid)
 	l.Debugf("Open")
+	remote := p.remote.Remote()
+	if p.remote.Transparent {
+		addr, err := p.originalDst(src)
+		if err != nil {
+			l.Infof("%s", err)
+			return
+		}
+		l.Debugf("Original destination %s", addr)
+		remote = addr
+	}
 	sshConn := p.sshTun.getSSH(ctx)
 	if sshConn == nil {
 		l.Debugf("No remote connection")
 		return
 	}
+	//optionally compressed, when the other side supports it
+	channel := remote
+	compress := p.sshTun.compression(p.remote.Compress)
+	if compress != "" {
+		channel += "+" + compress
+	}
 	//ssh request for tcp connection for this proxy's remote
-	dst, reqs, err := sshConn.OpenChannel("chisel", []byte(p.remote.Remote()))
+	ch, reqs, err := sshConn.OpenChannel("chisel", []byte(channel))
 	if err != nil {
 		l.Infof("Stream error: %s", err)
 		return
 	}
 	go ssh.DiscardRequests(reqs)
+	dst := io.ReadWriteCloser(ch)
+	if compress != "" {
+		if dst, err = cnet.NewCompressedRWC(ch, compress); err != nil {
+			l.Infof("Stream error: %s", err)
+			ch.Close()
+			return
+		}
+	}
+	p.sshTun.countStream(1)
+	defer p.sshTun.countStream(-1)
+	t0 := time.Now()
+	p.sshTun.emit(Event{Type: EventChannelOpened, Remote: p.remote.String(), Target: remote})
 	//then pipe
 	s, r := cio.Pipe(src, dst)
-	l.Debugf("Close (sent %s received %s)", sizestr.ToString(s), sizestr.ToString(r))
+	l.Debugf("Close (sent %s received %s%s)", sizestr.ToString(s), sizestr.ToString(r), compressionStats(dst))
+	p.sshTun.emit(Event{
+		Type:     EventChannelClosed,
+		Remote:   p.remote.String(),
+		Target:   remote,
+		Sent:     s,
+		Received: r,
+		Duration: time.Since(t0),
+	})
+}
+
+//compressionStats describes the compression of a stream, if any
+func compressionStats(rwc io.ReadWriteCloser) string {
+	if c, ok := rwc.(*cnet.CompressedRWC); ok {
+		return ", " + c.String()
+	}
+	return ""
 }
@@ -0,0 +1,456 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jpillora/chisel/share/cio"
+	"github.com/jpillora/chisel/share/cnet"
+	"github.com/jpillora/chisel/share/settings"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sync/errgroup"
+)
+
+// listenDNS is a DNS server (on both udp and tcp) which forwards
+// queries via the bound ssh connection, to be answered by the
+// nameserver of the far end. Queries are sent as udp packets over
+// a single "dns" channel, where the packet source is a query id.
+// Answers are cached in memory until their TTL expires.
+func listenDNS(l *cio.Logger, sshTun sshTunnel, remote *settings.Remote) (*dnsListener, error) {
+	a, err := net.ResolveUDPAddr("udp", remote.Local())
+	if err != nil {
+		return nil, l.Errorf("resolve: %s", err)
+	}
+	udp, err := net.ListenUDP("udp", a)
+	if err != nil {
+		return nil, l.Errorf("udp: %s", err)
+	}
+	tcp, err := net.Listen("tcp", remote.Local())
+	if err != nil {
+		udp.Close()
+		return nil, l.Errorf("tcp: %s", err)
+	}
+	return &dnsListener{
+		Logger:  l,
+		sshTun:  sshTun,
+		udp:     udp,
+		tcp:     tcp,
+		cache:   newDNSCache(settings.EnvInt("DNS_CACHE_SIZE", 1000)),
+		timeout: settings.EnvDuration("DNS_TIMEOUT", 5*time.Second),
+		queued:  make(chan struct{}, dnsQueries()),
+		pending: map[string]chan []byte{},
+	}, nil
+}
+
+type dnsListener struct {
+	*cio.Logger
+	sshTun sshTunnel
+	udp    *net.UDPConn
+	tcp    net.Listener
+	//domains optionally restricts which names are
+	//forwarded, others are sent to the local nameserver
+	domains    []string
+	cache      *dnsCache
+	timeout    time.Duration
+	channelMut sync.Mutex
+	channel    *udpChannel
+	pendingMut sync.Mutex
+	pending    map[string]chan []byte
+	queries    uint64
+	//queued limits the udp queries in flight
+	queued chan struct{}
+}
+
+func (d *dnsListener) run(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		d.udp.Close()
+		d.tcp.Close()
+	}()
+	eg, gctx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		return d.runUDP(gctx)
+	})
+	eg.Go(func() error {
+		return d.runTCP(gctx)
+	})
+	err := eg.Wait()
+	if isDone(ctx) {
+		err = nil
+	}
+	d.Infof("Closed")
+	return err
+}
+
+func (d *dnsListener) runUDP(ctx context.Context) error {
+	buff := make([]byte, 65535)
+	for {
+		n, addr, err := d.udp.ReadFromUDP(buff)
+		if err != nil {
+			if isDone(ctx) {
+				return nil
+			}
+			return d.Errorf("udp read error: %w", err)
+		}
+		select {
+		case d.queued <- struct{}{}:
+		default:
+			d.Debugf("Dropped query from %s (too many in flight)", addr)
+			continue
+		}
+		msg := append([]byte(nil), buff[:n]...)
+		go func() {
+			defer func() { <-d.queued }()
+			resp, err := d.query(ctx, msg)
+			if err != nil {
+				d.Debugf("Query failed: %s", err)
+				return
+			}
+			d.udp.WriteToUDP(resp, addr)
+		}()
+	}
+}
+
+func (d *dnsListener) runTCP(ctx context.Context) error {
+	for {
+		conn, err := d.tcp.Accept()
+		if err != nil {
+			if isDone(ctx) {
+				return nil
+			}
+			return d.Errorf("tcp accept error: %w", err)
+		}
+		go d.serveTCP(ctx, conn)
+	}
+}
+
+func (d *dnsListener) serveTCP(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	for !isDone(ctx) {
+		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		msg, err := cnet.ReadDNSMessage(conn)
+		if err != nil {
+			return
+		}
+		resp, err := d.query(ctx, msg)
+		if err != nil {
+			d.Debugf("Query failed: %s", err)
+			return
+		}
+		if err := cnet.WriteDNSMessage(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+// query answers the DNS query from the cache,
+// the far end of the tunnel, or the local nameserver
+func (d *dnsListener) query(ctx context.Context, msg []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+	key := name + " " + q.Type.String() + " " + q.Class.String()
+	if resp := d.cache.get(key, msg[:2]); resp != nil {
+		return resp, nil
+	}
+	var resp []byte
+	if d.forwards(name) {
+		resp, err = d.forward(ctx, msg)
+	} else if d.isLocal(cnet.SystemNameserver()) {
+		err = errors.New("the local nameserver is this dns remote")
+	} else {
+		resp, err = (*cnet.Resolver)(nil).Exchange(ctx, msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.cache.put(key, resp)
+	return resp, nil
+}
+
+// isLocal checks if the nameserver address is this dns remote,
+// which listens on every local address when bound to 0.0.0.0 or ::
+func (d *dnsListener) isLocal(nameserver string) bool {
+	host, port, err := net.SplitHostPort(nameserver)
+	if err != nil {
+		return false
+	}
+	la := d.udp.LocalAddr().(*net.UDPAddr)
+	ip := net.ParseIP(host)
+	if ip == nil || port != strconv.Itoa(la.Port) {
+		return false
+	}
+	if !la.IP.IsUnspecified() {
+		return la.IP.Equal(ip)
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwards checks if the name is within the forwarded domains
+func (d *dnsListener) forwards(name string) bool {
+	if len(d.domains) == 0 {
+		return true
+	}
+	for _, domain := range d.domains {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// forward sends the query through the tunnel and waits for the answer
+func (d *dnsListener) forward(ctx context.Context, msg []byte) ([]byte, error) {
+	ch, err := d.getChannel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id := strconv.FormatUint(atomic.AddUint64(&d.queries, 1), 10)
+	reply := make(chan []byte, 1)
+	d.pendingMut.Lock()
+	d.pending[id] = reply
+	d.pendingMut.Unlock()
+	defer func() {
+		d.pendingMut.Lock()
+		delete(d.pending, id)
+		d.pendingMut.Unlock()
+	}()
+	if err := ch.encode(id, msg); err != nil {
+		return nil, err
+	}
+	select {
+	case resp := <-reply:
+		if resp == nil {
+			return nil, errors.New("channel closed")
+		}
+		return resp, nil
+	case <-time.After(d.timeout):
+		return nil, errors.New("timeout")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (d *dnsListener) getChannel(ctx context.Context) (*udpChannel, error) {
+	d.channelMut.Lock()
+	defer d.channelMut.Unlock()
+	if d.channel != nil {
+		return d.channel, nil
+	}
+	sshConn := d.sshTun.getSSH(ctx)
+	if sshConn == nil {
+		return nil, fmt.Errorf("ssh-conn nil")
+	}
+	rwc, reqs, err := sshConn.OpenChannel("chisel", []byte("dns"))
+	if err != nil {
+		return nil, fmt.Errorf("ssh-chan error: %s", err)
+	}
+	go ssh.DiscardRequests(reqs)
+	ch := newUDPChannel(rwc, d.sshTun.udpFraming())
+	d.channel = ch
+	go d.readChannel(ch)
+	d.Debugf("aquired channel")
+	return ch, nil
+}
+
+// readChannel dispatches answers to their pending queries
+func (d *dnsListener) readChannel(ch *udpChannel) {
+	for {
+		p := udpPacket{}
+		if err := ch.decode(&p); err != nil {
+			break
+		}
+		d.pendingMut.Lock()
+		reply, ok := d.pending[p.Src]
+		d.pendingMut.Unlock()
+		if ok {
+			reply <- p.Payload
+		}
+	}
+	d.Debugf("lost channel")
+	ch.c.Close()
+	d.channelMut.Lock()
+	if d.channel == ch {
+		d.channel = nil
+	}
+	d.channelMut.Unlock()
+	//fail queries in flight
+	d.pendingMut.Lock()
+	for _, reply := range d.pending {
+		select {
+		case reply <- nil:
+		default:
+		}
+	}
+	d.pendingMut.Unlock()
+}
+
+// dnsCache holds DNS answers by question
+type dnsCache struct {
+	mut     sync.Mutex
+	max     int
+	entries map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	msg     []byte
+	stored  time.Time
+	expires time.Time
+}
+
+func newDNSCache(max int) *dnsCache {
+	return &dnsCache{max: max, entries: map[string]dnsCacheEntry{}}
+}
+
+// get returns a copy of the cached answer with the id of
+// the current query, its TTLs reduced by the time cached
+func (c *dnsCache) get(key string, id []byte) []byte {
+	c.mut.Lock()
+	e, ok := c.entries[key]
+	if ok && time.Now().After(e.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mut.Unlock()
+	if !ok {
+		return nil
+	}
+	msg, err := dnsAged(e.msg, uint32(time.Since(e.stored)/time.Second))
+	if err != nil {
+		return nil
+	}
+	copy(msg, id)
+	return msg
+}
+
+func (c *dnsCache) put(key string, msg []byte) {
+	ttl, ok := dnsTTL(msg)
+	if !ok || c.max <= 0 {
+		return
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if len(c.entries) >= c.max {
+		now := time.Now()
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	if len(c.entries) >= c.max {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	now := time.Now()
+	c.entries[key] = dnsCacheEntry{
+		msg:     msg,
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// dnsAged returns a copy of the answer with
+// the TTLs of its records reduced by age seconds
+func dnsAged(msg []byte, age uint32) ([]byte, error) {
+	if age == 0 {
+		return append([]byte(nil), msg...), nil
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil {
+		return nil, err
+	}
+	for _, rrs := range [][]dnsmessage.Resource{m.Answers, m.Authorities, m.Additionals} {
+		for i := range rrs {
+			h := &rrs[i].Header
+			//the ttl of an opt record holds flags
+			if h.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if h.TTL > age {
+				h.TTL -= age
+			} else {
+				h.TTL = 0
+			}
+		}
+	}
+	return m.Pack()
+}
+
+// dnsQueries is the limit of queries in flight, per dns remote
+// and per tunnel answering them, beyond which udp queries are dropped
+func dnsQueries() int {
+	return settings.EnvInt("DNS_QUERIES", 256)
+}
+
+// dnsTTL returns the lowest TTL of the records in a cacheable
+// answer, which includes negative answers with an SOA record
+func dnsTTL(msg []byte) (uint32, bool) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil || h.Truncated {
+		return 0, false
+	}
+	if h.RCode != dnsmessage.RCodeSuccess && h.RCode != dnsmessage.RCodeNameError {
+		return 0, false
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return 0, false
+	}
+	ttl, found := uint32(0), false
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		} else if err != nil {
+			return 0, false
+		}
+		if !found || rh.TTL < ttl {
+			ttl, found = rh.TTL, true
+		}
+		if err := p.SkipAnswer(); err != nil {
+			return 0, false
+		}
+	}
+	for {
+		rh, err := p.AuthorityHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		} else if err != nil {
+			return 0, false
+		}
+		if !found || rh.TTL < ttl {
+			ttl, found = rh.TTL, true
+		}
+		if err := p.SkipAuthority(); err != nil {
+			return 0, false
+		}
+	}
+	return ttl, found && ttl > 0
+}
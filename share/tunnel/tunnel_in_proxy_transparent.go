@@ -0,0 +1,249 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jpillora/chisel/share/cio"
+	"github.com/jpillora/chisel/share/cnet"
+	"github.com/jpillora/chisel/share/settings"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sync/errgroup"
+)
+
+// runTransparent accepts connections and packets redirected
+// by iptables, and tunnels each to its original destination
+func (p *Proxy) runTransparent(ctx context.Context) error {
+	if p.tproxy == nil {
+		return p.runTCP(ctx)
+	}
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		return p.runTCP(ctx)
+	})
+	eg.Go(func() error {
+		return p.tproxy.run(ctx)
+	})
+	return eg.Wait()
+}
+
+// originalDst returns the destination a redirected
+// connection was addressed to before redirection
+func (p *Proxy) originalDst(src io.ReadWriteCloser) (string, error) {
+	conn, ok := src.(net.Conn)
+	if !ok {
+		return "", fmt.Errorf("not a network connection")
+	}
+	addr, err := cnet.OriginalDst(conn)
+	if err != nil {
+		return "", fmt.Errorf("original destination: %s", err)
+	}
+	//connected directly, rather than redirected (TPROXY
+	//connections keep their non-local destination address)
+	if addr.String() == conn.LocalAddr().String() && isLocalIP(addr.IP) {
+		return "", fmt.Errorf("connection to %s was not redirected", addr)
+	}
+	return addr.String(), nil
+}
+
+// isLocalIP checks if the IP is assigned to this host
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return true
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// listenTransparentUDP listens for packets redirected by TPROXY.
+// Each source and original destination pair is a flow with its
+// own "<dst>/udp" channel, and replies are sent from a socket
+// bound to the original destination, so the client sees them as
+// coming from where it sent its packets. Idle flows are closed.
+func listenTransparentUDP(l *cio.Logger, sshTun sshTunnel, remote *settings.Remote) (*transparentUDP, error) {
+	conn, err := cnet.ListenTransparentUDP(remote.Local())
+	if err != nil {
+		return nil, err
+	}
+	return &transparentUDP{
+		Logger:  l,
+		sshTun:  sshTun,
+		inbound: conn,
+		flows:   map[string]*transparentFlow{},
+		maxMTU:  settings.EnvInt("UDP_MAX_SIZE", 9012),
+		idle:    settings.EnvDuration("UDP_DEADLINE", 15*time.Second),
+		queue:   max(settings.EnvInt("UDP_QUEUE", 1024), 1),
+	}, nil
+}
+
+type transparentUDP struct {
+	*cio.Logger
+	sshTun  sshTunnel
+	inbound *net.UDPConn
+	mut     sync.Mutex
+	flows   map[string]*transparentFlow
+	maxMTU  int
+	idle    time.Duration
+	queue   int
+}
+
+type transparentFlow struct {
+	queue chan []byte
+	done  chan struct{}
+	once  sync.Once
+	last  int64
+}
+
+func (f *transparentFlow) touch() {
+	atomic.StoreInt64(&f.last, time.Now().UnixNano())
+}
+
+func (f *transparentFlow) close() {
+	f.once.Do(func() { close(f.done) })
+}
+
+func (u *transparentUDP) run(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		u.inbound.Close()
+	}()
+	go u.expire(ctx)
+	buff := make([]byte, u.maxMTU)
+	for {
+		n, src, dst, err := cnet.ReadTransparentUDP(u.inbound, buff)
+		if err != nil {
+			if isDone(ctx) {
+				return nil
+			}
+			return u.Errorf("read error: %w", err)
+		}
+		//sent directly, rather than redirected
+		if dst.Port == u.inbound.LocalAddr().(*net.UDPAddr).Port && isLocalIP(dst.IP) {
+			u.Debugf("Dropped packet to %s: not redirected", dst)
+			continue
+		}
+		//queued for the flow, which opens its channel without
+		//blocking the packets of the other flows
+		f := u.getFlow(ctx, src, dst)
+		select {
+		case f.queue <- append([]byte(nil), buff[:n]...):
+		default:
+			u.Debugf("Dropped packet to %s: queue full", dst)
+		}
+	}
+}
+
+func (u *transparentUDP) getFlow(ctx context.Context, src, dst *net.UDPAddr) *transparentFlow {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	key := src.String() + ">" + dst.String()
+	if f, ok := u.flows[key]; ok {
+		select {
+		case <-f.done:
+		default:
+			f.touch()
+			return f
+		}
+	}
+	f := &transparentFlow{
+		queue: make(chan []byte, u.queue),
+		done:  make(chan struct{}),
+	}
+	f.touch()
+	u.flows[key] = f
+	go u.runFlow(ctx, key, f, src, dst)
+	return f
+}
+
+// runFlow opens the channel of the flow, sends its queued packets
+// and writes replies back to the client, until the flow closes
+func (u *transparentUDP) runFlow(ctx context.Context, key string, f *transparentFlow, src, dst *net.UDPAddr) {
+	defer func() {
+		f.close()
+		u.mut.Lock()
+		if u.flows[key] == f {
+			delete(u.flows, key)
+		}
+		u.mut.Unlock()
+	}()
+	sshConn := u.sshTun.getSSH(ctx)
+	if sshConn == nil {
+		u.Debugf("Dropped flow %s: ssh-conn nil", key)
+		return
+	}
+	reply, err := cnet.DialTransparentUDP(dst, src)
+	if err != nil {
+		u.Debugf("Dropped flow %s: %s", key, err)
+		return
+	}
+	defer reply.Close()
+	rwc, reqs, err := sshConn.OpenChannel("chisel", []byte(dst.String()+"/udp"))
+	if err != nil {
+		u.Debugf("Dropped flow %s: ssh-chan error: %s", key, err)
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	ch := newUDPChannel(rwc, u.sshTun.udpFraming())
+	u.Debugf("Open flow %s", key)
+	go func() {
+		defer rwc.Close()
+		for {
+			select {
+			case b := <-f.queue:
+				if err := ch.encode(src.String(), b); err != nil {
+					return
+				}
+			case <-f.done:
+				return
+			}
+		}
+	}()
+	for {
+		p := udpPacket{}
+		if err := ch.decode(&p); err != nil {
+			break
+		}
+		f.touch()
+		reply.Write(p.Payload)
+	}
+	u.Debugf("Close flow %s", key)
+}
+
+// expire closes flows which have been idle too long
+func (u *transparentUDP) expire(ctx context.Context) {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			u.mut.Lock()
+			for _, f := range u.flows {
+				f.close()
+			}
+			u.mut.Unlock()
+			return
+		case <-t.C:
+		}
+		cutoff := time.Now().Add(-u.idle).UnixNano()
+		u.mut.Lock()
+		for _, f := range u.flows {
+			if atomic.LoadInt64(&f.last) < cutoff {
+				f.close()
+			}
+		}
+		u.mut.Unlock()
+	}
+}
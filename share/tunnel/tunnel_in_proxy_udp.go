@@ -2,8 +2,8 @@ package tunnel
 
 import (
 	"context"
-	"encoding/gob"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"net"
 	"strings"
@@ -47,19 +47,36 @@ func listenUDP(l *cio.Logger, sshTun sshTunnel, remote *settings.Remote) (*udpLi
 		inbound: conn,
 		maxMTU:  settings.EnvInt("UDP_MAX_SIZE", 9012),
 	}
-	u.Debugf("UDP max size: %d bytes", u.maxMTU)
+	//sources are sharded across channels, each with its
+	//own queue, so one slow channel doesn't stall the others
+	channels := max(settings.EnvInt("UDP_CHANNELS", 4), 1)
+	queue := max(settings.EnvInt("UDP_QUEUE", 1024), 1)
+	for i := 0; i < channels; i++ {
+		u.shards = append(u.shards, &udpShard{
+			udpListener: u,
+			queue:       make(chan udpPacket, queue),
+		})
+	}
+	u.Debugf("UDP max size: %d bytes, %d channels", u.maxMTU, channels)
 	return u, nil
 }
 
 type udpListener struct {
 	*cio.Logger
-	sshTun      sshTunnel
-	remote      *settings.Remote
-	inbound     *net.UDPConn
+	sshTun              sshTunnel
+	remote              *settings.Remote
+	inbound             *net.UDPConn
+	shards              []*udpShard
+	sent, recv, dropped int64
+	maxMTU              int
+}
+
+//udpShard is the channel of the sources which hash to it
+type udpShard struct {
+	*udpListener
+	queue       chan udpPacket
 	outboundMut sync.Mutex
 	outbound    *udpChannel
-	sent, recv  int64
-	maxMTU      int
 }
 
 func (u *udpListener) run(ctx context.Context) error {
@@ -71,17 +88,24 @@ func (u *udpListener) run(ctx context.Context) error {
 	eg.Go(func() error {
 		return u.runInbound(ctx)
 	})
-	eg.Go(func() error {
-		return u.runOutbound(ctx)
-	})
+	for _, s := range u.shards {
+		eg.Go(func() error {
+			return s.runSend(ctx)
+		})
+		eg.Go(func() error {
+			return s.runOutbound(ctx)
+		})
+	}
 	if err := eg.Wait(); err != nil {
 		u.Debugf("listen: %s", err)
 		return err
 	}
-	u.Debugf("Close (sent %s received %s)", sizestr.ToString(u.sent), sizestr.ToString(u.recv))
+	u.Debugf("Close (sent %s received %s dropped %d packets)", sizestr.ToString(u.sent), sizestr.ToString(u.recv), u.dropped)
 	return nil
 }
 
+//runInbound queues each packet for the shard of its source,
+//dropping packets instead of waiting when the queue is full
 func (u *udpListener) runInbound(ctx context.Context) error {
 	buff := make([]byte, u.maxMTU)
 	for !isDone(ctx) {
@@ -94,37 +118,61 @@ func (u *udpListener) runInbound(ctx context.Context) error {
 		if err != nil {
 			return u.Errorf("read error: %w", err)
 		}
+		src := addr.String()
+		h := fnv.New32a()
+		h.Write([]byte(src))
+		s := u.shards[h.Sum32()%uint32(len(u.shards))]
+		p := udpPacket{Src: src, Payload: append([]byte(nil), buff[:n]...)}
+		select {
+		case s.queue <- p:
+		default:
+			if atomic.AddInt64(&u.dropped, 1)%1000 == 1 {
+				u.Debugf("queue full, dropped %d packets", atomic.LoadInt64(&u.dropped))
+			}
+			atomic.AddInt64(&udpFlowStats.dropped, 1)
+		}
+	}
+	return nil
+}
+
+//runSend sends the queued packets over the shard's channel
+func (s *udpShard) runSend(ctx context.Context) error {
+	for {
+		var p udpPacket
+		select {
+		case p = <-s.queue:
+		case <-ctx.Done():
+			return nil
+		}
 		//upsert ssh channel
-		uc, err := u.getUDPChan(ctx)
+		uc, err := s.getUDPChan(ctx)
 		if err != nil {
 			if strings.HasSuffix(err.Error(), "EOF") {
 				continue
 			}
-			return u.Errorf("inbound-udpchan: %w", err)
+			return s.Errorf("inbound-udpchan: %w", err)
 		}
 		//send over channel, including source address
-		b := buff[:n]
-		if err := uc.encode(addr.String(), b); err != nil {
+		if err := uc.encode(p.Src, p.Payload); err != nil {
 			if strings.HasSuffix(err.Error(), "EOF") {
 				continue //dropped packet...
 			}
-			return u.Errorf("encode error: %w", err)
+			return s.Errorf("encode error: %w", err)
 		}
 		//stats
-		atomic.AddInt64(&u.sent, int64(n))
+		atomic.AddInt64(&s.sent, int64(len(p.Payload)))
 	}
-	return nil
 }
 
-func (u *udpListener) runOutbound(ctx context.Context) error {
+func (s *udpShard) runOutbound(ctx context.Context) error {
 	for !isDone(ctx) {
 		//upsert ssh channel
-		uc, err := u.getUDPChan(ctx)
+		uc, err := s.getUDPChan(ctx)
 		if err != nil {
 			if strings.HasSuffix(err.Error(), "EOF") {
 				continue
 			}
-			return u.Errorf("outbound-udpchan: %w", err)
+			return s.Errorf("outbound-udpchan: %w", err)
 		}
 		//receive from channel, including source address
 		p := udpPacket{}
@@ -132,60 +180,56 @@ func (u *udpListener) runOutbound(ctx context.Context) error {
 			//outbound ssh disconnected, get new connection...
 			continue
 		} else if err != nil {
-			return u.Errorf("decode error: %w", err)
+			return s.Errorf("decode error: %w", err)
 		}
 		//write back to inbound udp
 		addr, err := net.ResolveUDPAddr("udp", p.Src)
 		if err != nil {
-			return u.Errorf("resolve error: %w", err)
+			return s.Errorf("resolve error: %w", err)
 		}
-		n, err := u.inbound.WriteToUDP(p.Payload, addr)
+		n, err := s.inbound.WriteToUDP(p.Payload, addr)
 		if err != nil {
-			return u.Errorf("write error: %w", err)
+			return s.Errorf("write error: %w", err)
 		}
 		//stats
-		atomic.AddInt64(&u.recv, int64(n))
+		atomic.AddInt64(&s.recv, int64(n))
 	}
 	return nil
 }
 
-func (u *udpListener) getUDPChan(ctx context.Context) (*udpChannel, error) {
-	u.outboundMut.Lock()
-	defer u.outboundMut.Unlock()
+func (s *udpShard) getUDPChan(ctx context.Context) (*udpChannel, error) {
+	s.outboundMut.Lock()
+	defer s.outboundMut.Unlock()
 	//cached
-	if u.outbound != nil {
-		return u.outbound, nil
+	if s.outbound != nil {
+		return s.outbound, nil
 	}
 	//not cached, bind
-	sshConn := u.sshTun.getSSH(ctx)
+	sshConn := s.sshTun.getSSH(ctx)
 	if sshConn == nil {
 		return nil, fmt.Errorf("ssh-conn nil")
 	}
 	//ssh request for udp packets for this proxy's remote,
 	//just "udp" since the remote address is sent with each packet
-	dstAddr := u.remote.Remote() + "/udp"
+	dstAddr := s.remote.Remote() + "/udp"
 	rwc, reqs, err := sshConn.OpenChannel("chisel", []byte(dstAddr))
 	if err != nil {
 		return nil, fmt.Errorf("ssh-chan error: %s", err)
 	}
 	go ssh.DiscardRequests(reqs)
 	//remove on disconnect
-	go u.unsetUDPChan(sshConn)
+	go s.unsetUDPChan(sshConn)
 	//ready
-	o := &udpChannel{
-		r: gob.NewDecoder(rwc),
-		w: gob.NewEncoder(rwc),
-		c: rwc,
-	}
-	u.outbound = o
-	u.Debugf("aquired channel")
+	o := newUDPChannel(rwc, s.sshTun.udpFraming())
+	s.outbound = o
+	s.Debugf("aquired channel")
 	return o, nil
 }
 
-func (u *udpListener) unsetUDPChan(sshConn ssh.Conn) {
+func (s *udpShard) unsetUDPChan(sshConn ssh.Conn) {
 	sshConn.Wait()
-	u.Debugf("lost channel")
-	u.outboundMut.Lock()
-	u.outbound = nil
-	u.outboundMut.Unlock()
+	s.Debugf("lost channel")
+	s.outboundMut.Lock()
+	s.outbound = nil
+	s.outboundMut.Unlock()
 }
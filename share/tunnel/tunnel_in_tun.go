@@ -0,0 +1,45 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jpillora/chisel/share/cnet"
+	"github.com/jpillora/chisel/share/settings"
+)
+
+// TunConfig configures a TUN interface (Linux only) whose
+// TCP and UDP flows are tunneled to their destinations
+type TunConfig struct {
+	//Name of the interface to create (or attach to)
+	Name string
+	//Routes are the networks routed into the interface
+	Routes []string
+	//MTU of the interface, defaults to 1500
+	MTU int
+}
+
+// BindTun creates the TUN interface and forwards its traffic
+// until the context is cancelled. Packets are reassembled into
+// TCP and UDP flows by a userspace network stack, and each flow
+// is sent to its destination via a regular channel, so the far
+// end applies its usual access controls.
+func (t *Tunnel) BindTun(ctx context.Context, c TunConfig) error {
+	if !t.Inbound {
+		return errors.New("inbound connections blocked")
+	}
+	routes, err := settings.ParseCIDRs(c.Routes)
+	if err != nil {
+		return err
+	}
+	if c.MTU == 0 {
+		c.MTU = 1500
+	}
+	fd, err := cnet.OpenTun(c.Name, c.MTU, routes)
+	if err != nil {
+		return t.Errorf("tun: %s", err)
+	}
+	l := t.Logger.Fork("tun#%s", c.Name)
+	l.Infof("Routing %s", routes.Strings())
+	return t.runTun(ctx, l, fd, c.MTU)
+}
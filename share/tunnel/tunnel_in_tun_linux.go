@@ -0,0 +1,159 @@
+//go:build linux
+
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/jpillora/chisel/share/cio"
+	"github.com/jpillora/chisel/share/settings"
+	"github.com/jpillora/sizestr"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+func (t *Tunnel) runTun(ctx context.Context, l *cio.Logger, fd int, mtu int) error {
+	defer unix.Close(fd)
+	ep, err := fdbased.New(&fdbased.Options{FDs: []int{fd}, MTU: uint32(mtu)})
+	if err != nil {
+		return l.Errorf("link: %s", err)
+	}
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	//destroy removes the nic, stopping the link's readers, which
+	//would otherwise read whichever file reuses the fd once closed
+	defer s.Destroy()
+	//the nic is only enabled once the handlers are set,
+	//since its link delivers packets as soon as it is
+	const nic = 1
+	if err := s.CreateNICWithOptions(nic, ep, stack.NICOptions{Disabled: true}); err != nil {
+		return l.Errorf("nic: %s", err)
+	}
+	//accept packets for any destination, and reply as that destination
+	s.SetPromiscuousMode(nic, true)
+	s.SetSpoofing(nic, true)
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: nic},
+		{Destination: header.IPv6EmptySubnet, NIC: nic},
+	})
+	tcpFwd := tcp.NewForwarder(s, 0, settings.EnvInt("TUN_MAX_CONNECTING", 1024), func(r *tcp.ForwarderRequest) {
+		t.tunTCP(ctx, l, r)
+	})
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpFwd.HandlePacket)
+	udpFwd := udp.NewForwarder(s, func(r *udp.ForwarderRequest) {
+		t.tunUDP(ctx, l, r)
+	})
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpFwd.HandlePacket)
+	if err := s.EnableNIC(nic); err != nil {
+		return l.Errorf("nic: %s", err)
+	}
+	l.Infof("Listening")
+	<-ctx.Done()
+	l.Infof("Closed")
+	return nil
+}
+
+// tunTCP tunnels a TCP connection from the interface, only
+// completing the handshake once the far end accepts the
+// channel, so that denied connections are reset
+func (t *Tunnel) tunTCP(ctx context.Context, l *cio.Logger, r *tcp.ForwarderRequest) {
+	id := r.ID()
+	dst := net.JoinHostPort(id.LocalAddress.String(), strconv.Itoa(int(id.LocalPort)))
+	l = l.Fork("conn#%d", t.connStats.New())
+	ch, err := t.openTunChannel(ctx, dst)
+	if err != nil {
+		l.Debugf("Denied %s: %s", dst, err)
+		r.Complete(true)
+		return
+	}
+	var wq waiter.Queue
+	ep, terr := r.CreateEndpoint(&wq)
+	if terr != nil {
+		r.Complete(true)
+		ch.Close()
+		return
+	}
+	r.Complete(false)
+	conn := gonet.NewTCPConn(&wq, ep)
+	l.Debugf("Open %s", dst)
+	s, rcv := cio.Pipe(conn, ch)
+	l.Debugf("Close (sent %s received %s)", sizestr.ToString(s), sizestr.ToString(rcv))
+}
+
+// tunUDP tunnels a UDP flow (source and destination pair)
+// from the interface, until it has been idle for too long
+func (t *Tunnel) tunUDP(ctx context.Context, l *cio.Logger, r *udp.ForwarderRequest) {
+	id := r.ID()
+	dst := net.JoinHostPort(id.LocalAddress.String(), strconv.Itoa(int(id.LocalPort)))
+	src := net.JoinHostPort(id.RemoteAddress.String(), strconv.Itoa(int(id.RemotePort)))
+	var wq waiter.Queue
+	ep, terr := r.CreateEndpoint(&wq)
+	if terr != nil {
+		l.Debugf("UDP endpoint for %s: %s", dst, terr)
+		return
+	}
+	conn := gonet.NewUDPConn(&wq, ep)
+	go func() {
+		defer conn.Close()
+		ch, err := t.openTunChannel(ctx, dst+"/udp")
+		if err != nil {
+			l.Debugf("Denied %s/udp: %s", dst, err)
+			return
+		}
+		defer ch.Close()
+		uc := newUDPChannel(ch, t.udpFraming())
+		go func() {
+			defer conn.Close()
+			for {
+				p := udpPacket{}
+				if err := uc.decode(&p); err != nil {
+					return
+				}
+				if _, err := conn.Write(p.Payload); err != nil {
+					return
+				}
+			}
+		}()
+		idle := settings.EnvDuration("UDP_DEADLINE", 15*time.Second)
+		buff := make([]byte, settings.EnvInt("UDP_MAX_SIZE", 9012))
+		for {
+			conn.SetReadDeadline(time.Now().Add(idle))
+			n, err := conn.Read(buff)
+			if err != nil {
+				return
+			}
+			if err := uc.encode(src, buff[:n]); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func (t *Tunnel) openTunChannel(ctx context.Context, remote string) (ssh.Channel, error) {
+	sshConn := t.getSSH(ctx)
+	if sshConn == nil {
+		return nil, fmt.Errorf("no remote connection")
+	}
+	ch, reqs, err := sshConn.OpenChannel("chisel", []byte(remote))
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	return ch, nil
+}
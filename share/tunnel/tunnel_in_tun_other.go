@@ -0,0 +1,14 @@
+//go:build !linux
+
+package tunnel
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jpillora/chisel/share/cio"
+)
+
+func (t *Tunnel) runTun(ctx context.Context, l *cio.Logger, fd int, mtu int) error {
+	return errors.New("tun is only supported on linux")
+}
@@ -0,0 +1,92 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/armon/go-socks5"
+	"github.com/jpillora/chisel/share/cnet"
+)
+
+var errDenied = errors.New("access denied")
+
+//resolveDest looks up the host of an outbound destination and returns
+//the first resolved address permitted by the destination ACL. Dialing
+//this exact address (instead of the host name) ensures the checked IP
+//is the one connected to, even if the DNS record changes in between.
+func (t *Tunnel) resolveDest(ctx context.Context, hostPort string) (string, error) {
+	if t.Config.AllowDest == nil && t.Config.Resolver == nil {
+		return hostPort, nil
+	}
+	host, p, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return "", err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return "", err
+	}
+	ips, err := t.Config.Resolver.LookupIP(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if t.Config.AllowDest == nil || t.Config.AllowDest(host, ip, port) {
+			return net.JoinHostPort(ip.String(), p), nil
+		}
+	}
+	return "", errDenied
+}
+
+//socksRules applies the destination ACL to SOCKS requests,
+//which go-socks5 checks after resolving the destination
+type socksRules struct {
+	allow func(host string, ip net.IP, port int) bool
+}
+
+func (r socksRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	dest := req.DestAddr
+	host := dest.FQDN
+	if host == "" {
+		host = dest.IP.String()
+	}
+	return ctx, r.allow(host, dest.IP, dest.Port)
+}
+
+//socksRewriter keeps the requested destination in the
+//context, for socksDial, since go-socks5 dials the resolved IP
+type socksRewriter struct{}
+
+type socksDestKey struct{}
+
+func (socksRewriter) Rewrite(ctx context.Context, req *socks5.Request) (context.Context, *socks5.AddrSpec) {
+	return context.WithValue(ctx, socksDestKey{}, req.DestAddr), req.DestAddr
+}
+
+//socksDial dials SOCKS destinations with the dialer, which
+//sends the requested host name to any upstream proxy
+func socksDial(d *cnet.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dest := addr
+		if a, ok := ctx.Value(socksDestKey{}).(*socks5.AddrSpec); ok && a.FQDN != "" {
+			dest = net.JoinHostPort(a.FQDN, strconv.Itoa(a.Port))
+		}
+		return d.DialResolved(ctx, network, dest, addr)
+	}
+}
+
+//socksResolver resolves SOCKS destinations
+//using the tunnel's resolver
+type socksResolver struct {
+	r *cnet.Resolver
+}
+
+func (s socksResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ips, err := s.r.LookupIP(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, ips[0], nil
+}
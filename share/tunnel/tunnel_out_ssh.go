@@ -1,10 +1,13 @@
 package tunnel
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jpillora/chisel/share/cio"
 	"github.com/jpillora/chisel/share/cnet"
@@ -13,34 +16,57 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-func (t *Tunnel) handleSSHRequests(reqs <-chan *ssh.Request) {
+func (t *Tunnel) handleSSHRequests(reqs <-chan *ssh.Request, drain func()) {
 	for r := range reqs {
 		switch r.Type {
 		case "ping":
 			r.Reply(true, []byte("pong"))
+		case "drain":
+			//the other side is shutting down
+			r.Reply(true, nil)
+			drain()
 		default:
 			t.Debugf("Unknown request: %s", r.Type)
 		}
 	}
 }
 
+// handleSSHChannels handles each channel, until the ssh
+// connection closes, which cancels their resolving
 func (t *Tunnel) handleSSHChannels(chans <-chan ssh.NewChannel) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	for ch := range chans {
-		go t.handleSSHChannel(ch)
+		go t.handleSSHChannel(ctx, ch)
 	}
 }
 
-func (t *Tunnel) handleSSHChannel(ch ssh.NewChannel) {
+func (t *Tunnel) handleSSHChannel(ctx context.Context, ch ssh.NewChannel) {
 	if !t.Config.Outbound {
 		t.Debugf("Denied outbound connection")
 		ch.Reject(ssh.Prohibited, "Denied outbound connection")
 		return
 	}
+	t.activeConnMut.RLock()
+	draining := t.draining
+	t.activeConnMut.RUnlock()
+	if draining {
+		t.Debugf("Denied outbound connection (draining)")
+		ch.Reject(ssh.ResourceShortage, "draining")
+		return
+	}
 	remote := string(ch.ExtraData())
-	//extract protocol
+	//extract compression and protocol
+	remote, compress := settings.Compression(remote)
+	if compress != "" && !contains(cnet.Compressions, compress) {
+		t.Debugf("Denied unknown compression: %s", compress)
+		ch.Reject(ssh.UnknownChannelType, "unknown compression")
+		return
+	}
 	hostPort, proto := settings.L4Proto(remote)
 	udp := proto == "udp"
 	socks := hostPort == "socks"
+	dns := hostPort == "dns"
 	if socks && t.socksServer == nil {
 		t.Debugf("Denied socks request, please enable socks")
 		ch.Reject(ssh.Prohibited, "SOCKS5 is not enabled")
@@ -52,6 +78,36 @@ func (t *Tunnel) handleSSHChannel(ch ssh.NewChannel) {
 		ch.Reject(ssh.Prohibited, "access denied")
 		return
 	}
+	//dns channels query the exit resolver, so its
+	//nameserver must be an allowed destination
+	if dns && t.Config.AllowDest != nil {
+		host, ip, port := t.Config.Resolver.Nameserver()
+		if !t.Config.AllowDest(host, ip, port) {
+			t.Debugf("Denied DNS queries to %s (ACL)", net.JoinHostPort(host, strconv.Itoa(port)))
+			ch.Reject(ssh.Prohibited, "access denied")
+			return
+		}
+	}
+	//resolve and check the destination before accepting
+	dest := hostPort
+	if !socks && !dns {
+		rctx, cancel := context.WithTimeout(ctx, settings.EnvDuration("RESOLVE_TIMEOUT", 10*time.Second))
+		addr, err := t.resolveDest(rctx, hostPort)
+		cancel()
+		if err == errDenied {
+			t.Debugf("Denied connection to %s (ACL)", hostPort)
+			ch.Reject(ssh.Prohibited, "access denied")
+			return
+		} else if err != nil {
+			t.Debugf("Failed to resolve %s: %s", hostPort, err)
+			ch.Reject(ssh.ConnectionFailed, err.Error())
+			return
+		}
+		if addr != hostPort {
+			t.Debugf("Resolved %s to %s", hostPort, addr)
+		}
+		hostPort = addr
+	}
 	sshChan, reqs, err := ch.Accept()
 	if err != nil {
 		t.Debugf("Failed to accept stream: %s", err)
@@ -59,18 +115,42 @@ func (t *Tunnel) handleSSHChannel(ch ssh.NewChannel) {
 	}
 	stream := io.ReadWriteCloser(sshChan)
 	//cnet.MeterRWC(t.Logger.Fork("sshchan"), sshChan)
+	if compress != "" {
+		if stream, err = cnet.NewCompressedRWC(sshChan, compress); err != nil {
+			t.Debugf("Failed to compress stream: %s", err)
+			sshChan.Close()
+			return
+		}
+	}
 	defer stream.Close()
 	go ssh.DiscardRequests(reqs)
 	l := t.Logger.Fork("conn#%d", t.connStats.New())
 	//ready to handle
 	t.connStats.Open()
 	l.Debugf("Open %s", t.connStats.String())
+	target := hostPort
+	if socks {
+		target = "socks"
+	} else if dns {
+		target = "dns"
+	} else if udp {
+		target += "/udp"
+	}
+	t0 := time.Now()
+	t.emit(Event{Type: EventChannelOpened, Target: target, Outbound: true})
+	if !udp && !dns {
+		t.countStream(1)
+		defer t.countStream(-1)
+	}
+	var sent, received int64
 	if socks {
 		err = t.handleSocks(stream)
+	} else if dns {
+		err = t.handleDNS(l, stream)
 	} else if udp {
 		err = t.handleUDP(l, stream, hostPort)
 	} else {
-		err = t.handleTCP(l, stream, hostPort)
+		sent, received, err = t.handleTCP(l, stream, dest, hostPort)
 	}
 	t.connStats.Close()
 	errmsg := ""
@@ -78,18 +158,37 @@ func (t *Tunnel) handleSSHChannel(ch ssh.NewChannel) {
 		errmsg = fmt.Sprintf(" (error %s)", err)
 	}
 	l.Debugf("Close %s%s", t.connStats.String(), errmsg)
+	t.emit(Event{
+		Type:     EventChannelClosed,
+		Target:   target,
+		Outbound: true,
+		Sent:     sent,
+		Received: received,
+		Duration: time.Since(t0),
+		Err:      err,
+	})
 }
 
 func (t *Tunnel) handleSocks(src io.ReadWriteCloser) error {
 	return t.socksServer.ServeConn(cnet.NewRWCConn(src))
 }
 
-func (t *Tunnel) handleTCP(l *cio.Logger, src io.ReadWriteCloser, hostPort string) error {
-	dst, err := net.Dial("tcp", hostPort)
+// handleTCP connects to dest, as resolved to addr
+func (t *Tunnel) handleTCP(l *cio.Logger, src io.ReadWriteCloser, dest, addr string) (int64, int64, error) {
+	dst, err := t.Config.Dialer.DialResolved(context.Background(), "tcp", dest, addr)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 	s, r := cio.Pipe(src, dst)
-	l.Debugf("sent %s received %s", sizestr.ToString(s), sizestr.ToString(r))
-	return nil
+	l.Debugf("sent %s received %s%s", sizestr.ToString(s), sizestr.ToString(r), compressionStats(src))
+	return s, r, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
 }
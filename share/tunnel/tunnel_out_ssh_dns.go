@@ -0,0 +1,38 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/jpillora/chisel/share/cio"
+)
+
+// handleDNS answers the queries of a dns remote, sending
+// them to the nameserver of the tunnel's resolver
+func (t *Tunnel) handleDNS(l *cio.Logger, rwc io.ReadWriteCloser) error {
+	ch := newUDPChannel(rwc, t.udpFraming())
+	for {
+		p := udpPacket{}
+		if err := ch.decode(&p); err != nil {
+			return err
+		}
+		select {
+		case t.dnsQueued <- struct{}{}:
+		default:
+			l.Debugf("Dropped DNS query (too many in flight)")
+			continue
+		}
+		go func() {
+			defer func() { <-t.dnsQueued }()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			resp, err := t.Config.Resolver.Exchange(ctx, p.Payload)
+			if err != nil {
+				l.Debugf("DNS query failed: %s", err)
+				return
+			}
+			ch.encode(p.Src, resp)
+		}()
+	}
+}
@@ -1,11 +1,7 @@
 package tunnel
 
 import (
-	"encoding/gob"
 	"io"
-	"net"
-	"os"
-	"sync"
 	"time"
 
 	"github.com/jpillora/chisel/share/cio"
@@ -13,23 +9,22 @@ import (
 )
 
 func (t *Tunnel) handleUDP(l *cio.Logger, rwc io.ReadWriteCloser, hostPort string) error {
-	conns := &udpConns{
-		Logger: l,
-		m:      map[string]*udpConn{},
-	}
-	defer conns.closeAll()
 	h := &udpHandler{
-		Logger:   l,
-		hostPort: hostPort,
-		udpChannel: &udpChannel{
-			r: gob.NewDecoder(rwc),
-			w: gob.NewEncoder(rwc),
-			c: rwc,
-		},
-		udpConns: conns,
-		maxMTU:   settings.EnvInt("UDP_MAX_SIZE", 9012),
+		Logger:     l,
+		hostPort:   hostPort,
+		udpChannel: newUDPChannel(rwc, t.udpFraming()),
+	}
+	maxMTU := settings.EnvInt("UDP_MAX_SIZE", 9012)
+	maxFlows := settings.EnvInt("UDP_MAX_FLOWS", 4096)
+	//flows expire when idle in both directions
+	idle := settings.EnvDuration("UDP_IDLE", settings.EnvDuration("UDP_DEADLINE", 15*time.Second))
+	flows, err := newUDPFlows(l, t.Config.Dialer, max(maxFlows, 1), idle, maxMTU, h.encode)
+	if err != nil {
+		return err
 	}
-	h.Debugf("UDP max size: %d bytes", h.maxMTU)
+	defer flows.close()
+	h.udpFlows = flows
+	h.Debugf("UDP max size: %d bytes, framing v%d, max flows %d, idle %s", maxMTU, t.udpFraming(), maxFlows, idle)
 	for {
 		p := udpPacket{}
 		if err := h.handleWrite(&p); err != nil {
@@ -42,114 +37,23 @@ type udpHandler struct {
 	*cio.Logger
 	hostPort string
 	*udpChannel
-	*udpConns
-	maxMTU int
+	*udpFlows
 }
 
 func (h *udpHandler) handleWrite(p *udpPacket) error {
-	if err := h.r.Decode(&p); err != nil {
+	if err := h.decode(p); err != nil {
 		return err
 	}
-	//dial now, we know we must write
-	conn, exists, err := h.udpConns.dial(p.Src, h.hostPort)
+	//dial now, we know we must write, and
+	//the flow's replies are read by the poller
+	flow, err := h.udpFlows.dial(p.Src, h.hostPort)
 	if err != nil {
 		return err
 	}
-	//however, we dont know if we must read...
-	//spawn up to <max-conns> go-routines to wait
-	//for a reply.
-	//TODO configurable
-	//TODO++ dont use go-routines, switch to pollable
-	//  array of listeners where all listeners are
-	//  sweeped periodically, removing the idle ones
-	const maxConns = 100
-	if !exists {
-		if h.udpConns.len() <= maxConns {
-			go h.handleRead(p, conn)
-		} else {
-			h.Debugf("exceeded max udp connections (%d)", maxConns)
-		}
-	}
-	_, err = conn.Write(p.Payload)
-	if err != nil {
-		return err
+	if _, err := flow.Write(p.Payload); err != nil {
+		//only this flow is broken
+		h.Debugf("write error: %s", err)
+		h.udpFlows.drop(flow)
 	}
 	return nil
 }
-
-func (h *udpHandler) handleRead(p *udpPacket, conn *udpConn) {
-	//ensure connection is cleaned up
-	defer h.udpConns.remove(conn.id)
-	buff := make([]byte, h.maxMTU)
-	for {
-		//response must arrive within 15 seconds
-		deadline := settings.EnvDuration("UDP_DEADLINE", 15*time.Second)
-		conn.SetReadDeadline(time.Now().Add(deadline))
-		//read response
-		n, err := conn.Read(buff)
-		if err != nil {
-			if !os.IsTimeout(err) && err != io.EOF {
-				h.Debugf("read error: %s", err)
-			}
-			break
-		}
-		b := buff[:n]
-		//encode back over ssh connection
-		err = h.udpChannel.encode(p.Src, b)
-		if err != nil {
-			h.Debugf("encode error: %s", err)
-			return
-		}
-	}
-}
-
-type udpConns struct {
-	*cio.Logger
-	sync.Mutex
-	m map[string]*udpConn
-}
-
-func (cs *udpConns) dial(id, addr string) (*udpConn, bool, error) {
-	cs.Lock()
-	defer cs.Unlock()
-	conn, ok := cs.m[id]
-	if !ok {
-		c, err := net.Dial("udp", addr)
-		if err != nil {
-			return nil, false, err
-		}
-		conn = &udpConn{
-			id:   id,
-			Conn: c, // cnet.MeterConn(cs.Logger.Fork(addr), c),
-		}
-		cs.m[id] = conn
-	}
-	return conn, ok, nil
-}
-
-func (cs *udpConns) len() int {
-	cs.Lock()
-	l := len(cs.m)
-	cs.Unlock()
-	return l
-}
-
-func (cs *udpConns) remove(id string) {
-	cs.Lock()
-	delete(cs.m, id)
-	cs.Unlock()
-}
-
-func (cs *udpConns) closeAll() {
-	cs.Lock()
-	for id, conn := range cs.m {
-		conn.Close()
-		delete(cs.m, id)
-	}
-	cs.Unlock()
-}
-
-type udpConn struct {
-	id string
-	net.Conn
-}
@@ -0,0 +1,372 @@
+package tunnel
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jpillora/chisel/share/cnet"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/quicvarint"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	//maxQUICHeader limits the type and extra data of a channel
+	maxQUICHeader = 4096
+	//maxQUICPacket limits packets sent on the stream of a
+	//channel, when they are too large for a datagram
+	maxQUICPacket = 1 << 20
+	//quicPacketBuffer is the number of received packets
+	//queued per channel, after which datagrams are dropped
+	quicPacketBuffer = 256
+)
+
+// quicConn is an ssh.Conn over the first stream of a QUIC
+// connection, whose channels are the other streams of the
+// QUIC connection, and whose packets are QUIC datagrams.
+// Requests still use the ssh connection.
+type quicConn struct {
+	ssh.Conn
+	quic    *quic.Conn
+	chans   chan ssh.NewChannel
+	mu      sync.Mutex
+	packets map[quic.StreamID]*quicChannel
+}
+
+// WithQUIC converts the ssh connection over the first stream of a
+// QUIC connection, returning the ssh connection and incoming channels
+// to bind, which then use QUIC streams and datagrams for channels
+func WithQUIC(c ssh.Conn, chans <-chan ssh.NewChannel, qc *quic.Conn) (ssh.Conn, <-chan ssh.NewChannel) {
+	q := &quicConn{
+		Conn:    c,
+		quic:    qc,
+		chans:   make(chan ssh.NewChannel),
+		packets: map[quic.StreamID]*quicChannel{},
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		//channels opened over ssh are still served
+		defer wg.Done()
+		for ch := range chans {
+			q.chans <- ch
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		q.acceptStreams()
+	}()
+	go func() {
+		wg.Wait()
+		close(q.chans)
+	}()
+	go q.receiveDatagrams()
+	return q, q.chans
+}
+
+// OpenChannel opens a stream, which starts with the channel type and
+// extra data, and waits for the other side to accept or reject it
+func (q *quicConn) OpenChannel(name string, data []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	stream, err := q.quic.OpenStreamSync(q.quic.Context())
+	if err != nil {
+		return nil, nil, err
+	}
+	b := quicvarint.Append(nil, uint64(len(name)))
+	b = append(b, name...)
+	b = quicvarint.Append(b, uint64(len(data)))
+	b = append(b, data...)
+	if _, err := stream.Write(b); err != nil {
+		stream.CancelRead(0)
+		stream.CancelWrite(0)
+		return nil, nil, err
+	}
+	ch := q.newChannel(stream)
+	ch.register()
+	reason, err := quicvarint.Read(ch.r)
+	if err == nil && reason != 0 {
+		var msg []byte
+		if msg, err = readQUICString(ch.r); err == nil {
+			err = &ssh.OpenChannelError{
+				Reason:  ssh.RejectionReason(reason),
+				Message: string(msg),
+			}
+		}
+	}
+	if err != nil {
+		ch.Close()
+		return nil, nil, err
+	}
+	return ch, noRequests(), nil
+}
+
+// Close closes the ssh connection, and the QUIC connection with it
+func (q *quicConn) Close() error {
+	err := q.Conn.Close()
+	q.quic.CloseWithError(0, "")
+	return err
+}
+
+func (q *quicConn) acceptStreams() {
+	ctx := q.quic.Context()
+	for {
+		stream, err := q.quic.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+		go q.acceptStream(stream)
+	}
+}
+
+// acceptStream reads the channel type and extra data
+// which start the stream, and passes on the channel
+func (q *quicConn) acceptStream(stream *quic.Stream) {
+	stream.SetReadDeadline(time.Now().Add(30 * time.Second))
+	ch := q.newChannel(stream)
+	name, err := readQUICString(ch.r)
+	var data []byte
+	if err == nil {
+		data, err = readQUICString(ch.r)
+	}
+	if err != nil {
+		ch.Close()
+		return
+	}
+	stream.SetReadDeadline(time.Time{})
+	select {
+	case q.chans <- &quicNewChannel{ch: ch, name: string(name), data: data}:
+	case <-q.quic.Context().Done():
+		ch.Close()
+	}
+}
+
+// receiveDatagrams passes each datagram to the channel
+// of the stream id which starts it
+func (q *quicConn) receiveDatagrams() {
+	ctx := q.quic.Context()
+	for {
+		b, err := q.quic.ReceiveDatagram(ctx)
+		if err != nil {
+			return
+		}
+		id, n, err := quicvarint.Parse(b)
+		if err != nil {
+			continue
+		}
+		q.mu.Lock()
+		ch := q.packets[quic.StreamID(id)]
+		q.mu.Unlock()
+		if ch == nil {
+			continue
+		}
+		select {
+		case ch.packets <- b[n:]:
+		default:
+			//full, drop like udp
+		}
+	}
+}
+
+func (q *quicConn) newChannel(stream *quic.Stream) *quicChannel {
+	return &quicChannel{
+		Stream:  stream,
+		conn:    q,
+		r:       bufio.NewReader(stream),
+		packets: make(chan []byte, quicPacketBuffer),
+		done:    make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+}
+
+// quicNewChannel is an incoming channel, which is accepted or
+// rejected with the first bytes written back on its stream
+type quicNewChannel struct {
+	ch   *quicChannel
+	name string
+	data []byte
+}
+
+func (n *quicNewChannel) Accept() (ssh.Channel, <-chan *ssh.Request, error) {
+	//receive packets before the other side sends any
+	n.ch.register()
+	if _, err := n.ch.Stream.Write(quicvarint.Append(nil, 0)); err != nil {
+		n.ch.Close()
+		return nil, nil, err
+	}
+	return n.ch, noRequests(), nil
+}
+
+func (n *quicNewChannel) Reject(reason ssh.RejectionReason, message string) error {
+	b := quicvarint.Append(nil, uint64(reason))
+	b = quicvarint.Append(b, uint64(len(message)))
+	b = append(b, message...)
+	_, err := n.ch.Stream.Write(b)
+	n.ch.Close()
+	return err
+}
+
+func (n *quicNewChannel) ChannelType() string {
+	return n.name
+}
+
+func (n *quicNewChannel) ExtraData() []byte {
+	return n.data
+}
+
+// quicChannel is an ssh.Channel over a QUIC stream. It is also a
+// packetChannel, which sends packets as datagrams, or on the
+// stream when they are too large for datagrams.
+type quicChannel struct {
+	*quic.Stream
+	conn      *quicConn
+	r         *bufio.Reader
+	wmu       sync.Mutex
+	packets   chan []byte
+	readOnce  sync.Once
+	closeOnce sync.Once
+	done      chan struct{}
+	closed    chan struct{}
+	err       error
+}
+
+func (c *quicChannel) register() {
+	c.conn.mu.Lock()
+	c.conn.packets[c.StreamID()] = c
+	c.conn.mu.Unlock()
+}
+
+func (c *quicChannel) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	return n, cnet.QUICError(err)
+}
+
+func (c *quicChannel) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.Stream.Write(b)
+}
+
+// Close ends both directions of the stream
+func (c *quicChannel) Close() error {
+	c.closeOnce.Do(func() {
+		c.conn.mu.Lock()
+		delete(c.conn.packets, c.StreamID())
+		c.conn.mu.Unlock()
+		close(c.closed)
+		c.Stream.CancelRead(0)
+		c.Stream.Close()
+	})
+	return nil
+}
+
+// CloseWrite ends the stream in the sending direction
+func (c *quicChannel) CloseWrite() error {
+	return c.Stream.Close()
+}
+
+// SendRequest is not supported by QUIC channels,
+// which are not used for requests
+func (c *quicChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return false, nil
+}
+
+func (c *quicChannel) Stderr() io.ReadWriter {
+	return noStderr{}
+}
+
+// WritePacket sends a datagram, starting with the stream id, or
+// when too large, a length prefixed packet on the stream instead
+func (c *quicChannel) WritePacket(b []byte) error {
+	d := quicvarint.Append(nil, uint64(c.StreamID()))
+	d = append(d, b...)
+	err := c.conn.quic.SendDatagram(d)
+	if err == nil {
+		return nil
+	}
+	var tooLarge *quic.DatagramTooLargeError
+	if !errors.As(err, &tooLarge) {
+		return err
+	}
+	if len(b) > maxQUICPacket {
+		return fmt.Errorf("packet too large (%d bytes)", len(b))
+	}
+	f := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(f, uint32(len(b)))
+	_, err = c.Write(append(f, b...))
+	return err
+}
+
+// ReadPacket returns the next datagram or stream packet
+func (c *quicChannel) ReadPacket() ([]byte, error) {
+	c.readOnce.Do(func() {
+		go c.readPackets()
+	})
+	select {
+	case b := <-c.packets:
+		return b, nil
+	case <-c.done:
+	}
+	//drain packets received before the stream ended
+	select {
+	case b := <-c.packets:
+		return b, nil
+	default:
+		return nil, c.err
+	}
+}
+
+// readPackets queues the packets sent on the stream
+func (c *quicChannel) readPackets() {
+	defer close(c.done)
+	h := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(c.r, h); err != nil {
+			c.err = cnet.QUICError(err)
+			return
+		}
+		n := binary.BigEndian.Uint32(h)
+		if n > maxQUICPacket {
+			c.err = fmt.Errorf("packet too large (%d bytes)", n)
+			return
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			c.err = cnet.QUICError(err)
+			return
+		}
+		select {
+		case c.packets <- b:
+		case <-c.closed:
+			c.err = io.EOF
+			return
+		}
+	}
+}
+
+func readQUICString(r *bufio.Reader) ([]byte, error) {
+	n, err := quicvarint.Read(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxQUICHeader {
+		return nil, errors.New("invalid channel header")
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+func noRequests() <-chan *ssh.Request {
+	reqs := make(chan *ssh.Request)
+	close(reqs)
+	return reqs
+}
+
+type noStderr struct{}
+
+func (noStderr) Read(b []byte) (int, error)  { return 0, io.EOF }
+func (noStderr) Write(b []byte) (int, error) { return len(b), nil }
@@ -1,9 +1,37 @@
 package tunnel
 
 import (
+	"bufio"
 	"context"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"io"
+	"sync"
+
+	"github.com/jpillora/chisel/share/settings"
+)
+
+//UDPFraming is the latest udp framing version this side supports.
+//Version 0 is encoding/gob udpPackets, used by older peers.
+//Version 1 is a version byte at the start of each direction of
+//the stream, then uvarint length prefixed frames, each holding a
+//uvarint flow id, the source of new flows, and the payload.
+const UDPFraming = 1
+
+//MaxUDPFraming is the udp framing version this side offers,
+//which CHISEL_UDP_FRAMING may lower, to compare the versions
+func MaxUDPFraming() int {
+	return min(max(settings.EnvInt("UDP_FRAMING", UDPFraming), 0), UDPFraming)
+}
+
+const (
+	//maxUDPFlows limits the flow ids of each direction,
+	//after which the sender starts again from zero
+	maxUDPFlows = 4096
+	//maxUDPFrame limits the size of each frame
+	maxUDPFrame = 1 << 17
 )
 
 type udpPacket struct {
@@ -15,14 +43,54 @@ func init() {
 	gob.Register(&udpPacket{})
 }
 
-//udpChannel encodes/decodes udp payloads over a stream
+//packetChannel is a channel which carries whole packets,
+//such as those of the QUIC transport (see quicChannel)
+type packetChannel interface {
+	ReadPacket() ([]byte, error)
+	WritePacket(b []byte) error
+}
+
+//udpChannel encodes/decodes udp payloads over a stream,
+//or over a packetChannel, when the channel is one
 type udpChannel struct {
 	r *gob.Decoder
 	w *gob.Encoder
+	p packetChannel
 	c io.Closer
+	f *udpFramer
+}
+
+//newUDPChannel encodes udp payloads with the given framing version,
+//which must be the version both sides agreed upon, see Tunnel.udpFraming
+func newUDPChannel(rwc io.ReadWriteCloser, version int) *udpChannel {
+	if p, ok := rwc.(packetChannel); ok {
+		return &udpChannel{p: p, c: rwc}
+	}
+	if version >= 1 {
+		return &udpChannel{f: newUDPFramer(rwc), c: rwc}
+	}
+	return &udpChannel{
+		r: gob.NewDecoder(rwc),
+		w: gob.NewEncoder(rwc),
+		c: rwc,
+	}
 }
 
 func (o *udpChannel) encode(src string, b []byte) error {
+	if o.p != nil {
+		//packets are the source length, source and payload
+		if len(src) > 255 {
+			return errors.New("udp source too long")
+		}
+		buff := make([]byte, 0, 1+len(src)+len(b))
+		buff = append(buff, byte(len(src)))
+		buff = append(buff, src...)
+		buff = append(buff, b...)
+		return o.p.WritePacket(buff)
+	}
+	if o.f != nil {
+		return o.f.encode(src, b)
+	}
 	return o.w.Encode(udpPacket{
 		Src:     src,
 		Payload: b,
@@ -30,9 +98,139 @@ func (o *udpChannel) encode(src string, b []byte) error {
 }
 
 func (o *udpChannel) decode(p *udpPacket) error {
+	if o.p != nil {
+		b, err := o.p.ReadPacket()
+		if err != nil {
+			return err
+		}
+		if len(b) == 0 || len(b) < 1+int(b[0]) {
+			return errors.New("invalid udp packet")
+		}
+		n := 1 + int(b[0])
+		p.Src = string(b[1:n])
+		p.Payload = b[n:]
+		return nil
+	}
+	if o.f != nil {
+		return o.f.decode(p)
+	}
 	return o.r.Decode(p)
 }
 
+//udpFramer implements version 1 of the udp framing. Sources are
+//sent once per flow, the first time each is used, after which
+//frames only carry the flow id. Since the stream is reliable, the
+//receiver always knows the source of each flow id it is sent.
+type udpFramer struct {
+	wmu     sync.Mutex
+	w       io.Writer
+	wrote   bool
+	flows   map[string]uint64
+	r       *bufio.Reader
+	read    bool
+	sources map[uint64]string
+}
+
+func newUDPFramer(rw io.ReadWriter) *udpFramer {
+	return &udpFramer{
+		w:       rw,
+		flows:   map[string]uint64{},
+		r:       bufio.NewReader(rw),
+		sources: map[uint64]string{},
+	}
+}
+
+func (f *udpFramer) encode(src string, b []byte) error {
+	f.wmu.Lock()
+	defer f.wmu.Unlock()
+	//the flow id is shifted left, with the low
+	//bit set when the source follows it
+	id, ok := f.flows[src]
+	flow := id << 1
+	if !ok {
+		if len(f.flows) == maxUDPFlows {
+			f.flows = map[string]uint64{}
+		}
+		id = uint64(len(f.flows))
+		f.flows[src] = id
+		flow = id<<1 | 1
+	}
+	body := make([]byte, 0, 2*binary.MaxVarintLen64+len(src)+len(b))
+	body = binary.AppendUvarint(body, flow)
+	if !ok {
+		body = binary.AppendUvarint(body, uint64(len(src)))
+		body = append(body, src...)
+	}
+	body = append(body, b...)
+	if len(body) > maxUDPFrame {
+		return fmt.Errorf("udp packet too large (%d bytes)", len(b))
+	}
+	frame := make([]byte, 0, 1+binary.MaxVarintLen64+len(body))
+	if !f.wrote {
+		frame = append(frame, UDPFraming)
+	}
+	frame = binary.AppendUvarint(frame, uint64(len(body)))
+	frame = append(frame, body...)
+	if _, err := f.w.Write(frame); err != nil {
+		return err
+	}
+	f.wrote = true
+	return nil
+}
+
+func (f *udpFramer) decode(p *udpPacket) error {
+	if !f.read {
+		v, err := f.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if v != UDPFraming {
+			return fmt.Errorf("unsupported udp framing version %d", v)
+		}
+		f.read = true
+	}
+	n, err := binary.ReadUvarint(f.r)
+	if err != nil {
+		return err
+	}
+	if n > maxUDPFrame {
+		return fmt.Errorf("udp frame too large (%d bytes)", n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(f.r, body); err != nil {
+		return unexpectedEOF(err)
+	}
+	flow, i := binary.Uvarint(body)
+	if i <= 0 || flow>>1 >= maxUDPFlows {
+		return errors.New("invalid udp frame")
+	}
+	body = body[i:]
+	id := flow >> 1
+	if flow&1 == 1 {
+		l, i := binary.Uvarint(body)
+		if i <= 0 || uint64(len(body)-i) < l {
+			return errors.New("invalid udp frame")
+		}
+		f.sources[id] = string(body[i : i+int(l)])
+		body = body[i+int(l):]
+	}
+	src, ok := f.sources[id]
+	if !ok {
+		return fmt.Errorf("unknown udp flow %d", id)
+	}
+	p.Src = src
+	p.Payload = body
+	return nil
+}
+
+//unexpectedEOF reports streams which end mid-frame
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
 func isDone(ctx context.Context) bool {
 	select {
 	case <-ctx.Done():
@@ -0,0 +1,193 @@
+package tunnel
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jpillora/chisel/share/cio"
+	"github.com/jpillora/chisel/share/cnet"
+)
+
+// udpFlowStats counts the flows of every udp exit,
+// and the packets which udp listeners dropped
+var udpFlowStats struct {
+	open, total, evicted, expired, dropped int64
+}
+
+// UDPStats describes the flows of every udp exit,
+// and the packets which udp listeners dropped
+func UDPStats() string {
+	return fmt.Sprintf("udp-flows: %d open, %d total, %d evicted, %d expired, %d dropped packets",
+		atomic.LoadInt64(&udpFlowStats.open),
+		atomic.LoadInt64(&udpFlowStats.total),
+		atomic.LoadInt64(&udpFlowStats.evicted),
+		atomic.LoadInt64(&udpFlowStats.expired),
+		atomic.LoadInt64(&udpFlowStats.dropped),
+	)
+}
+
+// udpFlow is the connection of one source to the udp destination
+type udpFlow struct {
+	net.Conn
+	src  string
+	elem *list.Element
+	last time.Time
+}
+
+// udpFlows is the flow table of a udp exit, mapping the source of
+// each flow to its connection. The table is bounded, evicting its
+// least recently used flow when full, and expires flows which are
+// idle in both directions. Replies are read by a udpPoller, rather
+// than by a goroutine per flow, where the platform allows it.
+type udpFlows struct {
+	*cio.Logger
+	mu     sync.Mutex
+	dialer *cnet.Dialer
+	max    int
+	idle   time.Duration
+	m      map[string]*udpFlow
+	lru    *list.List
+	poller udpPoller
+	reply  func(src string, b []byte) error
+	done   chan struct{}
+}
+
+func newUDPFlows(l *cio.Logger, dialer *cnet.Dialer, maxFlows int, idle time.Duration, mtu int, reply func(src string, b []byte) error) (*udpFlows, error) {
+	fs := &udpFlows{
+		Logger: l,
+		dialer: dialer,
+		max:    maxFlows,
+		idle:   idle,
+		m:      map[string]*udpFlow{},
+		lru:    list.New(),
+		reply:  reply,
+		done:   make(chan struct{}),
+	}
+	p, err := newUDPPoller(mtu, fs.received, fs.failed)
+	if err != nil {
+		return nil, err
+	}
+	fs.poller = p
+	go fs.expire()
+	return fs, nil
+}
+
+// dial returns the flow of the given source, dialing addr
+// for new flows, after evicting the least recently used
+// flow when the table is full
+func (fs *udpFlows) dial(src, addr string) (*udpFlow, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if f, ok := fs.m[src]; ok {
+		fs.touch(f)
+		return f, nil
+	}
+	if len(fs.m) >= fs.max {
+		f := fs.lru.Back().Value.(*udpFlow)
+		fs.Debugf("Evicted UDP flow %s (%d flows)", f.src, fs.max)
+		fs.remove(f)
+		atomic.AddInt64(&udpFlowStats.evicted, 1)
+	}
+	c, err := fs.dialer.DialContext(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	f := &udpFlow{Conn: c, src: src, last: time.Now()}
+	if err := fs.poller.add(f); err != nil {
+		c.Close()
+		return nil, err
+	}
+	f.elem = fs.lru.PushFront(f)
+	fs.m[src] = f
+	atomic.AddInt64(&udpFlowStats.open, 1)
+	atomic.AddInt64(&udpFlowStats.total, 1)
+	return f, nil
+}
+
+// received sends a reply back to the source of the flow
+func (fs *udpFlows) received(f *udpFlow, b []byte) {
+	fs.mu.Lock()
+	if fs.m[f.src] == f {
+		fs.touch(f)
+	}
+	fs.mu.Unlock()
+	if err := fs.reply(f.src, b); err != nil {
+		fs.Debugf("encode error: %s", err)
+	}
+}
+
+// failed removes a flow which can no longer be read
+func (fs *udpFlows) failed(f *udpFlow, err error) {
+	fs.Debugf("read error: %s", err)
+	fs.drop(f)
+}
+
+// drop removes the flow, if it is still in the table
+func (fs *udpFlows) drop(f *udpFlow) {
+	fs.mu.Lock()
+	if fs.m[f.src] == f {
+		fs.remove(f)
+	}
+	fs.mu.Unlock()
+}
+
+// touch marks the flow as the most recently used
+func (fs *udpFlows) touch(f *udpFlow) {
+	f.last = time.Now()
+	fs.lru.MoveToFront(f.elem)
+}
+
+func (fs *udpFlows) remove(f *udpFlow) {
+	delete(fs.m, f.src)
+	fs.lru.Remove(f.elem)
+	fs.poller.remove(f)
+	f.Close()
+	atomic.AddInt64(&udpFlowStats.open, -1)
+}
+
+// expire periodically removes the flows idle for too long,
+// which are at the back of the list
+func (fs *udpFlows) expire() {
+	t := time.NewTicker(max(fs.idle/4, 10*time.Millisecond))
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-fs.done:
+			return
+		}
+		fs.mu.Lock()
+		for e := fs.lru.Back(); e != nil; e = fs.lru.Back() {
+			f := e.Value.(*udpFlow)
+			if time.Since(f.last) < fs.idle {
+				break
+			}
+			fs.remove(f)
+			atomic.AddInt64(&udpFlowStats.expired, 1)
+		}
+		fs.mu.Unlock()
+	}
+}
+
+func (fs *udpFlows) close() {
+	close(fs.done)
+	fs.mu.Lock()
+	for _, f := range fs.m {
+		fs.remove(f)
+	}
+	fs.mu.Unlock()
+	fs.poller.close()
+}
+
+// udpPoller reads the replies of udp flows, passing each to
+// received, or the error which ended the flow to failed
+type udpPoller interface {
+	add(f *udpFlow) error
+	remove(f *udpFlow)
+	close()
+}
@@ -0,0 +1,156 @@
+//go:build linux
+
+package tunnel
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// newUDPPoller reads every flow from one goroutine,
+// which waits on an epoll instance for replies
+func newUDPPoller(mtu int, received func(*udpFlow, []byte), failed func(*udpFlow, error)) (udpPoller, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	//the event fd wakes the poller to close it
+	wake, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		unix.Close(epfd)
+		return nil, err
+	}
+	ev := unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(wake)}
+	if err := unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, wake, &ev); err != nil {
+		unix.Close(epfd)
+		unix.Close(wake)
+		return nil, err
+	}
+	p := &epollPoller{
+		epfd:     epfd,
+		wake:     wake,
+		fds:      map[int32]*epollFlow{},
+		flows:    map[*udpFlow]*epollFlow{},
+		received: received,
+		failed:   failed,
+		buff:     make([]byte, mtu),
+		done:     make(chan struct{}),
+	}
+	go p.wait()
+	return p, nil
+}
+
+type epollPoller struct {
+	epfd     int
+	wake     int
+	mu       sync.Mutex
+	fds      map[int32]*epollFlow
+	flows    map[*udpFlow]*epollFlow
+	received func(*udpFlow, []byte)
+	failed   func(*udpFlow, error)
+	buff     []byte
+	closed   int32
+	done     chan struct{}
+}
+
+type epollFlow struct {
+	*udpFlow
+	rc syscall.RawConn
+	fd int32
+}
+
+func (p *epollPoller) add(f *udpFlow) error {
+	sc, ok := f.Conn.(syscall.Conn)
+	if !ok {
+		return errors.New("udp connection has no file descriptor")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	ef := &epollFlow{udpFlow: f, rc: rc}
+	if err := rc.Control(func(fd uintptr) { ef.fd = int32(fd) }); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ev := unix.EpollEvent{Events: unix.EPOLLIN, Fd: ef.fd}
+	if err := unix.EpollCtl(p.epfd, unix.EPOLL_CTL_ADD, int(ef.fd), &ev); err != nil {
+		return err
+	}
+	p.fds[ef.fd] = ef
+	p.flows[f] = ef
+	return nil
+}
+
+// remove stops polling the flow, before it is closed,
+// and so before its file descriptor can be reused
+func (p *epollPoller) remove(f *udpFlow) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ef, ok := p.flows[f]; ok {
+		unix.EpollCtl(p.epfd, unix.EPOLL_CTL_DEL, int(ef.fd), nil)
+		delete(p.fds, ef.fd)
+		delete(p.flows, f)
+	}
+}
+
+// wait reads the flows which epoll reports readable
+func (p *epollPoller) wait() {
+	defer close(p.done)
+	events := make([]unix.EpollEvent, 128)
+	for atomic.LoadInt32(&p.closed) == 0 {
+		n, err := unix.EpollWait(p.epfd, events, -1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		for _, ev := range events[:n] {
+			p.mu.Lock()
+			ef := p.fds[ev.Fd]
+			p.mu.Unlock()
+			if ef != nil {
+				p.read(ef)
+			}
+		}
+	}
+}
+
+// read passes on each pending reply of the flow
+func (p *epollPoller) read(ef *epollFlow) {
+	for {
+		var n int
+		var rerr error
+		//holding the raw conn keeps the fd open while it is read
+		if err := ef.rc.Read(func(fd uintptr) bool {
+			n, rerr = unix.Read(int(fd), p.buff)
+			return true
+		}); err != nil {
+			rerr = err
+		}
+		if rerr == unix.EAGAIN || rerr == unix.EINTR {
+			return
+		}
+		if rerr != nil {
+			p.failed(ef.udpFlow, rerr)
+			return
+		}
+		p.received(ef.udpFlow, p.buff[:n])
+	}
+}
+
+func (p *epollPoller) close() {
+	if atomic.CompareAndSwapInt32(&p.closed, 0, 1) {
+		//closing epfd would not wake the poller
+		unix.Write(p.wake, []byte{1, 0, 0, 0, 0, 0, 0, 0})
+		<-p.done
+		unix.Close(p.epfd)
+		unix.Close(p.wake)
+	}
+}
@@ -0,0 +1,34 @@
+//go:build !linux
+
+package tunnel
+
+// newUDPPoller reads each flow with its own goroutine,
+// which ends when the flow is closed
+func newUDPPoller(mtu int, received func(*udpFlow, []byte), failed func(*udpFlow, error)) (udpPoller, error) {
+	return &goroutinePoller{mtu: mtu, received: received, failed: failed}, nil
+}
+
+type goroutinePoller struct {
+	mtu      int
+	received func(*udpFlow, []byte)
+	failed   func(*udpFlow, error)
+}
+
+func (p *goroutinePoller) add(f *udpFlow) error {
+	go func() {
+		b := make([]byte, p.mtu)
+		for {
+			n, err := f.Read(b)
+			if err != nil {
+				p.failed(f, err)
+				return
+			}
+			p.received(f, b[:n])
+		}
+	}()
+	return nil
+}
+
+func (p *goroutinePoller) remove(f *udpFlow) {}
+
+func (p *goroutinePoller) close() {}
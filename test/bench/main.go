@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
@@ -50,6 +51,8 @@ func run() {
 			test()
 		case "bench":
 			bench()
+		case "udp":
+			benchUDP()
 		}
 	}
 }
@@ -69,6 +72,16 @@ func bench() {
 	}
 }
 
+//udp benchmark, of the current udp
+//framing (:2003) and of gob (:2004)
+func benchUDP() {
+	for _, size := range []int{10, 100, 1000, 8000} {
+		testUDP("3001", size)
+		testUDP("2003", size)
+		testUDP("2004", size)
+	}
+}
+
 func benchSizes(port string) {
 	for size := 1; size <= 100*MB; size *= 10 {
 		testTunnel(port, size)
@@ -96,6 +109,39 @@ func testTunnel(port string, size int) {
 	}
 }
 
+func testUDP(port string, size int) {
+	const count = 20000
+	const window = 64
+	conn, err := net.Dial("udp", "127.0.0.1:"+port)
+	if err != nil {
+		fatal(err)
+	}
+	defer conn.Close()
+	//keep up to <window> packets in flight
+	b := make([]byte, size)
+	t0 := time.Now()
+	sent, received := 0, 0
+	for ; sent < window; sent++ {
+		conn.Write(b)
+	}
+	r := make([]byte, size)
+	for received < sent {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(r); err != nil {
+			break
+		}
+		received++
+		if sent < count {
+			conn.Write(b)
+			sent++
+		}
+	}
+	d := time.Since(t0)
+	fmt.Printf(":%s => %d x %d byte packets in %s (%.0f packets/s, %.1f MB/s, %d lost)\n",
+		port, received, size, d, float64(received)/d.Seconds(),
+		float64(received*size)/MB/d.Seconds(), sent-received)
+}
+
 //============================
 
 func requestFile(port string, size int) (*http.Response, error) {
@@ -126,6 +172,24 @@ func makeFileServer() *cnet.HTTPServer {
 	return s
 }
 
+func makeUDPEchoServer() net.PacketConn {
+	l, err := net.ListenPacket("udp", "127.0.0.1:3001")
+	if err != nil {
+		fatal(err)
+	}
+	go func() {
+		b := make([]byte, 9000)
+		for {
+			n, a, err := l.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			l.WriteTo(b[:n], a)
+		}
+	}()
+	return l
+}
+
 //============================
 
 func fatal(args ...interface{}) {
@@ -139,6 +203,8 @@ func fatalf(f string, args ...interface{}) {
 func main() {
 
 	fs := makeFileServer()
+	us := makeUDPEchoServer()
+	defer us.Close()
 	go func() {
 		err := fs.Wait()
 		if err != nil {
@@ -189,15 +255,28 @@ func main() {
 
 	hf := exec.Command("chisel", "client",
 		// "-v",
-		"--fingerprint", "mOz4rg9zlQ409XAhhj6+fDDVwQMY42CL3Zg2W2oTYxA=",
+		"--fingerprint", "OHclTPr2X1+S7CdRWW7dLFP7SwgtZy6jub2UmnpbTXw=",
 		"127.0.0.1:2002",
-		"2001:3000")
+		"2001:3000",
+		"2003:3001/udp")
 	hf.Stdout = os.Stdout
 	if err := hf.Start(); err != nil {
 		fatal(err)
 	}
 	defer hf.Process.Kill()
 
+	//older clients use gob udp framing
+	hg := exec.Command("chisel", "client",
+		"--fingerprint", "OHclTPr2X1+S7CdRWW7dLFP7SwgtZy6jub2UmnpbTXw=",
+		"127.0.0.1:2002",
+		"2004:3001/udp")
+	hg.Env = append(os.Environ(), "CHISEL_UDP_FRAMING=0")
+	hg.Stdout = os.Stdout
+	if err := hg.Start(); err != nil {
+		fatal(err)
+	}
+	defer hg.Process.Kill()
+
 	time.Sleep(100 * time.Millisecond)
 
 	defer func() {
@@ -0,0 +1,84 @@
+package e2e_test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	chserver "github.com/jpillora/chisel/server"
+)
+
+func startAccessServer(t *testing.T, c *chserver.Config) (string, func()) {
+	s, err := chserver.NewServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Debug = debug
+	serverPort := availablePort()
+	if err := s.Start("127.0.0.1", serverPort); err != nil {
+		t.Fatal(err)
+	}
+	return "127.0.0.1:" + serverPort, func() { s.Close() }
+}
+
+func TestDenyIP(t *testing.T) {
+	serverAddr, teardown := startAccessServer(t, &chserver.Config{
+		KeySeed: "deny-ip-test",
+		DenyIP:  []string{"127.0.0.0/8"},
+	})
+	defer teardown()
+	if err := chiselLogin(serverAddr, "foo", "bar"); err == nil {
+		t.Fatalf("expected denied network to be rejected")
+	}
+}
+
+func TestAllowIPTrustedProxy(t *testing.T) {
+	serverAddr, teardown := startAccessServer(t, &chserver.Config{
+		KeySeed:        "allow-ip-test",
+		AllowIP:        []string{"10.1.2.3"},
+		TrustedProxies: []string{"127.0.0.1"},
+	})
+	defer teardown()
+	//direct connection from the proxy is not allowed
+	if err := chiselLogin(serverAddr, "foo", "bar"); err == nil {
+		t.Fatalf("expected proxy address to be rejected")
+	}
+	//forwarded client address is allowed
+	h := http.Header{}
+	h.Set("X-Forwarded-For", "10.1.2.3")
+	if err := chiselLoginHeaders(serverAddr, "foo", "bar", h); err != nil {
+		t.Fatalf("expected forwarded client to be allowed: %s", err)
+	}
+	//spoofed address before an untrusted hop is ignored
+	h.Set("X-Forwarded-For", "10.1.2.3, 192.168.0.1")
+	if err := chiselLoginHeaders(serverAddr, "foo", "bar", h); err == nil {
+		t.Fatalf("expected untrusted hop to be rejected")
+	}
+}
+
+func TestUserAllowIP(t *testing.T) {
+	authfile := filepath.Join(t.TempDir(), "users.json")
+	err := os.WriteFile(authfile, []byte(`{
+		"local:pass": {"addrs": [""], "allow-ip": ["127.0.0.0/8"]},
+		"remote:pass": {"addrs": [""], "allow-ip": ["10.0.0.0/8"]},
+		"legacy:pass": [""]
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverAddr, teardown := startAccessServer(t, &chserver.Config{
+		KeySeed:  "user-allow-ip-test",
+		AuthFile: authfile,
+	})
+	defer teardown()
+	if err := chiselLogin(serverAddr, "local", "pass"); err != nil {
+		t.Fatalf("expected local user to be allowed: %s", err)
+	}
+	if err := chiselLogin(serverAddr, "legacy", "pass"); err != nil {
+		t.Fatalf("expected legacy user to be allowed: %s", err)
+	}
+	if err := chiselLogin(serverAddr, "remote", "pass"); err == nil {
+		t.Fatalf("expected remote user to be denied")
+	}
+}
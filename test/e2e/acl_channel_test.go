@@ -6,6 +6,8 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -321,3 +323,91 @@ func TestAuthWildcardChannel(t *testing.T) {
 	}
 	t.Logf("wildcard user correctly allowed")
 }
+
+// TestAuthChannelResolvedACL verifies that structured ACL rules are
+// checked against the resolved address of the destination.
+func TestAuthChannelResolvedACL(t *testing.T) {
+	targetPort := availablePort()
+	listener, err := net.Listen("tcp", "127.0.0.1:"+targetPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("RESOLVED"))
+			conn.Close()
+		}
+	}()
+
+	authfile := filepath.Join(t.TempDir(), "users.json")
+	users := fmt.Sprintf(`{
+		"user:pass": {
+			"addrs": [""],
+			"acl": ["allow 127.0.0.0/8:%s", "deny *"]
+		},
+		"public:pass": {
+			"addrs": [""],
+			"acl": ["deny 127.0.0.0/8", "allow *"]
+		}
+	}`, targetPort)
+	if err := os.WriteFile(authfile, []byte(users), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := chserver.NewServer(&chserver.Config{
+		KeySeed:  "acl-resolved-test",
+		AuthFile: authfile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Debug = debug
+	serverPort := availablePort()
+	if err := s.Start("127.0.0.1", serverPort); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	serverAddr := "127.0.0.1:" + serverPort
+
+	r, err := settings.DecodeRemote(fmt.Sprintf("0.0.0.0:%s:127.0.0.1:%s", targetPort, targetPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the host name is resolved and matched against the allowed CIDR
+	sc, _, _ := dialChiselSSH(t, serverAddr, "user", "pass")
+	defer sc.Close()
+	sendConfig(t, sc, []*settings.Remote{r})
+	ch, reqs, err := sc.OpenChannel("chisel", []byte("localhost:"+targetPort))
+	if err != nil {
+		t.Fatalf("channel to allowed port was rejected: %v", err)
+	}
+	go ssh.DiscardRequests(reqs)
+	buf := make([]byte, 64)
+	n, err := ch.Read(buf)
+	if err != nil && err != io.EOF {
+		t.Fatalf("read: %v", err)
+	}
+	ch.Close()
+	if string(buf[:n]) != "RESOLVED" {
+		t.Fatalf("expected 'RESOLVED', got %q", buf[:n])
+	}
+	// other ports fall through to the deny rule
+	if ch, _, err := sc.OpenChannel("chisel", []byte("127.0.0.1:"+availablePort())); err == nil {
+		ch.Close()
+		t.Fatalf("channel to port outside the acl was accepted")
+	}
+
+	// a host name resolving into a denied network is rejected
+	sc2, _, _ := dialChiselSSH(t, serverAddr, "public", "pass")
+	defer sc2.Close()
+	sendConfig(t, sc2, []*settings.Remote{r})
+	if ch, _, err := sc2.OpenChannel("chisel", []byte("localhost:"+targetPort)); err == nil {
+		ch.Close()
+		t.Fatalf("channel resolving to a denied network was accepted")
+	}
+}
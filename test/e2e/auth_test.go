@@ -1,14 +1,19 @@
 package e2e_test
 
 import (
+	"net"
+	"net/http"
 	"testing"
+	"time"
 
+	"github.com/gorilla/websocket"
 	chclient "github.com/jpillora/chisel/client"
 	chserver "github.com/jpillora/chisel/server"
+	"github.com/jpillora/chisel/share/cnet"
+	"golang.org/x/crypto/ssh"
 )
 
 //TODO tests for:
-// - failed auth
 // - dynamic auth (server add/remove user)
 // - watch auth file
 
@@ -46,3 +51,138 @@ func TestAuth(t *testing.T) {
 		t.Fatalf("expected exclamation mark added again")
 	}
 }
+
+// chiselLogin connects to the chisel server via websocket
+// and attempts an SSH handshake as the given user.
+func chiselLogin(serverAddr, user, pass string) error {
+	return chiselLoginHeaders(serverAddr, user, pass, http.Header{})
+}
+
+func chiselLoginHeaders(serverAddr, user, pass string, headers http.Header) error {
+	return chiselLoginFrom(serverAddr, "", user, pass, headers)
+}
+
+// chiselLoginFrom logins from the optional source IP
+func chiselLoginFrom(serverAddr, src, user, pass string, headers http.Header) error {
+	d := &net.Dialer{}
+	if src != "" {
+		d.LocalAddr = &net.TCPAddr{IP: net.ParseIP(src)}
+	}
+	ws, _, err := (&websocket.Dialer{
+		NetDialContext:   d.DialContext,
+		HandshakeTimeout: 5 * time.Second,
+		Subprotocols:     []string{"chisel-v3"},
+	}).Dial("ws://"+serverAddr, headers)
+	if err != nil {
+		return err
+	}
+	conn := cnet.NewWebSocketConn(ws)
+	defer conn.Close()
+	sc, _, _, err := ssh.NewClientConn(conn, "", &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.Password(pass)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return err
+	}
+	return sc.Close()
+}
+
+func TestAuthLockout(t *testing.T) {
+	s, err := chserver.NewServer(&chserver.Config{
+		KeySeed:       "lockout-test",
+		Auth:          "foo:bar",
+		LoginAttempts: 2,
+		LoginBan:      time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Debug = debug
+	serverPort := availablePort()
+	if err := s.Start("127.0.0.1", serverPort); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	serverAddr := "127.0.0.1:" + serverPort
+	//correct password works
+	if err := chiselLogin(serverAddr, "foo", "bar"); err != nil {
+		t.Fatalf("expected login to succeed: %s", err)
+	}
+	//guess twice
+	for i := 0; i < 2; i++ {
+		if err := chiselLogin(serverAddr, "foo", "guess"); err == nil {
+			t.Fatalf("expected login to fail")
+		}
+	}
+	//now locked out, even with the correct password
+	if err := chiselLogin(serverAddr, "foo", "bar"); err == nil {
+		t.Fatalf("expected login to be locked out")
+	}
+}
+
+func TestAuthLockoutOtherAddress(t *testing.T) {
+	t.Setenv("CHISEL_LOGIN_DELAY", "50ms")
+	s, err := chserver.NewServer(&chserver.Config{
+		KeySeed:       "lockout-other-test",
+		Auth:          "foo:bar",
+		LoginAttempts: 2,
+		LoginBan:      time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Debug = debug
+	serverPort := availablePort()
+	if err := s.Start("127.0.0.1", serverPort); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	serverAddr := "127.0.0.1:" + serverPort
+	//one address guesses until it is locked out
+	for i := 0; i < 4; i++ {
+		if err := chiselLoginFrom(serverAddr, "127.0.0.2", "foo", "guess", http.Header{}); err == nil {
+			t.Fatalf("expected login to fail")
+		}
+	}
+	if err := chiselLoginFrom(serverAddr, "127.0.0.2", "foo", "bar", http.Header{}); err == nil {
+		t.Fatalf("expected login to be locked out")
+	}
+	//the user still logs in from another address, only slowed down
+	t0 := time.Now()
+	if err := chiselLoginFrom(serverAddr, "127.0.0.3", "foo", "bar", http.Header{}); err != nil {
+		t.Fatalf("expected login from another address to succeed: %s", err)
+	}
+	if d := time.Since(t0); d < 50*time.Millisecond {
+		t.Fatalf("expected login to be slowed down, took %s", d)
+	}
+}
+
+func TestAuthLockoutAllowlist(t *testing.T) {
+	s, err := chserver.NewServer(&chserver.Config{
+		KeySeed:       "lockout-allow-test",
+		Auth:          "foo:bar",
+		LoginAttempts: 1,
+		LoginAllow:    []string{"127.0.0.0/8"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Debug = debug
+	serverPort := availablePort()
+	if err := s.Start("127.0.0.1", serverPort); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	serverAddr := "127.0.0.1:" + serverPort
+	for i := 0; i < 3; i++ {
+		if err := chiselLogin(serverAddr, "foo", "guess"); err == nil {
+			t.Fatalf("expected login to fail")
+		}
+	}
+	//trusted network is never locked out
+	if err := chiselLogin(serverAddr, "foo", "bar"); err != nil {
+		t.Fatalf("expected trusted login to succeed: %s", err)
+	}
+}
@@ -0,0 +1,100 @@
+package e2e_test
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	chclient "github.com/jpillora/chisel/client"
+	chserver "github.com/jpillora/chisel/server"
+)
+
+// countingDialer counts the bytes read and written
+// by the client's connections to the server
+type countingDialer struct {
+	n atomic.Int64
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, n: &d.n}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	n *atomic.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// postCompressed posts the body, which is echoed back, and checks
+// far fewer bytes than the body crossed the client's connection
+func postCompressed(t *testing.T, d *countingDialer, port, body string) {
+	t.Helper()
+	before := d.n.Load()
+	result, err := post("http://localhost:"+port, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != body+"!" {
+		t.Fatalf("expected exclamation mark added, got %d bytes", len(result))
+	}
+	//the body crosses twice, uncompressed
+	//that would be over 2MB on the wire
+	if wire := d.n.Load() - before; wire > int64(len(body))/10 {
+		t.Fatalf("expected the channel to be compressed, %d bytes crossed for a %d byte body", wire, len(body))
+	}
+}
+
+func TestCompress(t *testing.T) {
+	body := strings.Repeat("compressible text, ", 50000)
+	for _, alg := range []string{"zstd", "deflate"} {
+		t.Run(alg, func(t *testing.T) {
+			d := &countingDialer{}
+			forwardPort := availablePort()
+			reversePort := availablePort()
+			teardown := simpleSetup(t,
+				&chserver.Config{Reverse: true},
+				&chclient.Config{
+					Remotes: []string{
+						forwardPort + ":$FILEPORT/" + alg,
+						"R:" + reversePort + ":$FILEPORT/" + alg,
+					},
+					DialContext: d.DialContext,
+				})
+			defer teardown()
+			for _, port := range []string{forwardPort, reversePort} {
+				postCompressed(t, d, port, body)
+			}
+		})
+	}
+}
+
+func TestCompressAll(t *testing.T) {
+	d := &countingDialer{}
+	tmpPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{},
+		&chclient.Config{
+			Remotes:     []string{tmpPort + ":$FILEPORT"},
+			Compress:    "zstd",
+			DialContext: d.DialContext,
+		})
+	defer teardown()
+	postCompressed(t, d, tmpPort, strings.Repeat("compressible text, ", 50000))
+}
@@ -0,0 +1,156 @@
+package e2e_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	chclient "github.com/jpillora/chisel/client"
+	chserver "github.com/jpillora/chisel/server"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDNSRemote(t *testing.T) {
+	//fake nameserver at the far end, counting A queries
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var queries int32
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			if _, err := p.Start(b[:n]); err == nil {
+				if q, err := p.Question(); err == nil && q.Type == dnsmessage.TypeA {
+					atomic.AddInt32(&queries, 1)
+				}
+			}
+			conn.WriteTo(fakeDNSAnswer(b[:n]), addr)
+		}
+	}()
+	dnsPort := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{ExitDNS: conn.LocalAddr().String()},
+		&chclient.Config{
+			Remotes:    []string{"127.0.0.1:" + dnsPort + ":dns"},
+			DNSDomains: []string{"chisel.test"},
+		},
+	)
+	defer teardown()
+	for _, network := range []string{"udp", "tcp"} {
+		r := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				d := net.Dialer{}
+				return d.DialContext(ctx, network, "127.0.0.1:"+dnsPort)
+			},
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		addrs, err := r.LookupHost(ctx, "fake.chisel.test")
+		cancel()
+		if err != nil {
+			t.Fatalf("%s: %s", network, err)
+		}
+		if len(addrs) != 1 || addrs[0] != "127.0.0.1" {
+			t.Fatalf("%s: expected 127.0.0.1, got %v", network, addrs)
+		}
+	}
+	//the second lookup was answered from the cache
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Fatalf("expected 1 A query at the nameserver, got %d", n)
+	}
+	//cached answers count down their ttl
+	time.Sleep(1100 * time.Millisecond)
+	if ttl := queryTTL(t, "127.0.0.1:"+dnsPort, "fake.chisel.test."); ttl >= 60 {
+		t.Fatalf("expected the cached ttl to be below 60, got %d", ttl)
+	}
+}
+
+// queryTTL sends an A query over udp, returning the ttl of the answer
+func queryTTL(t *testing.T, addr, name string) uint32 {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	query, _ := b.Finish()
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(query); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, 512)
+	n, err := conn.Read(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m dnsmessage.Message
+	if err := m.Unpack(resp[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Answers) != 1 {
+		t.Fatalf("expected 1 answer, got %d", len(m.Answers))
+	}
+	return m.Answers[0].Header.TTL
+}
+
+func TestDNSRemoteACL(t *testing.T) {
+	nameserver := fakeDNSServer(t)
+	authfile := filepath.Join(t.TempDir(), "users.json")
+	users := fmt.Sprintf(`{
+		"web:pass": {"addrs": [""], "acl": ["allow 192.0.2.0/24:443"]},
+		"dns:pass": {"addrs": [""], "acl": ["allow %s"]}
+	}`, nameserver)
+	if err := os.WriteFile(authfile, []byte(users), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := chserver.NewServer(&chserver.Config{
+		KeySeed:  "dns-acl-test",
+		AuthFile: authfile,
+		ExitDNS:  nameserver,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Debug = debug
+	serverPort := availablePort()
+	if err := s.Start("127.0.0.1", serverPort); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, tc := range []struct {
+		user    string
+		allowed bool
+	}{
+		//the nameserver is not among the allowed destinations
+		{"web", false},
+		{"dns", true},
+	} {
+		sc, _, _ := dialChiselSSH(t, "127.0.0.1:"+serverPort, tc.user, "pass")
+		sendConfig(t, sc, nil)
+		ch, _, err := sc.OpenChannel("chisel", []byte("dns"))
+		if tc.allowed && err != nil {
+			t.Fatalf("%s: expected dns channel, got %s", tc.user, err)
+		} else if !tc.allowed && err == nil {
+			t.Fatalf("%s: expected dns channel to be rejected", tc.user)
+		}
+		if ch != nil {
+			ch.Close()
+		}
+		sc.Close()
+	}
+}
@@ -0,0 +1,121 @@
+package e2e_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	chserver "github.com/jpillora/chisel/server"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNSAnswer answers A queries for *.chisel.test with 127.0.0.1
+func fakeDNSAnswer(query []byte) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, RecursionAvailable: true})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	if q.Type == dnsmessage.TypeA && strings.HasSuffix(q.Name.String(), ".chisel.test.") {
+		b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60},
+			dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}})
+	}
+	resp, _ := b.Finish()
+	return resp
+}
+
+func fakeDNSServer(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(fakeDNSAnswer(b[:n]), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func echoAddrServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(conn.LocalAddr().String()))
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+func TestExitResolver(t *testing.T) {
+	targetPort := echoAddrServer(t)
+	udpDNS := fakeDNSServer(t)
+	doh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(fakeDNSAnswer(b))
+	}))
+	defer doh.Close()
+	hosts := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(hosts, []byte("# static\n127.0.0.1 static.example\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, dns := range []string{udpDNS, doh.URL + "/dns-query"} {
+		serverAddr, teardown := startAccessServer(t, &chserver.Config{
+			KeySeed:       "exit-dns-test",
+			ExitDNS:       dns,
+			ExitHostsFile: hosts,
+		})
+		sc, _, _ := dialChiselSSH(t, serverAddr, "", "")
+		sendConfig(t, sc, nil)
+		for _, host := range []string{"fake.chisel.test", "static.example"} {
+			ch, reqs, err := sc.OpenChannel("chisel", []byte(host+":"+targetPort))
+			if err != nil {
+				t.Fatalf("%s: channel to %s rejected: %s", dns, host, err)
+			}
+			go ssh.DiscardRequests(reqs)
+			b, _ := io.ReadAll(ch)
+			ch.Close()
+			if string(b) != "127.0.0.1:"+targetPort {
+				t.Fatalf("%s: expected %s to resolve to 127.0.0.1, got %q", dns, host, b)
+			}
+		}
+		if ch, _, err := sc.OpenChannel("chisel", []byte("missing.example:"+targetPort)); err == nil {
+			ch.Close()
+			t.Fatalf("%s: expected unresolvable host to be rejected", dns)
+		}
+		sc.Close()
+		teardown()
+	}
+}
@@ -0,0 +1,146 @@
+package e2e_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	chclient "github.com/jpillora/chisel/client"
+	chserver "github.com/jpillora/chisel/server"
+	"github.com/jpillora/chisel/share/tunnel"
+)
+
+// balancer dials its current target, whatever
+// the address, like a load balancer would
+type balancer struct {
+	mu     sync.Mutex
+	target string
+}
+
+func (b *balancer) set(target string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.target = target
+}
+
+func (b *balancer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	b.mu.Lock()
+	target := b.target
+	b.mu.Unlock()
+	return (&net.Dialer{}).DialContext(ctx, network, target)
+}
+
+func startServer(t *testing.T, ctx context.Context) (*chserver.Server, string) {
+	s, err := chserver.NewServer(&chserver.Config{KeySeed: "drain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Debug = debug
+	port := availablePort()
+	if err := s.StartContext(ctx, "127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	return s, "127.0.0.1:" + port
+}
+
+func TestDrain(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoPort := echoServer(t)
+	localPort := availablePort()
+	//two servers behind a balancer
+	s1, addr1 := startServer(t, ctx)
+	s2, addr2 := startServer(t, ctx)
+	lb := &balancer{target: addr1}
+	events := &eventLog{}
+	hooked := make(chan error, 4)
+	c, err := chclient.NewClient(&chclient.Config{
+		Server:           "http://" + addr1,
+		Fingerprint:      s1.GetFingerprint(),
+		Remotes:          []string{localPort + ":" + echoPort},
+		DialContext:      lb.DialContext,
+		MaxRetryCount:    -1,
+		MaxRetryInterval: time.Second,
+		OnEvent:          events.add,
+		Hooks: chclient.Hooks{
+			Disconnect: func(err error) { hooked <- err },
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Debug = debug
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	conn1, err := net.Dial("tcp", "127.0.0.1:"+localPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn1.Close()
+	echoRoundTrip(t, conn1, "before")
+	//drain the first server, which the balancer no longer uses
+	lb.set(addr2)
+	drained := make(chan error, 1)
+	t0 := time.Now()
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		drained <- s1.Shutdown(ctx)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	resp, err := http.Get("http://" + addr1 + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected draining server to be unhealthy, got %d", resp.StatusCode)
+	}
+	//new connections use the second server
+	conn2, err := net.Dial("tcp", "127.0.0.1:"+localPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	echoRoundTrip(t, conn2, "after")
+	//the client records the drain as a disconnect
+	select {
+	case err := <-hooked:
+		if !errors.Is(err, tunnel.ErrDrained) {
+			t.Fatalf("expected the disconnect hook with %v, got %v", tunnel.ErrDrained, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the disconnect hook")
+	}
+	events.wait(t, tunnel.EventDisconnected, func(e tunnel.Event) bool {
+		return errors.Is(e.Err, tunnel.ErrDrained)
+	})
+	if st := c.Status(); !st.Connected || st.Reconnects != 1 || !st.Since.After(t0) {
+		t.Fatalf("expected the client to have reconnected after the drain, got %+v", st)
+	}
+	//while the open stream continues on the first
+	echoRoundTrip(t, conn1, "during")
+	select {
+	case <-drained:
+		t.Fatal("drained with an open stream")
+	default:
+	}
+	//which finishes draining once the stream closes
+	conn1.Close()
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected server to drain")
+	}
+	if d := time.Since(t0); d > 5*time.Second {
+		t.Fatalf("drain took %s", d)
+	}
+	echoRoundTrip(t, conn2, "still")
+	s2.Close()
+}
@@ -0,0 +1,152 @@
+package e2e_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	chclient "github.com/jpillora/chisel/client"
+	chserver "github.com/jpillora/chisel/server"
+	"github.com/jpillora/chisel/share/tunnel"
+)
+
+// eventLog records the events of a client or server
+type eventLog struct {
+	mu     sync.Mutex
+	events []tunnel.Event
+}
+
+func (l *eventLog) add(e tunnel.Event) {
+	l.mu.Lock()
+	l.events = append(l.events, e)
+	l.mu.Unlock()
+}
+
+// wait waits for an event of the type, matching the optional func
+func (l *eventLog) wait(t *testing.T, typ tunnel.EventType, match func(tunnel.Event) bool) tunnel.Event {
+	t.Helper()
+	for i := 0; i < 250; i++ {
+		l.mu.Lock()
+		for _, e := range l.events {
+			if e.Type == typ && (match == nil || match(e)) {
+				l.mu.Unlock()
+				return e
+			}
+		}
+		l.mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("expected %s event", typ)
+	return tunnel.Event{}
+}
+
+func TestEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sevents := &eventLog{}
+	s, err := chserver.NewServer(&chserver.Config{
+		KeySeed: "events",
+		Auth:    "foo:bar",
+		OnEvent: sevents.add,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Debug = debug
+	port := availablePort()
+	if err := s.StartContext(ctx, "127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	newClient := func(auth string, remotes []string, events *eventLog) {
+		c, err := chclient.NewClient(&chclient.Config{
+			Server:        "http://127.0.0.1:" + port,
+			Fingerprint:   s.GetFingerprint(),
+			Auth:          auth,
+			Remotes:       remotes,
+			MaxRetryCount: 0,
+			OnEvent:       events.add,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Debug = debug
+		if err := c.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//a connected client, with a local remote
+	cevents := &eventLog{}
+	local := availablePort()
+	target := echoServer(t)
+	newClient("foo:bar", []string{local + ":" + target}, cevents)
+	cevents.wait(t, tunnel.EventConnected, nil)
+	e := cevents.wait(t, tunnel.EventRemoteBound, nil)
+	if e.Remote != local+"=>"+target {
+		t.Fatalf("unexpected remote %q", e.Remote)
+	}
+	e = sevents.wait(t, tunnel.EventConnected, nil)
+	if e.User != "foo" || e.Session == "" || e.Addr != "127.0.0.1" {
+		t.Fatalf("unexpected session event %+v", e)
+	}
+	//a channel
+	conn, err := net.Dial("tcp", "127.0.0.1:"+local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoRoundTrip(t, conn, "hello")
+	conn.Close()
+	cevents.wait(t, tunnel.EventChannelOpened, nil)
+	e = cevents.wait(t, tunnel.EventChannelClosed, nil)
+	if e.Outbound || e.Sent != 5 || e.Received != 5 {
+		t.Fatalf("unexpected client channel event %+v", e)
+	}
+	e = sevents.wait(t, tunnel.EventChannelClosed, nil)
+	if !e.Outbound || e.User != "foo" || e.Target != "127.0.0.1:"+target || e.Sent != 5 || e.Received != 5 {
+		t.Fatalf("unexpected server channel event %+v", e)
+	}
+	//a compressed channel, whose target has no compression suffix
+	zlocal := availablePort()
+	zevents := &eventLog{}
+	newClient("foo:bar", []string{zlocal + ":" + target + "/zstd"}, zevents)
+	zevents.wait(t, tunnel.EventRemoteBound, nil)
+	conn, err = net.Dial("tcp", "127.0.0.1:"+zlocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoRoundTrip(t, conn, "hello")
+	conn.Close()
+	opened := zevents.wait(t, tunnel.EventChannelOpened, nil)
+	e = zevents.wait(t, tunnel.EventChannelClosed, nil)
+	if opened.Target != e.Target || e.Target != "127.0.0.1:"+target || e.Sent != 5 || e.Received != 5 {
+		t.Fatalf("unexpected compressed channel events %+v %+v", opened, e)
+	}
+	//each opened channel is closed
+	for _, l := range []*eventLog{cevents, zevents} {
+		l.mu.Lock()
+		n := 0
+		for _, e := range l.events {
+			switch e.Type {
+			case tunnel.EventChannelOpened:
+				n++
+			case tunnel.EventChannelClosed:
+				n--
+			}
+		}
+		l.mu.Unlock()
+		if n != 0 {
+			t.Fatalf("expected each opened channel to be closed, %d were not", n)
+		}
+	}
+	//a rejected login
+	aevents := &eventLog{}
+	newClient("foo:baz", []string{availablePort() + ":" + target}, aevents)
+	aevents.wait(t, tunnel.EventAuthFailed, nil)
+	sevents.wait(t, tunnel.EventAuthFailed, func(e tunnel.Event) bool { return e.User == "foo" })
+	//a rejected config, reverse remotes not being enabled
+	revents := &eventLog{}
+	newClient("foo:bar", []string{"R:" + availablePort() + ":" + target}, revents)
+	revents.wait(t, tunnel.EventConfigRejected, nil)
+	sevents.wait(t, tunnel.EventConfigRejected, func(e tunnel.Event) bool { return e.Err != nil })
+}
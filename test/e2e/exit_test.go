@@ -0,0 +1,246 @@
+package e2e_test
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	chserver "github.com/jpillora/chisel/server"
+	"github.com/jpillora/chisel/share/cio"
+	"github.com/jpillora/chisel/share/settings"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestExitDeny(t *testing.T) {
+	targetPort := availablePort()
+	listener, err := net.Listen("tcp", "127.0.0.1:"+targetPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	serverAddr, teardown := startAccessServer(t, &chserver.Config{
+		KeySeed:  "exit-deny-test",
+		Socks5:   true,
+		ExitDeny: []string{"127.0.0.0/8"},
+	})
+	defer teardown()
+	sc, _, _ := dialChiselSSH(t, serverAddr, "", "")
+	defer sc.Close()
+	r, err := settings.DecodeRemote("socks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendConfig(t, sc, []*settings.Remote{r})
+	//forward channel
+	if ch, _, err := sc.OpenChannel("chisel", []byte("localhost:"+targetPort)); err == nil {
+		ch.Close()
+		t.Fatalf("channel to denied exit was accepted")
+	}
+	if ch, _, err := sc.OpenChannel("chisel", []byte("127.0.0.1:"+targetPort+"/udp")); err == nil {
+		ch.Close()
+		t.Fatalf("udp channel to denied exit was accepted")
+	}
+	//socks channel
+	ch, reqs, err := sc.OpenChannel("chisel", []byte("socks"))
+	if err != nil {
+		t.Fatalf("socks channel rejected: %s", err)
+	}
+	go ssh.DiscardRequests(reqs)
+	defer ch.Close()
+	if rep := socksConnect(t, ch, "127.0.0.1", targetPort); rep != 2 {
+		t.Fatalf("expected socks rule failure (2), got %d", rep)
+	}
+}
+
+func TestExitAllow(t *testing.T) {
+	serverAddr, teardown := startAccessServer(t, &chserver.Config{
+		KeySeed:   "exit-allow-test",
+		ExitAllow: []string{"10.0.0.0/8"},
+	})
+	defer teardown()
+	sc, _, _ := dialChiselSSH(t, serverAddr, "", "")
+	defer sc.Close()
+	sendConfig(t, sc, nil)
+	if ch, _, err := sc.OpenChannel("chisel", []byte("127.0.0.1:"+availablePort())); err == nil {
+		ch.Close()
+		t.Fatalf("channel outside of allowed exits was accepted")
+	}
+}
+
+// socksConnect performs a SOCKS5 connect
+// and returns the server's reply code
+func socksConnect(t *testing.T, rw io.ReadWriter, ip, port string) byte {
+	t.Helper()
+	if _, err := rw.Write([]byte{5, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 10)
+	if _, err := io.ReadFull(rw, b[:2]); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	req := append([]byte{5, 1, 0, 1}, net.ParseIP(ip).To4()...)
+	req = binary.BigEndian.AppendUint16(req, uint16(p))
+	if _, err := rw.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(rw, b); err != nil {
+		t.Fatal(err)
+	}
+	return b[1]
+}
+
+func TestExitSource(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("requires the 127.0.0.0/8 loopback network")
+	}
+	targetPort := availablePort()
+	listener, err := net.Listen("tcp", "127.0.0.1:"+targetPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(settings.HostIP(conn.RemoteAddr().String()).String()))
+			conn.Close()
+		}
+	}()
+	serverAddr, teardown := startAccessServer(t, &chserver.Config{
+		KeySeed:       "exit-source-test",
+		ExitSource:    "127.0.0.2",
+		ExitInterface: "lo",
+	})
+	defer teardown()
+	sc, _, _ := dialChiselSSH(t, serverAddr, "", "")
+	defer sc.Close()
+	sendConfig(t, sc, nil)
+	ch, reqs, err := sc.OpenChannel("chisel", []byte("127.0.0.1:"+targetPort))
+	if err != nil {
+		t.Fatalf("channel rejected: %s", err)
+	}
+	go ssh.DiscardRequests(reqs)
+	defer ch.Close()
+	b, err := io.ReadAll(ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "127.0.0.2" {
+		t.Fatalf("expected source 127.0.0.2, got %q", b)
+	}
+}
+
+func TestExitProxy(t *testing.T) {
+	targetPort := availablePort()
+	listener, err := net.Listen("tcp", "127.0.0.1:"+targetPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("TARGET"))
+			conn.Close()
+		}
+	}()
+	//http connect proxy, recording each target
+	connects := make(chan string, 10)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		connects <- r.Host
+		dst, err := net.Dial("tcp", strings.Replace(r.Host, "target.test", "127.0.0.1", 1))
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		src, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			dst.Close()
+			return
+		}
+		src.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go cio.Pipe(src, dst)
+	}))
+	defer proxy.Close()
+	//destinations are resolved (by the hosts file) before
+	//the proxy and bypass decision, which uses the host name
+	hosts := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(hosts, []byte("127.0.0.1 target.test\n127.0.0.1 bypass.test\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	serverAddr, teardown := startAccessServer(t, &chserver.Config{
+		KeySeed:         "exit-proxy-test",
+		ExitProxy:       proxy.URL,
+		ExitProxyBypass: []string{"*.bypass.test", "bypass.test"},
+		ExitHostsFile:   hosts,
+	})
+	defer teardown()
+	sc, _, _ := dialChiselSSH(t, serverAddr, "", "")
+	defer sc.Close()
+	sendConfig(t, sc, nil)
+	read := func(addr string) string {
+		ch, reqs, err := sc.OpenChannel("chisel", []byte(addr))
+		if err != nil {
+			t.Fatalf("channel rejected: %s", err)
+		}
+		go ssh.DiscardRequests(reqs)
+		defer ch.Close()
+		b, err := io.ReadAll(ch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	//proxied
+	if s := read("127.0.0.1:" + targetPort); s != "TARGET" {
+		t.Fatalf("expected TARGET, got %q", s)
+	}
+	select {
+	case host := <-connects:
+		if host != "127.0.0.1:"+targetPort {
+			t.Fatalf("unexpected proxy target %s", host)
+		}
+	default:
+		t.Fatalf("expected connection via proxy")
+	}
+	//proxied by name
+	if s := read("target.test:" + targetPort); s != "TARGET" {
+		t.Fatalf("expected TARGET, got %q", s)
+	}
+	select {
+	case host := <-connects:
+		if host != "target.test:"+targetPort {
+			t.Fatalf("unexpected proxy target %s", host)
+		}
+	default:
+		t.Fatalf("expected connection via proxy")
+	}
+	//bypassed
+	if s := read("bypass.test:" + targetPort); s != "TARGET" {
+		t.Fatalf("expected TARGET, got %q", s)
+	}
+	select {
+	case host := <-connects:
+		t.Fatalf("expected bypass, got proxy connection to %s", host)
+	default:
+	}
+}
@@ -0,0 +1,119 @@
+package e2e_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	chclient "github.com/jpillora/chisel/client"
+	chserver "github.com/jpillora/chisel/server"
+)
+
+func TestHandoff(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("handoff requires SIGUSR1")
+	}
+	//the handoff starts the executable again, so use a real one
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "chisel")
+	if out, err := exec.Command("go", "build", "-o", bin, "github.com/jpillora/chisel").CombinedOutput(); err != nil {
+		t.Fatalf("build: %s\n%s", err, out)
+	}
+	logPath := filepath.Join(dir, "server.log")
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logFile.Close()
+	port := availablePort()
+	old := exec.Command(bin, "server", "--host", "127.0.0.1", "--port", port, "--key", "handoff")
+	old.Stdout = logFile
+	old.Stderr = logFile
+	if err := old.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer old.Process.Kill()
+	exited := make(chan struct{})
+	go func() {
+		old.Wait()
+		close(exited)
+	}()
+	waitStatus(t, "http://127.0.0.1:"+port+"/health", http.StatusOK)
+	//client of the old process
+	s, _ := chserver.NewServer(&chserver.Config{KeySeed: "handoff"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	echoPort := echoServer(t)
+	localPort := availablePort()
+	c, err := chclient.NewClient(&chclient.Config{
+		Server:           "http://127.0.0.1:" + port,
+		Fingerprint:      s.GetFingerprint(),
+		Remotes:          []string{localPort + ":" + echoPort},
+		MaxRetryCount:    -1,
+		MaxRetryInterval: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Debug = debug
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	conn1, err := net.Dial("tcp", "127.0.0.1:"+localPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn1.Close()
+	echoRoundTrip(t, conn1, "before")
+	//upgrade
+	if err := old.Process.Signal(syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	pid := 0
+	handedOff := regexp.MustCompile(`Handed off listener to process (\d+)`)
+	for i := 0; i < 100 && pid == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+		b, _ := os.ReadFile(logPath)
+		if m := handedOff.FindSubmatch(b); m != nil {
+			pid, _ = strconv.Atoi(string(m[1]))
+		}
+	}
+	if pid == 0 {
+		b, _ := os.ReadFile(logPath)
+		t.Fatalf("expected handoff, got log:\n%s", b)
+	}
+	defer syscall.Kill(pid, syscall.SIGKILL)
+	//the new process accepts the new connections
+	waitStatus(t, "http://127.0.0.1:"+port+"/health", http.StatusOK)
+	time.Sleep(200 * time.Millisecond)
+	conn2, err := net.Dial("tcp", "127.0.0.1:"+localPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	echoRoundTrip(t, conn2, "after")
+	//while the old process drains the open stream
+	echoRoundTrip(t, conn1, "during")
+	select {
+	case <-exited:
+		t.Fatal("old process exited with an open stream")
+	default:
+	}
+	conn1.Close()
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected old process to exit")
+	}
+	echoRoundTrip(t, conn2, "still")
+}
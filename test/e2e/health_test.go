@@ -0,0 +1,237 @@
+package e2e_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	chclient "github.com/jpillora/chisel/client"
+	chserver "github.com/jpillora/chisel/server"
+)
+
+func TestClientHealth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, addr := startServer(t, ctx)
+	echoPort := echoServer(t)
+	localPort := availablePort()
+	health := "127.0.0.1:" + availablePort()
+	c, err := chclient.NewClient(&chclient.Config{
+		Server:           "http://" + addr,
+		Fingerprint:      s.GetFingerprint(),
+		Remotes:          []string{localPort + ":" + echoPort},
+		KeepAlive:        100 * time.Millisecond,
+		MaxRetryCount:    -1,
+		MaxRetryInterval: time.Second,
+		Health:           health,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Debug = debug
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, "http://"+health+"/healthz", http.StatusOK)
+	waitStatus(t, "http://"+health+"/readyz", http.StatusOK)
+	//keepalive latency
+	time.Sleep(300 * time.Millisecond)
+	resp, err := http.Get("http://" + health + "/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := chclient.Status{}
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Connected || status.Latency <= 0 || status.Reconnects != 0 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+	if l := status.LatencyStats; l.Pings == 0 || l.Min > l.Avg || l.Avg > l.Max || l.Last != status.Latency {
+		t.Fatalf("unexpected latency %+v", l)
+	}
+	//the server does not ping without a keepalive
+	if l := s.Health().Latency; len(l) != 1 || l["session#1"].Pings != 0 {
+		t.Fatalf("unexpected server latency %+v", l)
+	}
+	if len(status.Remotes) != 1 || !status.Remotes[0].Listening {
+		t.Fatalf("unexpected remotes %+v", status.Remotes)
+	}
+	metrics := get(t, "http://"+health+"/metrics", "")
+	for _, m := range []string{"chisel_connected 1\n", "chisel_reconnects_total 0\n", `chisel_latency_seconds{stat="max"} `} {
+		if !strings.Contains(metrics, m) {
+			t.Fatalf("expected metric %q, got %s", m, metrics)
+		}
+	}
+	//disconnected
+	s.Shutdown(ctx)
+	waitStatus(t, "http://"+health+"/healthz", http.StatusServiceUnavailable)
+	if st := c.Status(); st.Connected || st.Latency != 0 {
+		t.Fatalf("unexpected status %+v", st)
+	}
+}
+
+func TestMaxLatency(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, addr := startServer(t, ctx)
+	//every ping exceeds the max latency
+	c, err := chclient.NewClient(&chclient.Config{
+		Server:           "http://" + addr,
+		Fingerprint:      s.GetFingerprint(),
+		Remotes:          []string{availablePort() + ":" + echoServer(t)},
+		KeepAlive:        50 * time.Millisecond,
+		MaxLatency:       time.Nanosecond,
+		MaxRetryCount:    -1,
+		MaxRetryInterval: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Debug = debug
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && c.Status().Reconnects == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if c.Status().Reconnects == 0 {
+		t.Fatal("expected the client to reconnect")
+	}
+}
+
+func TestServerHealth(t *testing.T) {
+	t.Setenv("CHISEL_HEALTH_CACHE", "1s")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend"))
+	}))
+	defer backend.Close()
+	authfile := filepath.Join(t.TempDir(), "users.json")
+	if err := os.WriteFile(authfile, []byte(`{"foo:bar": [""]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := chserver.NewServer(&chserver.Config{
+		KeySeed:    "health",
+		AuthFile:   authfile,
+		Proxy:      backend.URL,
+		HealthPath: "/chisel",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Debug = debug
+	port := availablePort()
+	if err := s.StartContext(ctx, "127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	url := "http://127.0.0.1:" + port
+	//health checks are served alongside the backend,
+	//which still receives its own health paths
+	waitStatus(t, url+"/chisel/healthz", http.StatusOK)
+	h := readyz(t, url, http.StatusOK)
+	if !h.Ready || !h.Listening || h.AuthFile == nil || !h.AuthFile.OK || h.Backend == nil || !h.Backend.OK {
+		t.Fatalf("unexpected health %+v", h)
+	}
+	for _, p := range []string{"/health", "/healthz", "/readyz"} {
+		if b := get(t, url+p, ""); b != "backend" {
+			t.Fatalf("expected %s to be proxied, got %q", p, b)
+		}
+	}
+	//without credentials, only the status is sent
+	if b := get(t, url+"/chisel/readyz", ""); b != "" {
+		t.Fatalf("expected no health without credentials, got %q", b)
+	}
+	if b := get(t, url+"/chisel/readyz", "foo:baz"); b != "" {
+		t.Fatalf("expected no health with the wrong password, got %q", b)
+	}
+	if b := get(t, url+"/chisel/metrics", ""); b != "" {
+		t.Fatalf("expected no metrics without credentials, got %q", b)
+	}
+	if b := get(t, url+"/chisel/metrics", "foo:bar"); !strings.Contains(b, "chisel_sessions 0\n") {
+		t.Fatalf("expected metrics, got %q", b)
+	}
+	//failed authfile reload
+	if err := os.WriteFile(authfile, []byte(`{`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, url+"/chisel/readyz", http.StatusServiceUnavailable)
+	if h := readyz(t, url, http.StatusServiceUnavailable); h.AuthFile.OK || !h.Backend.OK {
+		t.Fatalf("unexpected health %+v", h)
+	}
+	if err := os.WriteFile(authfile, []byte(`{"foo:bar": [""]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitStatus(t, url+"/chisel/readyz", http.StatusOK)
+	//unreachable backend, once the cached check expires
+	backend.Close()
+	waitStatus(t, url+"/chisel/readyz", http.StatusServiceUnavailable)
+	if h := readyz(t, url, http.StatusServiceUnavailable); !h.AuthFile.OK || h.Backend.OK {
+		t.Fatalf("unexpected health %+v", h)
+	}
+	waitStatus(t, url+"/chisel/healthz", http.StatusOK)
+}
+
+// get returns the body of url, with the optional basic auth
+func get(t *testing.T, url, auth string) string {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	if user, pass, ok := strings.Cut(auth, ":"); ok {
+		req.SetBasicAuth(user, pass)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return string(b)
+}
+
+// readyz returns the health of the server, as user foo, expecting status
+func readyz(t *testing.T, url string, status int) chserver.Health {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url+"/chisel/readyz", nil)
+	req.SetBasicAuth("foo", "bar")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		t.Fatalf("expected /readyz to respond with %d, got %d", status, resp.StatusCode)
+	}
+	h := chserver.Health{}
+	if err := json.NewDecoder(resp.Body).Decode(&h); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// waitStatus waits for url to respond with status
+func waitStatus(t *testing.T, url string, status int) {
+	t.Helper()
+	got := 0
+	for i := 0; i < 100; i++ {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			if got = resp.StatusCode; got == status {
+				return
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("expected %s to respond with %d, got %d", url, status, got)
+}
@@ -0,0 +1,183 @@
+package e2e_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	chclient "github.com/jpillora/chisel/client"
+	"github.com/jpillora/chisel/share/cnet"
+)
+
+// freezableDialer can freeze the client's connections, whose
+// reads then block, like half-open connections whose NAT
+// mapping was dropped
+type freezableDialer struct {
+	mu    sync.Mutex
+	conns []*frozenConn
+}
+
+type frozenConn struct {
+	net.Conn
+	frozen, closed chan struct{}
+	once           sync.Once
+}
+
+func (c *frozenConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	select {
+	case <-c.frozen:
+		<-c.closed
+		return 0, net.ErrClosed
+	default:
+	}
+	return n, err
+}
+
+func (c *frozenConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func (d *freezableDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &frozenConn{Conn: conn, frozen: make(chan struct{}), closed: make(chan struct{})}
+	d.mu.Lock()
+	d.conns = append(d.conns, c)
+	d.mu.Unlock()
+	return c, nil
+}
+
+func (d *freezableDialer) freeze() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, c := range d.conns {
+		close(c.frozen)
+	}
+	d.conns = nil
+}
+
+func TestKeepAliveTimeout(t *testing.T) {
+	t.Setenv("CHISEL_WS_PING", "50ms")
+	for _, tc := range []struct {
+		transport string
+		keepAlive time.Duration
+	}{
+		//detected by missed keepalive pings
+		{"tcp", 50 * time.Millisecond},
+		//detected by missed websocket pongs, before the first ping
+		{"websocket", time.Hour},
+	} {
+		t.Run(tc.transport, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			s, addr := startServer(t, ctx)
+			d := &freezableDialer{}
+			c, err := chclient.NewClient(&chclient.Config{
+				Server:           "http://" + addr,
+				Fingerprint:      s.GetFingerprint(),
+				Remotes:          []string{availablePort() + ":" + echoServer(t)},
+				Transport:        tc.transport,
+				DialContext:      d.DialContext,
+				KeepAlive:        tc.keepAlive,
+				KeepAliveTimeout: 100 * time.Millisecond,
+				KeepAliveMisses:  1,
+				MaxRetryCount:    -1,
+				MaxRetryInterval: time.Second,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Debug = debug
+			if err := c.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 100 && !c.Status().Connected; i++ {
+				time.Sleep(20 * time.Millisecond)
+			}
+			d.freeze()
+			t0 := time.Now()
+			for i := 0; i < 150 && c.Status().Reconnects == 0; i++ {
+				time.Sleep(20 * time.Millisecond)
+			}
+			if c.Status().Reconnects == 0 {
+				t.Fatal("expected the client to detect the frozen connection")
+			}
+			if d := time.Since(t0); d > 2*time.Second {
+				t.Fatalf("detection took %s", d)
+			}
+		})
+	}
+}
+
+func TestWebSocketKeepAliveMisses(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		late func(ping int64) bool
+		open bool
+	}{
+		//a single missed pong is allowed
+		{"one late pong", func(ping int64) bool { return ping == 1 }, true},
+		//late pongs do not answer the following pings
+		{"all late pongs", func(int64) bool { return true }, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pings := int64(0)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer ws.Close()
+				ws.SetPingHandler(func(data string) error {
+					delay := time.Duration(0)
+					if tc.late(atomic.AddInt64(&pings, 1)) {
+						delay = 150 * time.Millisecond
+					}
+					time.AfterFunc(delay, func() {
+						ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+					})
+					return nil
+				})
+				for {
+					if _, _, err := ws.ReadMessage(); err != nil {
+						return
+					}
+				}
+			}))
+			defer server.Close()
+			ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn := cnet.NewWebSocketConn(ws)
+			defer conn.Close()
+			go cnet.WebSocketKeepAlive(conn, 20*time.Millisecond, 100*time.Millisecond, 1)
+			closed := make(chan struct{})
+			go func() {
+				conn.Read(make([]byte, 1))
+				close(closed)
+			}()
+			select {
+			case <-closed:
+				if tc.open {
+					t.Fatal("expected the connection to stay open")
+				}
+			case <-time.After(time.Second):
+				if !tc.open {
+					t.Fatal("expected the connection to be closed")
+				}
+			}
+		})
+	}
+}
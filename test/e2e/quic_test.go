@@ -0,0 +1,76 @@
+package e2e_test
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	chclient "github.com/jpillora/chisel/client"
+	chserver "github.com/jpillora/chisel/server"
+)
+
+func TestQUIC(t *testing.T) {
+	tlsConfig, err := newTestTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsConfig.Close()
+	for _, useTLS := range []bool{false, true} {
+		name := "self-signed"
+		if useTLS {
+			name = "tls"
+		}
+		t.Run(name, func(t *testing.T) {
+			echoPort := udpEchoServer(t)
+			tcpPort := availablePort()
+			udpPort := availableUDPPort()
+			s := &chserver.Config{QUIC: true}
+			c := &chclient.Config{
+				Remotes: []string{
+					tcpPort + ":$FILEPORT",
+					"127.0.0.1:" + udpPort + ":127.0.0.1:" + echoPort + "/udp",
+				},
+				Transport: "quic",
+			}
+			if useTLS {
+				s.TLS = *tlsConfig.serverTLS
+				c.TLS = *tlsConfig.clientTLS
+			}
+			teardown := simpleSetup(t, s, c)
+			defer teardown()
+			//tcp remotes use streams
+			for _, body := range []string{"foo", "bar"} {
+				result, err := post("http://localhost:"+tcpPort, body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if result != body+"!" {
+					t.Fatalf("expected exclamation mark added, got %q", result)
+				}
+			}
+			//udp remotes use datagrams, or the stream
+			//for packets too large for a datagram
+			conn, err := net.Dial("udp", "127.0.0.1:"+udpPort)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			for _, size := range []int{4, 1000, 4000} {
+				sent := bytes.Repeat([]byte{'x'}, size)
+				if _, err := conn.Write(sent); err != nil {
+					t.Fatal(err)
+				}
+				b := make([]byte, 9000)
+				conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+				n, err := conn.Read(b)
+				if err != nil {
+					t.Fatalf("%d byte packet: %s", size, err)
+				}
+				if !bytes.Equal(b[:n], sent) {
+					t.Fatalf("%d byte packet: received %d bytes", size, n)
+				}
+			}
+		})
+	}
+}
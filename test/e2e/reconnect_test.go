@@ -0,0 +1,105 @@
+package e2e_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	chclient "github.com/jpillora/chisel/client"
+	chserver "github.com/jpillora/chisel/server"
+)
+
+func TestReconnectHooks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, addr := startServer(t, ctx)
+	events := make(chan string, 10)
+	c, err := chclient.NewClient(&chclient.Config{
+		Server:      "http://" + addr,
+		Fingerprint: s.GetFingerprint(),
+		Remotes:     []string{availablePort() + ":" + echoServer(t)},
+		//only Reconnect retries in time
+		MinRetryInterval: time.Hour,
+		MaxRetryInterval: time.Hour,
+		MaxRetryCount:    -1,
+		Hooks: chclient.Hooks{
+			Connect:    func() { events <- "connect" },
+			Disconnect: func(err error) { events <- "disconnect" },
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Debug = debug
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, events, "connect")
+	//server restarts on the same address
+	s.Shutdown(ctx)
+	expectEvent(t, events, "disconnect")
+	//until the client waits to retry
+	time.Sleep(200 * time.Millisecond)
+	s2, err := chserver.NewServer(&chserver.Config{KeySeed: "drain"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.StartContext(ctx, "127.0.0.1", addr[len("127.0.0.1:"):]); err != nil {
+		t.Fatal(err)
+	}
+	c.Reconnect()
+	expectEvent(t, events, "connect")
+}
+
+func TestGiveUpHooks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := chserver.NewServer(&chserver.Config{KeySeed: "hooks", Auth: "foo:bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := availablePort()
+	if err := s.StartContext(ctx, "127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan string, 10)
+	c, err := chclient.NewClient(&chclient.Config{
+		Server:           "http://127.0.0.1:" + port,
+		Fingerprint:      s.GetFingerprint(),
+		Auth:             "foo:baz",
+		Remotes:          []string{availablePort() + ":" + echoServer(t)},
+		MinRetryInterval: 10 * time.Millisecond,
+		RetryFactor:      1.5,
+		RetryJitter:      true,
+		MaxRetryCount:    2,
+		Hooks: chclient.Hooks{
+			Connect:     func() { events <- "connect" },
+			AuthFailure: func(err error) { events <- "auth-failure" },
+			GiveUp:      func(err error) { events <- "give-up" },
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Debug = debug
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		expectEvent(t, events, "auth-failure")
+	}
+	expectEvent(t, events, "give-up")
+}
+
+// expectEvent waits for the next event, expecting it to be want
+func expectEvent(t *testing.T, events <-chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-events:
+		if got != want {
+			t.Fatalf("expected %s event, got %s", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected %s event", want)
+	}
+}
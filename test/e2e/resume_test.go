@@ -0,0 +1,306 @@
+package e2e_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	chclient "github.com/jpillora/chisel/client"
+	chserver "github.com/jpillora/chisel/server"
+	chshare "github.com/jpillora/chisel/share"
+	"github.com/jpillora/chisel/share/cnet"
+)
+
+// droppableDialer records its connections, so
+// that tests can drop the client's transport,
+// and the resume headers the client sent
+type droppableDialer struct {
+	mu     sync.Mutex
+	conns  []net.Conn
+	block  bool
+	proofs []string
+	//src is the optional source IP of new connections
+	src string
+}
+
+func (d *droppableDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.block {
+		return nil, io.ErrClosedPipe
+	}
+	nd := &net.Dialer{}
+	if d.src != "" {
+		nd.LocalAddr = &net.TCPAddr{IP: net.ParseIP(d.src)}
+	}
+	conn, err := nd.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn = &proofConn{Conn: conn, d: d}
+	d.conns = append(d.conns, conn)
+	return conn, nil
+}
+
+// proofConn records the resume header of the request it sends
+type proofConn struct {
+	net.Conn
+	d *droppableDialer
+}
+
+func (c *proofConn) Write(b []byte) (int, error) {
+	prefix := []byte(cnet.ResumeHeader + ": ")
+	if i := bytes.Index(b, prefix); i >= 0 {
+		line := b[i+len(prefix):]
+		if j := bytes.IndexByte(line, '\r'); j >= 0 {
+			c.d.mu.Lock()
+			c.d.proofs = append(c.d.proofs, string(line[:j]))
+			c.d.mu.Unlock()
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+func (d *droppableDialer) drop(block bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, c := range d.conns {
+		c.Close()
+	}
+	d.conns = nil
+	d.block = block
+}
+
+func echoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+func echoRoundTrip(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != msg {
+		t.Fatalf("expected %q, got %q (%v)", msg, b, err)
+	}
+}
+
+func TestResumeSession(t *testing.T) {
+	for _, transport := range []string{"websocket", "http2", "poll", "tcp"} {
+		t.Run(transport, func(t *testing.T) {
+			echoPort := echoServer(t)
+			localPort := availablePort()
+			dialer := &droppableDialer{}
+			teardown := simpleSetup(t,
+				&chserver.Config{ResumeGrace: 5 * time.Second},
+				&chclient.Config{
+					Remotes:          []string{localPort + ":" + echoPort},
+					Transport:        transport,
+					Resume:           true,
+					DialContext:      dialer.DialContext,
+					MaxRetryCount:    -1,
+					MaxRetryInterval: time.Second,
+				},
+			)
+			defer teardown()
+			conn, err := net.Dial("tcp", "127.0.0.1:"+localPort)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			echoRoundTrip(t, conn, "before")
+			//drop the transport, the same tcp connection continues
+			for i := 0; i < 3; i++ {
+				dialer.drop(false)
+				echoRoundTrip(t, conn, "after drop")
+			}
+		})
+	}
+}
+
+func TestResumeSessionExpired(t *testing.T) {
+	echoPort := echoServer(t)
+	localPort := availablePort()
+	dialer := &droppableDialer{}
+	teardown := simpleSetup(t,
+		&chserver.Config{ResumeGrace: 200 * time.Millisecond},
+		&chclient.Config{
+			Remotes:          []string{localPort + ":" + echoPort},
+			Resume:           true,
+			DialContext:      dialer.DialContext,
+			MaxRetryCount:    -1,
+			MaxRetryInterval: time.Second,
+		},
+	)
+	defer teardown()
+	conn, err := net.Dial("tcp", "127.0.0.1:"+localPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echoRoundTrip(t, conn, "before")
+	//stay disconnected past the grace period
+	dialer.drop(true)
+	time.Sleep(500 * time.Millisecond)
+	dialer.drop(false)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected expired session to close connection, got %v", err)
+	}
+	//new connections use a new session
+	conn2, err := net.Dial("tcp", "127.0.0.1:"+localPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	echoRoundTrip(t, conn2, "new session")
+}
+
+func TestResumeDeniedIP(t *testing.T) {
+	echoPort := echoServer(t)
+	localPort := availablePort()
+	authfile := filepath.Join(t.TempDir(), "users.json")
+	users := `{"foo:bar": {"addrs": [""], "allow-ip": ["127.0.0.1/32"]}}`
+	if err := os.WriteFile(authfile, []byte(users), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dialer := &droppableDialer{}
+	teardown := simpleSetup(t,
+		&chserver.Config{AuthFile: authfile, ResumeGrace: 5 * time.Second},
+		&chclient.Config{
+			Auth:             "foo:bar",
+			Remotes:          []string{localPort + ":" + echoPort},
+			Resume:           true,
+			DialContext:      dialer.DialContext,
+			MaxRetryCount:    -1,
+			MaxRetryInterval: time.Second,
+		},
+	)
+	defer teardown()
+	conn, err := net.Dial("tcp", "127.0.0.1:"+localPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echoRoundTrip(t, conn, "before")
+	//reconnecting from a network the user is denied
+	//from does not resume the session
+	dialer.mu.Lock()
+	dialer.src = "127.0.0.2"
+	dialer.mu.Unlock()
+	dialer.drop(false)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the session not to resume, got %v", err)
+	}
+}
+
+func TestResumeProof(t *testing.T) {
+	//one resumable session per client ip
+	t.Setenv("CHISEL_RESUME_SESSIONS", "1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := chserver.NewServer(&chserver.Config{KeySeed: "resume", ResumeGrace: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Debug = debug
+	port := availablePort()
+	if err := s.StartContext(ctx, "127.0.0.1", port); err != nil {
+		t.Fatal(err)
+	}
+	echoPort := echoServer(t)
+	newClient := func(d *droppableDialer) string {
+		localPort := availablePort()
+		c, err := chclient.NewClient(&chclient.Config{
+			Server:           "http://127.0.0.1:" + port,
+			Fingerprint:      s.GetFingerprint(),
+			Remotes:          []string{localPort + ":" + echoPort},
+			Resume:           true,
+			DialContext:      d.DialContext,
+			MaxRetryCount:    -1,
+			MaxRetryInterval: time.Second,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Debug = debug
+		if err := c.Start(ctx); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100 && !c.Status().Connected; i++ {
+			time.Sleep(20 * time.Millisecond)
+		}
+		return localPort
+	}
+	d := &droppableDialer{}
+	conn, err := net.Dial("tcp", "127.0.0.1:"+newClient(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echoRoundTrip(t, conn, "before")
+	d.drop(false)
+	echoRoundTrip(t, conn, "after drop")
+	d.mu.Lock()
+	proofs := append([]string(nil), d.proofs...)
+	d.mu.Unlock()
+	if len(proofs) < 2 || proofs[0] != cnet.ResumeNew {
+		t.Fatalf("unexpected resume headers %q", proofs)
+	}
+	//neither a used proof, nor a forged one, resume the session
+	used := proofs[len(proofs)-1]
+	forged := used[:strings.LastIndexByte(used, '.')+1] + strings.Repeat("0", 64)
+	for _, proof := range []string{used, forged} {
+		h := http.Header{}
+		h.Set(cnet.ResumeHeader, proof)
+		ws, resp, err := (&websocket.Dialer{Subprotocols: []string{chshare.ProtocolVersion}}).Dial("ws://127.0.0.1:"+port, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ws.Close()
+		if status := resp.Header.Get(cnet.ResumeHeader); status != cnet.ResumeNew {
+			t.Fatalf("expected proof %q to be refused, got %q", proof, status)
+		}
+	}
+	echoRoundTrip(t, conn, "after replay")
+	//a second session from the same ip is not resumable
+	d2 := &droppableDialer{}
+	conn2, err := net.Dial("tcp", "127.0.0.1:"+newClient(d2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	echoRoundTrip(t, conn2, "second")
+	d2.drop(false)
+	conn2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn2.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the second session to end, got %v", err)
+	}
+}
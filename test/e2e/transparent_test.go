@@ -0,0 +1,172 @@
+package e2e_test
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	chclient "github.com/jpillora/chisel/client"
+	chserver "github.com/jpillora/chisel/server"
+)
+
+func TestTransparentDirect(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("transparent remotes are linux only")
+	}
+	port := availablePort()
+	teardown := simpleSetup(t,
+		&chserver.Config{},
+		&chclient.Config{
+			Remotes: []string{"127.0.0.1:" + port + ":transparent"},
+		},
+	)
+	defer teardown()
+	//connections which were not redirected by iptables
+	//have no original destination, and must not loop back
+	conn, err := net.Dial("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected direct connection to be closed, got %d bytes (%v)", n, err)
+	}
+}
+
+// transparentEcho replies to each tcp connection and
+// udp packet with the address of the peer, run by python3
+// inside the destination network namespace
+const transparentEcho = `
+import socket, threading
+u = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+u.bind(("10.98.2.2", 8081))
+def udp():
+    while True:
+        b, a = u.recvfrom(64)
+        u.sendto(a[0].encode(), a)
+threading.Thread(target=udp, daemon=True).start()
+s = socket.socket()
+s.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+s.bind(("10.98.2.2", 8080))
+s.listen()
+while True:
+    c, a = s.accept()
+    c.sendall(a[0].encode())
+    c.close()
+`
+
+// transparentClient connects from the source network namespace
+// to the echo servers, printing the address each saw the client
+// as, and the source address of the udp reply
+const transparentClient = `
+import socket
+s = socket.create_connection(("10.98.2.2", 8080), timeout=3)
+print(s.recv(64).decode())
+u = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+u.settimeout(3)
+u.sendto(b"x", ("10.98.2.2", 8081))
+b, a = u.recvfrom(64)
+print(b.decode(), a[0], a[1])
+`
+
+func TestTransparentRedirect(t *testing.T) {
+	if runtime.GOOS != "linux" || os.Geteuid() != 0 {
+		t.Skip("transparent redirects require linux and root")
+	}
+	for _, bin := range []string{"ip", "iptables", "python3"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("transparent test requires %s", bin)
+		}
+	}
+	port := availablePort()
+	//the source namespace chtp (10.98.0.2) routes the destination
+	//namespace chtpd (10.98.2.2) via this host, which redirects tcp
+	//with REDIRECT and udp with TPROXY to the transparent remote
+	redirect := [][]string{
+		{"-t", "nat", "PREROUTING", "-i", "chp0", "-p", "tcp", "-d", "10.98.2.2", "--dport", "8080",
+			"-j", "REDIRECT", "--to-ports", port},
+		{"-t", "mangle", "PREROUTING", "-i", "chp0", "-p", "udp", "-d", "10.98.2.2", "--dport", "8081",
+			"-j", "TPROXY", "--on-port", port, "--tproxy-mark", "0x1/0x1"},
+	}
+	iptables := func(op string, rule []string) []string {
+		return append([]string{"iptables", rule[0], rule[1], op}, rule[2:]...)
+	}
+	setup := [][]string{
+		{"ip", "netns", "add", "chtp"},
+		{"ip", "netns", "add", "chtpd"},
+		{"ip", "link", "add", "chp0", "type", "veth", "peer", "name", "chp1"},
+		{"ip", "link", "set", "chp1", "netns", "chtp"},
+		{"ip", "addr", "add", "10.98.0.1/30", "dev", "chp0"},
+		{"ip", "link", "set", "chp0", "up"},
+		{"ip", "-n", "chtp", "addr", "add", "10.98.0.2/30", "dev", "chp1"},
+		{"ip", "-n", "chtp", "link", "set", "chp1", "up"},
+		{"ip", "-n", "chtp", "route", "add", "10.98.2.0/24", "via", "10.98.0.1"},
+		{"ip", "link", "add", "chp2", "type", "veth", "peer", "name", "chp3"},
+		{"ip", "link", "set", "chp3", "netns", "chtpd"},
+		{"ip", "addr", "add", "10.98.2.1/30", "dev", "chp2"},
+		{"ip", "link", "set", "chp2", "up"},
+		{"ip", "-n", "chtpd", "addr", "add", "10.98.2.2/30", "dev", "chp3"},
+		{"ip", "-n", "chtpd", "link", "set", "chp3", "up"},
+		iptables("-A", redirect[0]),
+		iptables("-A", redirect[1]),
+		{"ip", "rule", "add", "fwmark", "1", "lookup", "199"},
+		{"ip", "route", "add", "local", "0.0.0.0/0", "dev", "lo", "table", "199"},
+	}
+	t.Cleanup(func() {
+		for _, args := range [][]string{
+			{"ip", "route", "del", "local", "0.0.0.0/0", "dev", "lo", "table", "199"},
+			{"ip", "rule", "del", "fwmark", "1", "lookup", "199"},
+			iptables("-D", redirect[1]),
+			iptables("-D", redirect[0]),
+			{"ip", "netns", "del", "chtpd"},
+			{"ip", "netns", "del", "chtp"},
+		} {
+			exec.Command(args[0], args[1:]...).Run()
+		}
+	})
+	for _, args := range setup {
+		if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+			t.Skipf("redirects unavailable: %v: %s", args, out)
+		}
+	}
+	echo := exec.Command("ip", "netns", "exec", "chtpd", "python3", "-c", transparentEcho)
+	if err := echo.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { echo.Process.Kill(); echo.Wait() })
+	teardown := simpleSetup(t,
+		&chserver.Config{},
+		&chclient.Config{
+			Remotes: []string{"0.0.0.0:" + port + ":transparent"},
+		},
+	)
+	defer teardown()
+	time.Sleep(300 * time.Millisecond) //python startup
+	out, err := exec.Command("ip", "netns", "exec", "chtp", "python3", "-c", transparentClient).CombinedOutput()
+	if err != nil {
+		t.Fatalf("client: %s: %s", err, out)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected client output %q", out)
+	}
+	//both reached the destination from this host, via the
+	//tunnel, rather than being forwarded from the namespace
+	if lines[0] != "10.98.2.1" {
+		t.Fatalf("expected the tcp connection from 10.98.2.1, got %s", lines[0])
+	}
+	fields := strings.Fields(lines[1])
+	if len(fields) != 3 || fields[0] != "10.98.2.1" {
+		t.Fatalf("expected the udp packet from 10.98.2.1, got %q", lines[1])
+	}
+	//udp replies appear to come from the original destination
+	if fields[1] != "10.98.2.2" || fields[2] != "8081" {
+		t.Fatalf("expected the udp reply from 10.98.2.2:8081, got %s:%s", fields[1], fields[2])
+	}
+}
@@ -0,0 +1,111 @@
+package e2e_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"testing"
+
+	chclient "github.com/jpillora/chisel/client"
+	chserver "github.com/jpillora/chisel/server"
+)
+
+func TestTransports(t *testing.T) {
+	tlsConfig, err := newTestTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsConfig.Close()
+	for _, transport := range []string{"websocket", "http2", "poll", "tcp"} {
+		for _, useTLS := range []bool{false, true} {
+			name := transport
+			if useTLS {
+				name += "+tls"
+			}
+			t.Run(name, func(t *testing.T) {
+				tmpPort := availablePort()
+				s := &chserver.Config{}
+				c := &chclient.Config{
+					Remotes:   []string{tmpPort + ":$FILEPORT"},
+					Transport: transport,
+				}
+				if useTLS {
+					s.TLS = *tlsConfig.serverTLS
+					c.TLS = *tlsConfig.clientTLS
+				}
+				teardown := simpleSetup(t, s, c)
+				defer teardown()
+				for _, body := range []string{"foo", "bar"} {
+					result, err := post("http://localhost:"+tmpPort, body)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if result != body+"!" {
+						t.Fatalf("expected exclamation mark added, got %q", result)
+					}
+				}
+			})
+		}
+	}
+}
+
+// upgradeStripper is an HTTP/1 reverse proxy which strips
+// websocket upgrades, in front of the server dialed
+type upgradeStripper struct {
+	mu     sync.Mutex
+	target string
+	addr   string
+}
+
+func newUpgradeStripper(t *testing.T) *upgradeStripper {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &upgradeStripper{addr: l.Addr().String()}
+	proxy := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			s.mu.Lock()
+			r.URL.Scheme = "http"
+			r.URL.Host = s.target
+			s.mu.Unlock()
+			r.Header.Del("Upgrade")
+			r.Header.Del("Connection")
+		},
+	}
+	server := &http.Server{Handler: proxy}
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+	return s
+}
+
+func (s *upgradeStripper) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	s.mu.Lock()
+	s.target = addr
+	s.mu.Unlock()
+	return (&net.Dialer{}).DialContext(ctx, network, s.addr)
+}
+
+func TestTransportFallback(t *testing.T) {
+	tmpPort := availablePort()
+	//websockets are stripped, and http2 is not
+	//spoken by the proxy, so the client falls back
+	//to long-polling
+	stripper := newUpgradeStripper(t)
+	teardown := simpleSetup(t,
+		&chserver.Config{},
+		&chclient.Config{
+			Remotes:     []string{tmpPort + ":$FILEPORT"},
+			DialContext: stripper.DialContext,
+		})
+	defer teardown()
+	result, err := post("http://localhost:"+tmpPort, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "foo!" {
+		t.Fatalf("expected exclamation mark added, got %q", result)
+	}
+}
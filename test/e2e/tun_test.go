@@ -0,0 +1,117 @@
+package e2e_test
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+
+	chclient "github.com/jpillora/chisel/client"
+	chserver "github.com/jpillora/chisel/server"
+	"github.com/jpillora/chisel/share/tunnel"
+)
+
+// tunEcho is a tcp and udp echo server, run
+// by python3 inside a network namespace
+const tunEcho = `
+import socket, threading
+u = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+u.bind(("10.99.0.2", 8081))
+def udp():
+    while True:
+        b, a = u.recvfrom(2048)
+        u.sendto(b, a)
+threading.Thread(target=udp, daemon=True).start()
+s = socket.socket()
+s.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+s.bind(("10.99.0.2", 8080))
+s.listen()
+while True:
+    c, _ = s.accept()
+    c.sendall(c.recv(2048))
+    c.close()
+`
+
+// setupTunNetns creates a network namespace reachable at
+// 10.99.0.2 via the veth interface chv0 (10.99.0.1)
+func setupTunNetns(t *testing.T) {
+	if runtime.GOOS != "linux" || os.Geteuid() != 0 {
+		t.Skip("tun requires linux and root")
+	}
+	for _, bin := range []string{"ip", "python3"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			t.Skipf("tun test requires %s", bin)
+		}
+	}
+	run := func(args ...string) {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			t.Skipf("network namespaces unavailable: ip %v: %s", args, out)
+		}
+	}
+	run("netns", "add", "chtun")
+	t.Cleanup(func() { exec.Command("ip", "netns", "del", "chtun").Run() })
+	run("link", "add", "chv0", "type", "veth", "peer", "name", "chv1")
+	run("link", "set", "chv1", "netns", "chtun")
+	run("addr", "add", "10.99.0.1/30", "dev", "chv0")
+	run("link", "set", "chv0", "up")
+	run("-n", "chtun", "addr", "add", "10.99.0.2/30", "dev", "chv1")
+	run("-n", "chtun", "link", "set", "chv1", "up")
+	echo := exec.Command("ip", "netns", "exec", "chtun", "python3", "-c", tunEcho)
+	if err := echo.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { echo.Process.Kill(); echo.Wait() })
+}
+
+func TestTun(t *testing.T) {
+	setupTunNetns(t)
+	//the server reaches the namespace via the veth, while the
+	//client routes the namespace address into its tun interface
+	teardown := simpleSetup(t,
+		&chserver.Config{ExitInterface: "chv0", ExitDeny: []string{"10.99.0.3"}},
+		&chclient.Config{
+			Tun: tunnel.TunConfig{Name: "chtun0", Routes: []string{"10.99.0.2/32", "10.99.0.3/32"}},
+		},
+	)
+	defer teardown()
+	for i := 0; i < 50; i++ {
+		if _, err := net.InterfaceByName("chtun0"); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	time.Sleep(300 * time.Millisecond) //python startup
+	//tcp
+	conn, err := net.DialTimeout("tcp", "10.99.0.2:8080", 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte("hello"))
+	b, err := io.ReadAll(conn)
+	conn.Close()
+	if string(b) != "hello" {
+		t.Fatalf("expected tcp echo, got %q (%v)", b, err)
+	}
+	//udp
+	uconn, err := net.Dial("udp", "10.99.0.2:8081")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uconn.Close()
+	uconn.Write([]byte("ping"))
+	uconn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	ub := make([]byte, 16)
+	n, err := uconn.Read(ub)
+	if err != nil || string(ub[:n]) != "ping" {
+		t.Fatalf("expected udp echo, got %q (%v)", ub[:n], err)
+	}
+	//connections the server denies are reset
+	if conn, err := net.DialTimeout("tcp", "10.99.0.3:8080", 2*time.Second); err == nil {
+		conn.Close()
+		t.Fatal("expected denied connection to be refused")
+	}
+}
@@ -1,13 +1,18 @@
 package e2e_test
 
 import (
+	"context"
+	"fmt"
+	"hash/fnv"
 	"log"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
 	chclient "github.com/jpillora/chisel/client"
 	chserver "github.com/jpillora/chisel/server"
+	"github.com/jpillora/chisel/share/tunnel"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -73,6 +78,237 @@ func TestUDP(t *testing.T) {
 	}
 }
 
+func TestUDPFraming(t *testing.T) {
+	echoPort := udpEchoServer(t)
+	//gob (older peers) and the current framing
+	for _, version := range []string{"0", "1"} {
+		t.Run("v"+version, func(t *testing.T) {
+			t.Setenv("CHISEL_UDP_FRAMING", version)
+			inboundPort := availableUDPPort()
+			teardown := simpleSetup(t,
+				&chserver.Config{},
+				&chclient.Config{
+					Remotes: []string{
+						"127.0.0.1:" + inboundPort + ":127.0.0.1:" + echoPort + "/udp",
+					},
+				},
+			)
+			defer teardown()
+			//each client is a flow, sending its source once
+			for i := 0; i < 3; i++ {
+				conn, err := net.Dial("udp", "127.0.0.1:"+inboundPort)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				for _, msg := range []string{"foo", "bar", ""} {
+					sent := fmt.Sprintf("%d%s", i, msg)
+					if _, err := conn.Write([]byte(sent)); err != nil {
+						t.Fatal(err)
+					}
+					b := make([]byte, 128)
+					conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+					n, err := conn.Read(b)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if string(b[:n]) != sent {
+						t.Fatalf("expected %q, got %q", sent, b[:n])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestUDPFlows(t *testing.T) {
+	//one channel, so one flow table
+	t.Setenv("CHISEL_UDP_CHANNELS", "1")
+	t.Setenv("CHISEL_UDP_MAX_FLOWS", "2")
+	t.Setenv("CHISEL_UDP_IDLE", "300ms")
+	echoPort := udpEchoServer(t)
+	inboundPort := availableUDPPort()
+	teardown := simpleSetup(t,
+		&chserver.Config{},
+		&chclient.Config{
+			Remotes: []string{
+				"127.0.0.1:" + inboundPort + ":127.0.0.1:" + echoPort + "/udp",
+			},
+		},
+	)
+	defer teardown()
+	before := udpStats(t)
+	//more flows than the table holds, evicting the oldest
+	conns := []net.Conn{}
+	for i := 0; i < 4; i++ {
+		conn, err := net.Dial("udp", "127.0.0.1:"+inboundPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	for round := 0; round < 2; round++ {
+		for i, conn := range conns {
+			sent := fmt.Sprintf("%d-%d", round, i)
+			if _, err := conn.Write([]byte(sent)); err != nil {
+				t.Fatal(err)
+			}
+			b := make([]byte, 128)
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			n, err := conn.Read(b)
+			if err != nil {
+				t.Fatalf("%s: %s", sent, err)
+			}
+			if string(b[:n]) != sent {
+				t.Fatalf("expected %q, got %q", sent, b[:n])
+			}
+		}
+	}
+	after := udpStats(t)
+	if after[1]-before[1] != 8 || after[2]-before[2] != 6 {
+		t.Fatalf("expected 8 flows and 6 evictions, got %s", tunnel.UDPStats())
+	}
+	//idle flows expire
+	time.Sleep(time.Second)
+	after = udpStats(t)
+	if after[0] != before[0] || after[3]-before[3] != 2 {
+		t.Fatalf("expected 2 expired flows, got %s", tunnel.UDPStats())
+	}
+}
+
+func TestUDPChannels(t *testing.T) {
+	t.Setenv("CHISEL_UDP_CHANNELS", "3")
+	t.Setenv("CHISEL_UDP_QUEUE", "1")
+	echoPort := udpEchoServer(t)
+	inboundPort := availableUDPPort()
+	sevents := &eventLog{}
+	d := &stallingDialer{}
+	teardown := simpleSetup(t,
+		&chserver.Config{OnEvent: sevents.add},
+		&chclient.Config{
+			Remotes: []string{
+				"127.0.0.1:" + inboundPort + ":127.0.0.1:" + echoPort + "/udp",
+			},
+			DialContext: d.DialContext,
+		},
+	)
+	defer teardown()
+	//sources are spread across the channels,
+	//add sources until each channel has one
+	shards := map[uint32]bool{}
+	var conns []net.Conn
+	for i := 0; len(shards) < 3; i++ {
+		if i == 64 {
+			t.Fatal("sources did not hash to every channel")
+		}
+		conn, err := net.Dial("udp", "127.0.0.1:"+inboundPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		h := fnv.New32a()
+		h.Write([]byte(conn.LocalAddr().String()))
+		shards[h.Sum32()%3] = true
+		conns = append(conns, conn)
+		for j := 0; j < 3; j++ {
+			sent := fmt.Sprintf("%d-%d", i, j)
+			if _, err := conn.Write([]byte(sent)); err != nil {
+				t.Fatal(err)
+			}
+			b := make([]byte, 128)
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			n, err := conn.Read(b)
+			if err != nil {
+				t.Fatalf("%s: %s", sent, err)
+			}
+			if string(b[:n]) != sent {
+				t.Fatalf("expected %q, got %q", sent, b[:n])
+			}
+		}
+	}
+	sevents.mu.Lock()
+	channels := 0
+	for _, e := range sevents.events {
+		if e.Type == tunnel.EventChannelOpened && e.Target == "127.0.0.1:"+echoPort+"/udp" {
+			channels++
+		}
+	}
+	sevents.mu.Unlock()
+	if channels != 3 {
+		t.Fatalf("expected %d sources to use 3 channels, got %d", len(conns), channels)
+	}
+	//packets are dropped, rather than queued without
+	//bound, while the connection to the server is stalled
+	dropped := udpStats(t)[4]
+	d.stall.Lock()
+	for i := 0; i < 50; i++ {
+		conns[0].Write([]byte("stalled"))
+	}
+	time.Sleep(200 * time.Millisecond)
+	d.stall.Unlock()
+	if s := udpStats(t); s[4] <= dropped {
+		t.Fatalf("expected dropped packets, got %d", s[4]-dropped)
+	}
+}
+
+// stallingDialer's connections block
+// their writes while stall is locked
+type stallingDialer struct {
+	stall sync.RWMutex
+}
+
+func (d *stallingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &stallingConn{Conn: conn, d: d}, nil
+}
+
+type stallingConn struct {
+	net.Conn
+	d *stallingDialer
+}
+
+func (c *stallingConn) Write(b []byte) (int, error) {
+	c.d.stall.RLock()
+	defer c.d.stall.RUnlock()
+	return c.Conn.Write(b)
+}
+
+// udpEchoServer starts a udp server which echoes each packet
+// back, until the test ends, returning its port
+func udpEchoServer(t *testing.T) string {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		b := make([]byte, 9000)
+		for {
+			n, a, err := echo.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(b[:n], a)
+		}
+	}()
+	_, port, _ := net.SplitHostPort(echo.LocalAddr().String())
+	return port
+}
+
+// udpStats parses the open, total, evicted and expired
+// udp flows, and the dropped packets
+func udpStats(t *testing.T) [5]int {
+	s := [5]int{}
+	if _, err := fmt.Sscanf(tunnel.UDPStats(), "udp-flows: %d open, %d total, %d evicted, %d expired, %d dropped packets", &s[0], &s[1], &s[2], &s[3], &s[4]); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
 func availableUDPPort() string {
 	a, _ := net.ResolveUDPAddr("udp", ":0")
 	l, err := net.ListenUDP("udp", a)